@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var bindAddress = flag.String("bind", "", "The address the server should listen on. Empty means all interfaces")
+var tokenFile = flag.String("tokenfile", "", "A file holding a shared token which clients can send with AUTH to control the LEDs")
+var usersFile = flag.String("users", "", "A file of users who can log in with AUTH, one per line as '<name> <role> <bcrypt hash of password>'")
+var tlsCert = flag.String("tlscert", "", "A PEM certificate file. If given with --tlskey, connections must use TLS")
+var tlsKey = flag.String("tlskey", "", "The PEM private key file for --tlscert")
+var unixSocket = flag.String("unix", "", "A Unix socket path the server should also listen on. Empty means none")
+var unixMode = flag.String("unixmode", "0660", "The permissions, in octal, for the Unix socket")
+var httpAddress = flag.String("http", "", "An address (host:port) to serve the browser viewer on, e.g. :8080. Empty means no viewer")
+
+// The number of failed AUTHs after which a connection is closed.
+const maxAuthFailures = 3
+
+// A role says which commands a connection may run.
+type role int
+
+const (
+	roleNone    role = iota // May only authenticate
+	roleRead                // May also run commands that don't change anything
+	roleControl             // May run anything
+)
+
+var roleNames = map[string]role{
+	"read":    roleRead,
+	"control": roleControl,
+}
+
+func (r role) String() string {
+	for n, nr := range roleNames {
+		if nr == r {
+			return n
+		}
+	}
+	return "none"
+}
+
+// authError is returned for failed authentication, and for commands a connection isn't allowed
+// to run. code is the protocol 2 status.
+type authError struct {
+	code int
+	msg  string
+}
+
+func (e authError) Error() string {
+	return e.msg
+}
+
+type user struct {
+	role role
+	hash []byte
+}
+
+// unknownUserHash is checked against when someone tries to log in as a user who doesn't exist.
+var unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+
+// authConfig holds who may connect, and what they may then do.
+type authConfig struct {
+	token string
+	users map[string]user
+}
+
+// loadAuth reads the token and users files. Either path may be empty. If both are, no
+// authentication is needed.
+func loadAuth(tokenPath, usersPath string) (*authConfig, error) {
+	a := authConfig{users: map[string]user{}}
+	if tokenPath != "" {
+		b, err := ioutil.ReadFile(tokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read token: %v", err)
+		}
+		a.token = strings.TrimSpace(string(b))
+		if a.token == "" {
+			return nil, fmt.Errorf("token file %s is empty", tokenPath)
+		}
+	}
+	if usersPath == "" {
+		return &a, nil
+	}
+	f, err := os.Open(usersPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open users: %v", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	n := 0
+	for sc.Scan() {
+		n++
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		t := strings.Fields(l)
+		if len(t) != 3 {
+			return nil, fmt.Errorf("%s line %d: want '<name> <role> <password hash>'", usersPath, n)
+		}
+		r, ok := roleNames[strings.ToLower(t[1])]
+		if !ok {
+			return nil, fmt.Errorf("%s line %d: unknown role '%s', want read or control", usersPath, n, t[1])
+		}
+		h := []byte(t[2])
+		if _, err := bcrypt.Cost(h); err != nil {
+			return nil, fmt.Errorf("%s line %d: password hash must be bcrypt: %v", usersPath, n, err)
+		}
+		if _, ok := a.users[t[0]]; ok {
+			return nil, fmt.Errorf("%s line %d: user '%s' is defined more than once", usersPath, n, t[0])
+		}
+		a.users[t[0]] = user{r, h}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read users: %v", err)
+	}
+	return &a, nil
+}
+
+// required returns whether connections must authenticate before doing anything. A nil authConfig
+// doesn't need authentication.
+func (a *authConfig) required() bool {
+	return a != nil && (a.token != "" || len(a.users) > 0)
+}
+
+// initialRole returns the role of a connection that hasn't authenticated.
+func (a *authConfig) initialRole() role {
+	if a.required() {
+		return roleNone
+	}
+	return roleControl
+}
+
+// login checks the parameters of an AUTH command, either "<token>" or "<user> <password>", and
+// returns the role they give.
+func (a *authConfig) login(parms string) (role, error) {
+	t := strings.Fields(parms)
+	switch {
+	case !a.required():
+		// Nothing to log in to
+	case len(t) == 1 && a.token != "":
+		if subtle.ConstantTimeCompare([]byte(t[0]), []byte(a.token)) == 1 {
+			return roleControl, nil
+		}
+	case len(t) == 2:
+		u, ok := a.users[t[0]]
+		if !ok {
+			// Take as long as for a real user, so as not to give away who exists
+			u.hash = unknownUserHash
+		}
+		if bcrypt.CompareHashAndPassword(u.hash, []byte(t[1])) == nil && ok {
+			return u.role, nil
+		}
+	}
+	return roleNone, authError{statusUnauthorized, "authentication failed"}
+}
+
+// allowed returns whether a connection with role r may run cmd.
+func allowed(r role, cmd, parms string) bool {
+	switch cmd {
+	case "AUTH", "PROTOCOL", "QUIT":
+		return true
+	}
+	if r >= roleControl {
+		return true
+	}
+	if r < roleRead {
+		return false
+	}
+	sub := strings.ToUpper(strings.SplitN(parms, " ", 2)[0])
+	switch cmd {
+	case "GET", "MODE", "COLOUR", "COLOR", "SEGMENTS", "SUBSCRIBE":
+		return true
+	case "PALETTE", "SCHEDULE":
+		return sub == "LIST"
+	case "ALARM", "RECORD":
+		return parms == ""
+	}
+	return false
+}
+
+// checkAllowed returns an error if a connection with role r may not run cmd.
+func checkAllowed(r role, cmd, parms string) error {
+	if allowed(r, cmd, parms) {
+		return nil
+	}
+	if r == roleNone {
+		return authError{statusUnauthorized, "authentication required"}
+	}
+	return authError{statusForbidden, "not allowed: " + cmd}
+}
+
+// authenticate handles an AUTH command, returning the connection's new role. On failure, the role
+// is unchanged. The reply is written on success, failures are replied to like any other error.
+func (s *Server) authenticate(parms string, r role, version int, id string, w *bufio.Writer) (role, error) {
+	nr, err := s.getAuth().login(parms)
+	if err != nil {
+		log.Printf("Failed authentication")
+		return r, err
+	}
+	log.Printf("Authenticated with role %s", nr)
+	if version >= 2 {
+		writeV2(w, id, nil, statusOK, "OK")
+	} else {
+		w.WriteString("OK\n")
+	}
+	return nr, w.Flush()
+}
+
+// getAuth returns the server's current authentication settings.
+func (s *Server) getAuth() *authConfig {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	return s.auth
+}
+
+func (s *Server) setAuth(a *authConfig) {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	s.auth = a
+}
+
+// newListener listens on TCP as described by lc, using TLS if it has a certificate and key.
+func newListener(lc ListenConfig) (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(lc.Bind, strconv.Itoa(lc.Port)))
+	if err != nil {
+		return nil, err
+	}
+	l, err = withTLS(lc, l)
+	if err != nil {
+		l.Close() // Ignore error, we already have one
+		return nil, err
+	}
+	return l, nil
+}
+
+// withTLS wraps l to accept only TLS connections, if lc has a certificate and key.
+func withTLS(lc ListenConfig, l net.Listener) (net.Listener, error) {
+	if lc.TLSCert == "" {
+		return l, nil
+	}
+	cert, err := tls.LoadX509KeyPair(lc.TLSCert, lc.TLSKey)
+	if err != nil {
+		return l, fmt.Errorf("couldn't load TLS certificate: %v", err)
+	}
+	return tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}), nil
+}
+
+// parseUnixMode parses the permissions for the Unix socket, in octal.
+func parseUnixMode(m string) (os.FileMode, error) {
+	v, err := strconv.ParseUint(m, 8, 32)
+	if err != nil || v > 0777 {
+		return 0, fmt.Errorf("'%s' isn't an octal file mode", m)
+	}
+	return os.FileMode(v), nil
+}
+
+// unixListener listens on the Unix socket given by lc, replacing any socket left behind by a
+// previous run. TLS isn't used: access to the socket is controlled by its permissions.
+func unixListener(lc ListenConfig) (net.Listener, error) {
+	mode, err := parseUnixMode(lc.UnixMode)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Lstat(lc.Unix); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(lc.Unix) // Ignore error, Listen will fail
+	}
+	// The socket's created with the permissions the umask allows. Setting them afterwards would
+	// leave a window where anyone the umask allows could connect.
+	um := syscall.Umask(0777 &^ int(mode))
+	l, err := net.Listen("unix", lc.Unix)
+	syscall.Umask(um)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
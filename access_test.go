@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeAuthFiles(t *testing.T, dir string) (string, string) {
+	token := filepath.Join(dir, "token")
+	err := ioutil.WriteFile(token, []byte("s3cret\n"), 0600)
+	if err != nil {
+		t.Fatalf("Couldn't write token: %v", err)
+	}
+	users := filepath.Join(dir, "users")
+	h, err := bcrypt.GenerateFromPassword([]byte("guest"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Couldn't hash password: %v", err)
+	}
+	err = ioutil.WriteFile(users, []byte("# Comment\nvisitor read "+string(h)+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("Couldn't write users: %v", err)
+	}
+	return token, users
+}
+
+func TestLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledctl")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	a, err := loadAuth(writeAuthFiles(t, dir))
+	if err != nil {
+		t.Fatalf("Couldn't load auth: %v", err)
+	}
+	tests := []struct {
+		parms string
+		want  role
+		ok    bool
+	}{
+		{"s3cret", roleControl, true},
+		{"wrong", roleNone, false},
+		{"visitor guest", roleRead, true},
+		{"visitor wrong", roleNone, false},
+		{"nobody guest", roleNone, false},
+		{"", roleNone, false},
+	}
+	for _, tc := range tests {
+		got, err := a.login(tc.parms)
+		if got != tc.want || (err == nil) != tc.ok {
+			t.Errorf("Wrong result for AUTH '%s', got: %v, %v, want: %v, ok %v", tc.parms, got, err, tc.want, tc.ok)
+		}
+	}
+
+	var none *authConfig
+	if none.initialRole() != roleControl {
+		t.Errorf("Connections need authenticating with no auth configured")
+	}
+	if _, err := none.login("anything"); err == nil {
+		t.Errorf("Logged in with no auth configured")
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		r     role
+		cmd   string
+		parms string
+		want  bool
+	}{
+		{roleNone, "AUTH", "x", true},
+		{roleNone, "MODE", "", false},
+		{roleRead, "MODE", "", true},
+		{roleRead, "COLOUR", "", true},
+		{roleRead, "SCHEDULE", "list", true},
+		{roleRead, "SCHEDULE", "DEL 1", false},
+		{roleRead, "ALARM", "", true},
+		{roleRead, "ALARM", "CANCEL", false},
+		{roleRead, "RECORD", "", true},
+		{roleRead, "RECORD", "STOP", false},
+		{roleRead, "FADE_ALL", "ff0000 1", false},
+		{roleControl, "FADE_ALL", "ff0000 1", true},
+	}
+	for _, tc := range tests {
+		if got := allowed(tc.r, tc.cmd, tc.parms); got != tc.want {
+			t.Errorf("Wrong result for %v running '%s %s', got: %v, want: %v", tc.r, tc.cmd, tc.parms, got, tc.want)
+		}
+	}
+}
+
+func TestAuthProtocol(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledctl")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s := newTestServer(4)
+	s.auth, err = loadAuth(writeAuthFiles(t, dir))
+	if err != nil {
+		t.Fatalf("Couldn't load auth: %v", err)
+	}
+	client, srv := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(srv)
+	r := bufio.NewReader(client)
+
+	tests := []struct {
+		send string
+		want string
+	}{
+		{"PROTOCOL 2", "200 OK"},
+		{"COLOUR", "401 authentication required"},
+		{"AUTH visitor wrong", "401 authentication failed"},
+		{"AUTH visitor guest", "200 OK"},
+		{"COLOUR", "200-010203"},
+		{"", "200 OK"},
+		{"FADE_ALL 0a0b0c 1", "403 not allowed: FADE_ALL"},
+		{"AUTH s3cret", "200 OK"},
+		{"FADE_ALL 0a0b0c 1", "200 OK"},
+		{"GET", "200-1"}, // By now, the fade has been started
+	}
+	for _, tc := range tests {
+		client.SetDeadline(time.Now().Add(time.Second))
+		if tc.send != "" {
+			_, err := client.Write([]byte(tc.send + "\n"))
+			if err != nil {
+				t.Fatalf("Couldn't send '%s': %v", tc.send, err)
+			}
+		}
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Couldn't read reply to '%s': %v", tc.send, err)
+		}
+		if got := strings.TrimSuffix(l, "\n"); got != tc.want {
+			t.Errorf("Wrong reply to '%s', got: '%s', want: '%s'", tc.send, got, tc.want)
+		}
+	}
+	if len(s.c) != 1 {
+		t.Errorf("Wrong number of effects started, got: %d, want: 1", len(s.c))
+	}
+}
+
+func TestAuthFailureLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledctl")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s := newTestServer(4)
+	s.auth, err = loadAuth(writeAuthFiles(t, dir))
+	if err != nil {
+		t.Fatalf("Couldn't load auth: %v", err)
+	}
+	client, srv := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(srv)
+	r := bufio.NewReader(client)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("PROTOCOL 2\n"))
+	r.ReadString('\n')
+	for i := 0; i < maxAuthFailures; i++ {
+		_, err := client.Write([]byte("AUTH visitor wrong\n"))
+		if err != nil {
+			t.Fatalf("Couldn't send AUTH %d: %v", i, err)
+		}
+		l, err := r.ReadString('\n')
+		if err != nil || l != "401 authentication failed\n" {
+			t.Fatalf("Wrong reply to AUTH %d, got: '%s', %v", i, l, err)
+		}
+	}
+	// The connection's now closed, so the pipe can't be written
+	if _, err := client.Write([]byte("AUTH visitor guest\n")); err == nil {
+		t.Errorf("Connection still open after %d failed AUTHs", maxAuthFailures)
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledctl")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	lc := ListenConfig{Unix: filepath.Join(dir, "ledctl.sock"), UnixMode: "0600"}
+	// A socket left behind by a previous run gets replaced
+	for i := 0; i < 2; i++ {
+		l, err := unixListener(lc)
+		if err != nil {
+			t.Fatalf("Couldn't listen on Unix socket: %v", err)
+		}
+		fi, err := os.Stat(lc.Unix)
+		if err != nil {
+			t.Fatalf("Couldn't stat Unix socket: %v", err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("Wrong permissions on Unix socket, got: %v, want: 0600", fi.Mode().Perm())
+		}
+		c, err := net.Dial("unix", lc.Unix)
+		if err != nil {
+			t.Errorf("Couldn't connect to Unix socket: %v", err)
+		} else {
+			c.Close()
+		}
+		if i == 0 {
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+}
@@ -0,0 +1,194 @@
+// Package clock tells the time and waits for it to pass. Code that takes a Clock rather than using
+// the time package directly can be tested with a Fake, whose time only moves when the test says.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Clock tells the time and waits for it to pass.
+type Clock interface {
+	Now() time.Time
+	// After waits for d to pass, then sends the time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+	// NewTimer is After, but the wait can be stopped, e.g. when something else happens first.
+	NewTimer(d time.Duration) (<-chan time.Time, Timer)
+	// AfterFunc waits for d to pass, then calls f in its own goroutine.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a call waiting to be made by AfterFunc, or a wait from NewTimer.
+type Timer interface {
+	// Stop stops the call being made or the time being sent, returning false if it's already
+	// happened or been stopped.
+	Stop() bool
+}
+
+// Real is the real time, as told by the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) (<-chan time.Time, Timer) {
+	t := time.NewTimer(d)
+	return t.C, t
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Fake is a Clock whose time only moves when Advance or Next is called. Everything waiting for a
+// time that's been reached is woken, in order of when it was waiting for. A channel from After
+// waits until its time is reached, even if nothing's receiving from it any more: code that might
+// give up on a wait should use NewTimer and stop it, so that Waiters and BlockUntil don't count it.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+	changed *sync.Cond
+}
+
+// A waiter is something waiting for a Fake to reach at: either a channel from After, or a call
+// from AfterFunc.
+type waiter struct {
+	f  *Fake
+	at time.Time
+	c  chan time.Time
+	fn func()
+}
+
+// NewFake returns a Fake whose time is now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	c, _ := f.NewTimer(d)
+	return c
+}
+
+func (f *Fake) NewTimer(d time.Duration) (<-chan time.Time, Timer) {
+	c := make(chan time.Time, 1)
+	w := &waiter{f: f, c: c}
+	f.wait(d, w)
+	return c, w
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	w := &waiter{f: f, fn: fn}
+	f.wait(d, w)
+	return w
+}
+
+// wait adds w, to be woken once d has passed, or wakes it straight away if d isn't positive.
+func (f *Fake) wait(d time.Duration, w *waiter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.at = f.now.Add(d)
+	if d <= 0 {
+		w.wake(f.now)
+		return
+	}
+	// After any others waiting for the same time, so those added first are woken first
+	i := sort.Search(len(f.waiters), func(i int) bool { return f.waiters[i].at.After(w.at) })
+	f.waiters = append(f.waiters, nil)
+	copy(f.waiters[i+1:], f.waiters[i:])
+	f.waiters[i] = w
+	f.changed.Broadcast()
+}
+
+func (w *waiter) wake(now time.Time) {
+	if w.c != nil {
+		w.c <- now
+		return
+	}
+	go w.fn()
+}
+
+func (w *waiter) Stop() bool {
+	f := w.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, o := range f.waiters {
+		if o == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			f.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the time on by d, waking everything waiting for a time up to then. Each is woken
+// with the time set to when it was waiting for.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := f.now.Add(d)
+	for len(f.waiters) > 0 && !f.waiters[0].at.After(end) {
+		f.wakeFirst()
+	}
+	f.now = end
+}
+
+// Next moves the time on to when the first waiter is waiting for, and wakes it and anything else
+// waiting for the same time, returning the new time. If nothing is waiting, the time doesn't
+// change.
+func (f *Fake) Next() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.waiters) == 0 {
+		return f.now
+	}
+	at := f.waiters[0].at
+	for len(f.waiters) > 0 && f.waiters[0].at.Equal(at) {
+		f.wakeFirst()
+	}
+	return f.now
+}
+
+// wakeFirst moves the time on to when the first waiter is waiting for, and wakes it. f.mu must be
+// held.
+func (f *Fake) wakeFirst() {
+	w := f.waiters[0]
+	f.waiters = f.waiters[1:]
+	f.now = w.at
+	w.wake(w.at)
+	f.changed.Broadcast()
+}
+
+// Waiters returns how many channels and calls are waiting.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// BlockUntil returns once at least n channels and calls are waiting, e.g. once the code under test
+// has caught up and is waiting for the time to move on.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		f.changed.Wait()
+	}
+}
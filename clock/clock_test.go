@@ -0,0 +1,84 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	c2 := f.After(2 * time.Second)
+	c1 := f.After(time.Second)
+	called := make(chan time.Time, 1)
+	f.AfterFunc(3*time.Second, func() { called <- f.Now() })
+	stopped := f.AfterFunc(time.Second, func() { t.Errorf("Stopped call made") })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Errorf("Wrong results stopping call")
+	}
+	tc, tm := f.NewTimer(time.Second)
+	if !tm.Stop() || tm.Stop() {
+		t.Errorf("Wrong results stopping timer")
+	}
+	if f.Waiters() != 3 {
+		t.Errorf("Wrong number of waiters, got: %d, want: 3", f.Waiters())
+	}
+	select {
+	case <-f.After(0):
+	default:
+		t.Errorf("Zero wait didn't wake straight away")
+	}
+
+	if got := f.Next(); !got.Equal(start.Add(time.Second)) {
+		t.Errorf("Wrong time after Next, got: %v", got)
+	}
+	select {
+	case got := <-c1:
+		if !got.Equal(start.Add(time.Second)) {
+			t.Errorf("Wrong time woken, got: %v", got)
+		}
+	default:
+		t.Errorf("First waiter not woken")
+	}
+	select {
+	case <-c2:
+		t.Errorf("Second waiter woken early")
+	default:
+	}
+
+	f.Advance(5 * time.Second)
+	if got := f.Now(); !got.Equal(start.Add(6 * time.Second)) {
+		t.Errorf("Wrong time after Advance, got: %v", got)
+	}
+	if got := <-c2; !got.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("Wrong time woken, got: %v", got)
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Errorf("Call not made")
+	}
+	select {
+	case <-tc:
+		t.Errorf("Stopped timer sent the time")
+	default:
+	}
+	if f.Waiters() != 0 {
+		t.Errorf("Waiters left, got: %d", f.Waiters())
+	}
+	if got := f.Next(); !got.Equal(start.Add(6 * time.Second)) {
+		t.Errorf("Next with nothing waiting moved the time to %v", got)
+	}
+
+	done := make(chan bool)
+	go func() {
+		f.BlockUntil(1)
+		close(done)
+	}()
+	f.After(time.Minute)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("BlockUntil didn't return")
+	}
+}
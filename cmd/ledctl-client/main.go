@@ -0,0 +1,293 @@
+// Command ledctl-client sends commands to a ledctl server.
+//
+//	ledctl-client [flags] <command> [<parameters>...]
+//	ledctl-client [flags]
+//
+// With a command, it runs it and prints the reply. Without one, it reads commands from stdin,
+// one per line. Commands are sent as they are: the server understands colours as CSS names,
+// #rrggbb or hsv(h,s,v) as well as hex.
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var addr = flag.String("addr", "localhost:24601", "The server's address, as host:port")
+var unixSocket = flag.String("unix", "", "The server's Unix socket, used instead of --addr")
+var useTLS = flag.Bool("tls", false, "Connect using TLS")
+var caCert = flag.String("cacert", "", "A PEM file of CA certificates to check the server's certificate against, e.g. its own self-signed certificate. Empty means the system's CAs")
+var user = flag.String("user", "", "The user to authenticate as, with the password from $LEDCTL_PASSWORD. Without this, $LEDCTL_TOKEN is used if set")
+var jsonOut = flag.Bool("json", false, "Print replies as JSON, one object per line")
+var completion = flag.Bool("completion", false, "Print a bash completion script and exit, e.g. for: source <(ledctl-client --completion)")
+
+// commands lists the server's commands, for completion and help.
+var commands = []string{
+	"ALARM", "AUTH", "BREATHE", "COLOUR", "CYCLE", "FADE_ALL", "GET", "KNIGHTRIDER", "MODE", "OFF",
+	"ON", "PALETTE", "PLAYBACK", "PROTOCOL", "QUIT", "RAINBOW", "RECORD", "RELOAD", "SCHEDULE",
+	"SEGMENTS", "SUBSCRIBE", "SUNRISE", "SUNSET", "TWINKLE", "ZIP_SET_ALL",
+}
+
+// A reply is the server's response to one command.
+type reply struct {
+	Command string   `json:"command"`
+	Status  int      `json:"status"`
+	Message string   `json:"message"`
+	Data    []string `json:"data,omitempty"`
+}
+
+// An event is sent after SUBSCRIBE.
+type event struct {
+	Event string `json:"event"`
+}
+
+// A client is a connection to the server, speaking protocol 2.
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	next int
+}
+
+// dial connects to the server and authenticates, if there's anything to authenticate with.
+func dial() (*client, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case *unixSocket != "":
+		conn, err = net.Dial("unix", *unixSocket)
+	case *useTLS:
+		var cfg tls.Config
+		if *caCert != "" {
+			pem, err := ioutil.ReadFile(*caCert)
+			if err != nil {
+				return nil, err
+			}
+			cfg.RootCAs = x509.NewCertPool()
+			if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", *caCert)
+			}
+		}
+		conn, err = tls.Dial("tcp", *addr, &cfg)
+	default:
+		conn, err = net.Dial("tcp", *addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(conn)
+	err = c.check("PROTOCOL 2")
+	if err == nil {
+		if *user != "" {
+			err = c.check("AUTH " + *user + " " + os.Getenv("LEDCTL_PASSWORD"))
+		} else if t := os.Getenv("LEDCTL_TOKEN"); t != "" {
+			err = c.check("AUTH " + t)
+		}
+	}
+	if err != nil {
+		conn.Close() // Ignore error, we already have one
+		return nil, err
+	}
+	return c, nil
+}
+
+func newClient(conn net.Conn) *client {
+	return &client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), next: 1}
+}
+
+var statusLine = regexp.MustCompile(`^(\d{3})([ -])(.*)$`)
+
+// do sends a command and returns the server's reply.
+func (c *client) do(cmd string) (*reply, error) {
+	id := fmt.Sprintf("#%d", c.next)
+	c.next++
+	c.w.WriteString(id + " " + cmd + "\n")
+	err := c.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+	rp := reply{Command: cmd}
+	if strings.HasPrefix(strings.ToUpper(cmd), "AUTH ") {
+		rp.Command = "AUTH ..." // Keep the password out of the output
+	}
+	for {
+		l, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		l = strings.TrimSuffix(l, "\n")
+		if !strings.HasPrefix(l, id+" ") {
+			return nil, fmt.Errorf("unexpected reply '%s'", l)
+		}
+		m := statusLine.FindStringSubmatch(strings.TrimPrefix(l, id+" "))
+		if m == nil {
+			return nil, fmt.Errorf("unexpected reply '%s'", l)
+		}
+		if m[2] == "-" {
+			rp.Data = append(rp.Data, m[3])
+			continue
+		}
+		fmt.Sscanf(m[1], "%d", &rp.Status) // Can't fail, the regexp checked it
+		rp.Message = m[3]
+		return &rp, nil
+	}
+}
+
+// check sends a command and returns an error if it doesn't succeed.
+func (c *client) check(cmd string) error {
+	rp, err := c.do(cmd)
+	if err != nil {
+		return err
+	}
+	if rp.Status != 200 {
+		return fmt.Errorf("%s: %s", rp.Command, rp.Message)
+	}
+	return nil
+}
+
+// events calls f for each event sent after SUBSCRIBE, until the connection closes.
+func (c *client) events(f func(string)) error {
+	for {
+		l, err := c.r.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		t := strings.SplitN(strings.TrimSuffix(l, "\n"), "EVENT ", 2)
+		if len(t) == 2 {
+			f(t[1])
+		}
+	}
+}
+
+// printReply writes rp, as JSON if --json was given.
+func printReply(w io.Writer, rp *reply) {
+	if *jsonOut {
+		json.NewEncoder(w).Encode(rp) // Ignore error, nowhere to report it
+		return
+	}
+	for _, d := range rp.Data {
+		fmt.Fprintln(w, d)
+	}
+	if rp.Status != 200 {
+		fmt.Fprintf(w, "Error: %s\n", rp.Message)
+	}
+}
+
+// printEvent writes an event, as JSON if --json was given.
+func printEvent(w io.Writer, ev string) {
+	if *jsonOut {
+		json.NewEncoder(w).Encode(event{ev}) // Ignore error, nowhere to report it
+		return
+	}
+	fmt.Fprintln(w, ev)
+}
+
+// run runs one command line, printing the reply. It returns whether the command succeeded, and
+// whether the connection is finished with (after QUIT or SUBSCRIBE).
+func run(c *client, args []string, out io.Writer) (bool, bool, error) {
+	cmd := strings.Join(args, " ")
+	if strings.ToUpper(args[0]) == "QUIT" {
+		// The server just closes the connection
+		c.w.WriteString("QUIT\n")
+		return true, true, c.w.Flush()
+	}
+	rp, err := c.do(cmd)
+	if err != nil {
+		return false, true, err
+	}
+	printReply(out, rp)
+	if strings.ToUpper(args[0]) == "SUBSCRIBE" && rp.Status == 200 {
+		err = c.events(func(ev string) { printEvent(out, ev) })
+		return err == nil, true, err
+	}
+	return rp.Status == 200, false, nil
+}
+
+// repl runs commands read from in, one per line, until in ends.
+func repl(c *client, in io.Reader, out io.Writer, prompt bool) error {
+	sc := bufio.NewScanner(in)
+	for {
+		if prompt {
+			fmt.Fprint(out, "ledctl> ")
+		}
+		if !sc.Scan() {
+			return sc.Err()
+		}
+		args := strings.Fields(sc.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if strings.ToUpper(args[0]) == "HELP" {
+			fmt.Fprintln(out, strings.Join(commands, " "))
+			continue
+		}
+		_, done, err := run(c, args, out)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+const completionScript = `_ledctl_client() {
+	local i
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case "${COMP_WORDS[i]}" in
+		-*) ;;
+		*) return ;; # The command's already there
+		esac
+	done
+	COMPREPLY=($(compgen -W "%s" -- "${COMP_WORDS[COMP_CWORD]}"))
+}
+complete -F _ledctl_client ledctl-client
+`
+
+func main() {
+	flag.Parse()
+	if *completion {
+		cs := append([]string{}, commands...)
+		sort.Strings(cs)
+		fmt.Printf(completionScript, strings.Join(cs, " "))
+		return
+	}
+	c, err := dial()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't connect: %v\n", err)
+		os.Exit(1)
+	}
+	defer c.conn.Close()
+	if flag.NArg() == 0 {
+		fi, err := os.Stdin.Stat()
+		prompt := err == nil && fi.Mode()&os.ModeCharDevice != 0
+		err = repl(c, os.Stdin, os.Stdout, prompt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	ok, _, err := run(c, flag.Args(), os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
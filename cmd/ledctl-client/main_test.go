@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer replies to each request it reads with the lines from replies, with the request's ID
+// in front, and sends "after" once it's run out of replies.
+func fakeServer(t *testing.T, conn net.Conn, replies [][]string, after string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, rs := range replies {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Errorf("Fake server couldn't read: %v", err)
+			return
+		}
+		id := strings.SplitN(l, " ", 2)[0]
+		for _, rl := range rs {
+			conn.Write([]byte(id + " " + rl + "\n"))
+		}
+	}
+	conn.Write([]byte(after))
+}
+
+func TestRepl(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+	go fakeServer(t, srv, [][]string{
+		{"200-010203", "200 OK"},
+		{"404 unknown command: BOGUS"},
+		{"200 OK"},
+	}, "#3 100 EVENT MODE CONST\n")
+	client.SetDeadline(time.Now().Add(time.Second))
+	c := newClient(client)
+	var out bytes.Buffer
+	err := repl(c, strings.NewReader("COLOUR\n\nBOGUS\nSUBSCRIBE\nMODE\n"), &out, false)
+	if err != nil {
+		t.Fatalf("REPL failed: %v", err)
+	}
+	want := "010203\nError: unknown command: BOGUS\nMODE CONST\n"
+	if out.String() != want {
+		t.Errorf("Wrong output, got: %q, want: %q", out.String(), want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	*jsonOut = true
+	defer func() { *jsonOut = false }()
+	client, srv := net.Pipe()
+	defer client.Close()
+	go fakeServer(t, srv, [][]string{{"200-shelf 0 40", "200 OK"}}, "")
+	client.SetDeadline(time.Now().Add(time.Second))
+	var out bytes.Buffer
+	ok, _, err := run(newClient(client), []string{"SEGMENTS"}, &out)
+	if !ok || err != nil {
+		t.Fatalf("SEGMENTS failed: %v", err)
+	}
+	want := `{"command":"SEGMENTS","status":200,"message":"OK","data":["shelf 0 40"]}` + "\n"
+	if out.String() != want {
+		t.Errorf("Wrong output, got: %q, want: %q", out.String(), want)
+	}
+}
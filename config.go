@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	effects "github.com/Jon-Bright/ledctl/effects"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	yaml "gopkg.in/yaml.v3"
+)
+
+var configFile = flag.String("config", "", "A YAML file describing outputs, segments, power, listeners and defaults. Flags given on the command line override it")
+var printConfig = flag.Bool("print-config", false, "Print the effective configuration (the config file with any flags applied) and exit")
+
+// Config is everything that can be set in the config file. Every field corresponds to a flag,
+// apart from Segments, which can only be set in the file.
+type Config struct {
+	Output   OutputConfig    `yaml:"output"`
+	Segments []SegmentConfig `yaml:"segments,omitempty"`
+	Power    PowerConfig     `yaml:"power"`
+	Listen   ListenConfig    `yaml:"listen"`
+	Layout   LayoutConfig    `yaml:"layout"`
+	Preview  PreviewConfig   `yaml:"preview"`
+	Defaults DefaultsConfig  `yaml:"defaults"`
+}
+
+// OutputConfig describes the LEDs and how they're connected.
+type OutputConfig struct {
+	Chip       string  `yaml:"chip"`
+	Pixels     int     `yaml:"pixels"`
+	Order      string  `yaml:"order"`
+	Dev        string  `yaml:"dev"`
+	SPISpeed   uint    `yaml:"spispeed"`
+	Freq       uint    `yaml:"freq"`
+	DMA        int     `yaml:"dma"`
+	Pin0       int     `yaml:"pin0"`
+	Pin1       int     `yaml:"pin1"`
+	SPIBits    int     `yaml:"spibits"`
+	Brightness float64 `yaml:"brightness"`
+	Gamma      float64 `yaml:"gamma"`
+}
+
+// SegmentConfig names a contiguous range of pixels, e.g. the part of the strip behind a shelf.
+type SegmentConfig struct {
+	Name   string `yaml:"name"`
+	Start  int    `yaml:"start"`
+	Length int    `yaml:"length"`
+}
+
+// PowerConfig describes the GPIO pins controlling power to the LEDs.
+type PowerConfig struct {
+	CtrlPin    int    `yaml:"ctrlpin"`
+	StatusPin  int    `yaml:"statuspin"`
+	StatusWait string `yaml:"statuswait"`
+}
+
+// ListenConfig describes where the server listens for connections, and who may connect.
+type ListenConfig struct {
+	Port      int    `yaml:"port"`
+	Bind      string `yaml:"bind,omitempty"`
+	TokenFile string `yaml:"tokenfile,omitempty"`
+	Users     string `yaml:"users,omitempty"`
+	TLSCert   string `yaml:"tlscert,omitempty"`
+	TLSKey    string `yaml:"tlskey,omitempty"`
+	Unix      string `yaml:"unix,omitempty"`
+	UnixMode  string `yaml:"unixmode"`
+	HTTP      string `yaml:"http,omitempty"`
+}
+
+// LayoutConfig describes how the pixels are arranged physically, for previews.
+type LayoutConfig struct {
+	Shape      string `yaml:"shape"`
+	Width      int    `yaml:"width"`
+	Serpentine bool   `yaml:"serpentine"`
+}
+
+func (lc LayoutConfig) pixLayout() pixarray.Layout {
+	return pixarray.Layout{Shape: lc.Shape, Width: lc.Width, Serpentine: lc.Serpentine}
+}
+
+// PreviewConfig describes how the LEDs are shown without looking at them.
+type PreviewConfig struct {
+	Terminal bool    `yaml:"terminal"`
+	FPS      float64 `yaml:"fps"`
+}
+
+// DefaultsConfig holds everything else: where state is kept and how the server starts up.
+type DefaultsConfig struct {
+	State        string   `yaml:"state,omitempty"`
+	Restore      bool     `yaml:"restore"`
+	Schedule     string   `yaml:"schedule,omitempty"`
+	Palettes     string   `yaml:"palettes,omitempty"`
+	Recordings   string   `yaml:"recordings,omitempty"`
+	Latitude     *float64 `yaml:"latitude,omitempty"`
+	Longitude    *float64 `yaml:"longitude,omitempty"`
+	ShutdownFade string   `yaml:"shutdownfade"`
+}
+
+// segments holds the segments from the effective config.
+var segmentsMu sync.Mutex
+var segments []SegmentConfig
+
+// getSegments returns the segments from the effective config.
+func getSegments() []SegmentConfig {
+	segmentsMu.Lock()
+	defer segmentsMu.Unlock()
+	return segments
+}
+
+func setSegments(sgs []SegmentConfig) {
+	segmentsMu.Lock()
+	defer segmentsMu.Unlock()
+	segments = sgs
+}
+
+// baseConfig is the config before the config file was applied: defaults, plus anything given on
+// the command line. explicitFlags are the flags given on the command line. Both are needed to
+// reload the config file.
+var baseConfig *Config
+var explicitFlags map[string]bool
+
+// configFromFlags returns a Config reflecting the current values of all flags.
+func configFromFlags() *Config {
+	c := Config{
+		Output: OutputConfig{
+			Chip:       *ledChip,
+			Pixels:     *pixels,
+			Order:      *pixelOrder,
+			Dev:        *lpd8806Dev,
+			SPISpeed:   *lpd8806SpiSpeed,
+			Freq:       *ws281xFreq,
+			DMA:        *ws281xDma,
+			Pin0:       *ws281xPin0,
+			Pin1:       *ws281xPin1,
+			SPIBits:    *ws281xSpiBits,
+			Brightness: *brightness,
+			Gamma:      *gamma,
+		},
+		Segments: getSegments(),
+		Power: PowerConfig{
+			CtrlPin:    *powerCtrlPin,
+			StatusPin:  *powerStatusPin,
+			StatusWait: powerStatusWait.String(),
+		},
+		Listen: ListenConfig{
+			Port:      *port,
+			Bind:      *bindAddress,
+			TokenFile: *tokenFile,
+			Users:     *usersFile,
+			TLSCert:   *tlsCert,
+			TLSKey:    *tlsKey,
+			Unix:      *unixSocket,
+			UnixMode:  *unixMode,
+			HTTP:      *httpAddress,
+		},
+		Layout: LayoutConfig{
+			Shape:      *layoutShape,
+			Width:      *layoutWidth,
+			Serpentine: *serpentine,
+		},
+		Preview: PreviewConfig{
+			Terminal: *preview,
+			FPS:      *previewFPS,
+		},
+		Defaults: DefaultsConfig{
+			State:        *stateFile,
+			Restore:      *restoreState,
+			Schedule:     *scheduleFile,
+			Palettes:     *paletteFile,
+			Recordings:   *recordingsDir,
+			ShutdownFade: shutdownFade.String(),
+		},
+	}
+	if !math.IsNaN(*latitude) {
+		lat := *latitude
+		c.Defaults.Latitude = &lat
+	}
+	if !math.IsNaN(*longitude) {
+		long := *longitude
+		c.Defaults.Longitude = &long
+	}
+	return &c
+}
+
+// setFlags sets every flag to the value from c. The rest of the server only looks at flags. c must
+// have been validated.
+func (c *Config) setFlags() {
+	*ledChip = c.Output.Chip
+	*pixels = c.Output.Pixels
+	*pixelOrder = c.Output.Order
+	*lpd8806Dev = c.Output.Dev
+	*lpd8806SpiSpeed = c.Output.SPISpeed
+	*ws281xFreq = c.Output.Freq
+	*ws281xDma = c.Output.DMA
+	*ws281xPin0 = c.Output.Pin0
+	*ws281xPin1 = c.Output.Pin1
+	*ws281xSpiBits = c.Output.SPIBits
+	*brightness = c.Output.Brightness
+	*gamma = c.Output.Gamma
+	*powerCtrlPin = c.Power.CtrlPin
+	*powerStatusPin = c.Power.StatusPin
+	*powerStatusWait, _ = time.ParseDuration(c.Power.StatusWait) // Checked by validate
+	*port = c.Listen.Port
+	*bindAddress = c.Listen.Bind
+	*tokenFile = c.Listen.TokenFile
+	*usersFile = c.Listen.Users
+	*tlsCert = c.Listen.TLSCert
+	*tlsKey = c.Listen.TLSKey
+	*unixSocket = c.Listen.Unix
+	*unixMode = c.Listen.UnixMode
+	*httpAddress = c.Listen.HTTP
+	*layoutShape = c.Layout.Shape
+	*layoutWidth = c.Layout.Width
+	*serpentine = c.Layout.Serpentine
+	*preview = c.Preview.Terminal
+	*previewFPS = c.Preview.FPS
+	*stateFile = c.Defaults.State
+	*restoreState = c.Defaults.Restore
+	*scheduleFile = c.Defaults.Schedule
+	*paletteFile = c.Defaults.Palettes
+	*recordingsDir = c.Defaults.Recordings
+	*latitude = math.NaN()
+	if c.Defaults.Latitude != nil {
+		*latitude = *c.Defaults.Latitude
+	}
+	*longitude = math.NaN()
+	if c.Defaults.Longitude != nil {
+		*longitude = *c.Defaults.Longitude
+	}
+	*shutdownFade, _ = time.ParseDuration(c.Defaults.ShutdownFade) // Checked by validate
+	setSegments(c.Segments)
+}
+
+// flagSettings copies the setting for each flag from one Config to another.
+var flagSettings = map[string]func(dst, src *Config){
+	"ledchip":         func(d, s *Config) { d.Output.Chip = s.Output.Chip },
+	"pixels":          func(d, s *Config) { d.Output.Pixels = s.Output.Pixels },
+	"order":           func(d, s *Config) { d.Output.Order = s.Output.Order },
+	"dev":             func(d, s *Config) { d.Output.Dev = s.Output.Dev },
+	"spispeed":        func(d, s *Config) { d.Output.SPISpeed = s.Output.SPISpeed },
+	"ws281xfreq":      func(d, s *Config) { d.Output.Freq = s.Output.Freq },
+	"ws281xdma":       func(d, s *Config) { d.Output.DMA = s.Output.DMA },
+	"ws281xpin0":      func(d, s *Config) { d.Output.Pin0 = s.Output.Pin0 },
+	"ws281xpin1":      func(d, s *Config) { d.Output.Pin1 = s.Output.Pin1 },
+	"ws281xspibits":   func(d, s *Config) { d.Output.SPIBits = s.Output.SPIBits },
+	"brightness":      func(d, s *Config) { d.Output.Brightness = s.Output.Brightness },
+	"gamma":           func(d, s *Config) { d.Output.Gamma = s.Output.Gamma },
+	"powerCtrlPin":    func(d, s *Config) { d.Power.CtrlPin = s.Power.CtrlPin },
+	"powerStatusPin":  func(d, s *Config) { d.Power.StatusPin = s.Power.StatusPin },
+	"powerStatusWait": func(d, s *Config) { d.Power.StatusWait = s.Power.StatusWait },
+	"port":            func(d, s *Config) { d.Listen.Port = s.Listen.Port },
+	"bind":            func(d, s *Config) { d.Listen.Bind = s.Listen.Bind },
+	"tokenfile":       func(d, s *Config) { d.Listen.TokenFile = s.Listen.TokenFile },
+	"users":           func(d, s *Config) { d.Listen.Users = s.Listen.Users },
+	"tlscert":         func(d, s *Config) { d.Listen.TLSCert = s.Listen.TLSCert },
+	"tlskey":          func(d, s *Config) { d.Listen.TLSKey = s.Listen.TLSKey },
+	"unix":            func(d, s *Config) { d.Listen.Unix = s.Listen.Unix },
+	"unixmode":        func(d, s *Config) { d.Listen.UnixMode = s.Listen.UnixMode },
+	"http":            func(d, s *Config) { d.Listen.HTTP = s.Listen.HTTP },
+	"layout":          func(d, s *Config) { d.Layout.Shape = s.Layout.Shape },
+	"layoutwidth":     func(d, s *Config) { d.Layout.Width = s.Layout.Width },
+	"serpentine":      func(d, s *Config) { d.Layout.Serpentine = s.Layout.Serpentine },
+	"preview":         func(d, s *Config) { d.Preview.Terminal = s.Preview.Terminal },
+	"previewfps":      func(d, s *Config) { d.Preview.FPS = s.Preview.FPS },
+	"state":           func(d, s *Config) { d.Defaults.State = s.Defaults.State },
+	"restore":         func(d, s *Config) { d.Defaults.Restore = s.Defaults.Restore },
+	"schedule":        func(d, s *Config) { d.Defaults.Schedule = s.Defaults.Schedule },
+	"palettes":        func(d, s *Config) { d.Defaults.Palettes = s.Defaults.Palettes },
+	"recordings":      func(d, s *Config) { d.Defaults.Recordings = s.Defaults.Recordings },
+	"latitude":        func(d, s *Config) { d.Defaults.Latitude = s.Defaults.Latitude },
+	"longitude":       func(d, s *Config) { d.Defaults.Longitude = s.Defaults.Longitude },
+	"shutdownfade":    func(d, s *Config) { d.Defaults.ShutdownFade = s.Defaults.ShutdownFade },
+}
+
+// overrideFromFlags sets every setting in c whose flag was given on the command line to that
+// flag's value.
+func (c *Config) overrideFromFlags() {
+	f := configFromFlags()
+	for name := range explicitFlags {
+		if set, ok := flagSettings[name]; ok {
+			set(c, f)
+		}
+	}
+}
+
+// clone returns a deep copy of c.
+func (c *Config) clone() *Config {
+	n := *c
+	n.Segments = append([]SegmentConfig(nil), c.Segments...)
+	if c.Defaults.Latitude != nil {
+		lat := *c.Defaults.Latitude
+		n.Defaults.Latitude = &lat
+	}
+	if c.Defaults.Longitude != nil {
+		long := *c.Defaults.Longitude
+		n.Defaults.Longitude = &long
+	}
+	return &n
+}
+
+// diffConfig returns the names (as in the config file) of the settings that differ between
+// the structs a and b, prefixed with prefix.
+func diffConfig(prefix string, a, b interface{}) []string {
+	var d []string
+	va := reflect.ValueOf(a)
+	vb := reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			n := strings.SplitN(va.Type().Field(i).Tag.Get("yaml"), ",", 2)[0]
+			d = append(d, prefix+"."+n)
+		}
+	}
+	return d
+}
+
+// parseConfig reads a config file from r. Anything not mentioned in the file keeps the value
+// it already has in c.
+func parseConfig(r io.Reader, c *Config) error {
+	d := yaml.NewDecoder(r)
+	d.KnownFields(true)
+	err := d.Decode(c)
+	if err == io.EOF {
+		// Empty file
+		return nil
+	}
+	return err
+}
+
+// validate checks c for anything that would stop the server working, returning an error naming
+// the offending setting.
+func (c *Config) validate() error {
+	o := &c.Output
+	switch o.Chip {
+	case "ws281x", "ws281xspi", "lpd8806", "sim":
+	default:
+		return fmt.Errorf("output.chip '%s' isn't one of ws281x, ws281xspi, lpd8806, sim", o.Chip)
+	}
+	if o.Pixels <= 0 {
+		return fmt.Errorf("output.pixels must be positive, not %d", o.Pixels)
+	}
+	if _, ok := pixarray.StringOrders[o.Order]; !ok {
+		return fmt.Errorf("output.order '%s' isn't a known pixel order, e.g. RGB or GRB", o.Order)
+	}
+	if o.Chip == "lpd8806" {
+		if o.Dev == "" {
+			return fmt.Errorf("output.dev must be set for lpd8806")
+		}
+		if o.SPISpeed == 0 {
+			return fmt.Errorf("output.spispeed must be positive")
+		}
+	}
+	if o.Chip == "ws281xspi" {
+		if o.Dev == "" {
+			return fmt.Errorf("output.dev must be set for ws281xspi")
+		}
+		if o.Freq == 0 {
+			return fmt.Errorf("output.freq must be positive")
+		}
+		if o.SPIBits != 3 && o.SPIBits != 4 {
+			return fmt.Errorf("output.spibits must be 3 or 4, not %d", o.SPIBits)
+		}
+	}
+	if o.Chip == "ws281x" {
+		if o.Freq == 0 {
+			return fmt.Errorf("output.freq must be positive")
+		}
+		if o.DMA < 0 || o.DMA > 14 {
+			return fmt.Errorf("output.dma must be between 0 and 14, not %d", o.DMA)
+		}
+		if o.Pin0 < 0 && o.Pin1 < 0 {
+			return fmt.Errorf("at least one of output.pin0 and output.pin1 must be set")
+		}
+	}
+	if o.Brightness <= 0 || o.Brightness > 1 {
+		return fmt.Errorf("output.brightness must be more than 0 and at most 1, not %g", o.Brightness)
+	}
+	if o.Gamma < 1 || o.Gamma > 5 {
+		return fmt.Errorf("output.gamma must be between 1 and 5, not %g", o.Gamma)
+	}
+	names := map[string]bool{}
+	for i, s := range c.Segments {
+		if s.Name == "" {
+			return fmt.Errorf("segments[%d] has no name", i)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("segment '%s' is defined more than once", s.Name)
+		}
+		names[s.Name] = true
+		if s.Start < 0 || s.Length <= 0 || s.Start+s.Length > o.Pixels {
+			return fmt.Errorf("segment '%s' (start %d, length %d) doesn't fit in %d pixels", s.Name, s.Start, s.Length, o.Pixels)
+		}
+	}
+	p := &c.Power
+	if p.CtrlPin < -1 {
+		return fmt.Errorf("power.ctrlpin must be a GPIO pin or -1, not %d", p.CtrlPin)
+	}
+	if p.StatusPin < -1 {
+		return fmt.Errorf("power.statuspin must be a GPIO pin or -1, not %d", p.StatusPin)
+	}
+	if p.CtrlPin >= 0 && (p.CtrlPin == p.StatusPin || (o.Chip == "ws281x" && (p.CtrlPin == o.Pin0 || p.CtrlPin == o.Pin1))) {
+		return fmt.Errorf("power.ctrlpin %d is already in use", p.CtrlPin)
+	}
+	d, err := time.ParseDuration(p.StatusWait)
+	if err != nil {
+		return fmt.Errorf("power.statuswait: %v", err)
+	}
+	if d < 0 {
+		return fmt.Errorf("power.statuswait must not be negative")
+	}
+	if c.Listen.Port < 0 || c.Listen.Port > 65535 {
+		return fmt.Errorf("listen.port must be between 0 and 65535, not %d", c.Listen.Port)
+	}
+	if (c.Listen.TLSCert == "") != (c.Listen.TLSKey == "") {
+		return fmt.Errorf("listen.tlscert and listen.tlskey must be given together")
+	}
+	if _, err := parseUnixMode(c.Listen.UnixMode); err != nil {
+		return fmt.Errorf("listen.unixmode: %v", err)
+	}
+	if err := c.Layout.pixLayout().Validate(); err != nil {
+		return fmt.Errorf("layout: %v", err)
+	}
+	if c.Preview.FPS < 0 {
+		return fmt.Errorf("preview.fps must not be negative")
+	}
+	df := &c.Defaults
+	if df.Latitude != nil && (*df.Latitude < -90 || *df.Latitude > 90) {
+		return fmt.Errorf("defaults.latitude must be between -90 and 90, not %v", *df.Latitude)
+	}
+	if df.Longitude != nil && (*df.Longitude < -180 || *df.Longitude > 180) {
+		return fmt.Errorf("defaults.longitude must be between -180 and 180, not %v", *df.Longitude)
+	}
+	d, err = time.ParseDuration(df.ShutdownFade)
+	if err != nil {
+		return fmt.Errorf("defaults.shutdownfade: %v", err)
+	}
+	if d < 0 {
+		return fmt.Errorf("defaults.shutdownfade must not be negative")
+	}
+	if df.Restore && df.State == "" {
+		return fmt.Errorf("defaults.restore needs defaults.state to be set")
+	}
+	return nil
+}
+
+// String returns c as YAML, in the form the config file takes.
+func (c *Config) String() string {
+	var b bytes.Buffer
+	e := yaml.NewEncoder(&b)
+	e.SetIndent(2)
+	err := e.Encode(c)
+	if err != nil {
+		return fmt.Sprintf("# couldn't encode config: %v\n", err)
+	}
+	e.Close()
+	return b.String()
+}
+
+// loadConfig reads the config file, if there is one, applies it to any flags not given on the
+// command line, and validates the result.
+func loadConfig() (*Config, error) {
+	baseConfig = configFromFlags()
+	explicitFlags = map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+	c := baseConfig
+	if *configFile != "" {
+		var err error
+		c, err = readConfigFile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := c.validate()
+	if err != nil {
+		if *configFile != "" {
+			return nil, fmt.Errorf("invalid configuration (from %s and flags): %v", *configFile, err)
+		}
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	c.setFlags()
+	return c, nil
+}
+
+// readConfigFile returns the config file applied on top of baseConfig, with any flags given on the
+// command line overriding it. It doesn't validate it.
+func readConfigFile() (*Config, error) {
+	c := baseConfig.clone()
+	f, err := os.Open(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	err = parseConfig(f, c)
+	f.Close() // Ignore error
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", *configFile, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	c.overrideFromFlags()
+	return c, nil
+}
+
+// reload re-reads the config file and applies whatever has changed and can be changed without
+// re-initialising the hardware. It returns the settings that changed and were applied, and those
+// that changed but need a restart to take effect. If anything goes wrong, nothing changes.
+func (s *Server) reload() (applied, restart []string, err error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if *configFile == "" {
+		return nil, nil, fmt.Errorf("no config file to reload")
+	}
+	log.Printf("Reloading %s", *configFile)
+	old := configFromFlags()
+	n, err := readConfigFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The outputs and power pins are only set up at startup
+	restart = append(diffConfig("output", old.Output, n.Output), diffConfig("power", old.Power, n.Power)...)
+	restart = append(restart, diffConfig("layout", old.Layout, n.Layout)...)
+	restart = append(restart, diffConfig("preview", old.Preview, n.Preview)...)
+	n.Output = old.Output
+	n.Power = old.Power
+	n.Layout = old.Layout
+	n.Preview = old.Preview
+	err = n.validate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	// Do everything that can fail before changing anything
+	if !reflect.DeepEqual(old.Segments, n.Segments) {
+		applied = append(applied, "segments")
+	}
+	// The token and users files are always re-read, in case they've changed
+	a, err := loadAuth(n.Listen.TokenFile, n.Listen.Users)
+	if err != nil {
+		return nil, nil, err
+	}
+	ol := old.Listen
+	if ol.HTTP != n.Listen.HTTP {
+		// The viewer's frame feed is only set up at startup
+		restart = append(restart, "listen.http")
+		n.Listen.HTTP = ol.HTTP
+	}
+	nl := n.Listen
+	var l, ul net.Listener
+	newTCP := ol.Port != nl.Port || ol.Bind != nl.Bind || ol.TLSCert != nl.TLSCert || ol.TLSKey != nl.TLSKey
+	newUnix := ol.Unix != nl.Unix
+	if s.activated {
+		// systemd owns the sockets
+		for _, c := range diffConfig("listen", ol, nl) {
+			if c == "listen.tokenfile" || c == "listen.users" {
+				applied = append(applied, c)
+			} else {
+				restart = append(restart, c)
+			}
+		}
+		n.Listen.Port, n.Listen.Bind, n.Listen.Unix, n.Listen.UnixMode = ol.Port, ol.Bind, ol.Unix, ol.UnixMode
+		n.Listen.TLSCert, n.Listen.TLSKey = ol.TLSCert, ol.TLSKey
+		newTCP, newUnix = false, false
+	} else {
+		applied = append(applied, diffConfig("listen", ol, nl)...)
+	}
+	if newTCP {
+		l, err = newListener(nl)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't listen on port %d: %v", nl.Port, err)
+		}
+	}
+	if newUnix && nl.Unix != "" {
+		ul, err = unixListener(nl)
+		if err != nil {
+			if l != nil {
+				l.Close() // Ignore error
+			}
+			return nil, nil, fmt.Errorf("couldn't listen on %s: %v", nl.Unix, err)
+		}
+	}
+	closeNew := func() {
+		if l != nil {
+			l.Close() // Ignore error
+		}
+		if ul != nil {
+			ul.Close() // Ignore error
+		}
+	}
+	od := old.Defaults
+	nd := n.Defaults
+	var pals []*effects.Palette
+	if od.Palettes != nd.Palettes {
+		pals, err = readPaletteFile(nd.Palettes)
+		if err != nil {
+			closeNew()
+			return nil, nil, err
+		}
+	}
+	if od.Schedule != nd.Schedule || !reflect.DeepEqual(od.Latitude, nd.Latitude) || !reflect.DeepEqual(od.Longitude, nd.Longitude) {
+		// Last, because it changes the scheduler if it succeeds
+		lat, long := math.NaN(), math.NaN()
+		if nd.Latitude != nil {
+			lat = *nd.Latitude
+		}
+		if nd.Longitude != nil {
+			long = *nd.Longitude
+		}
+		err = s.sched.Reconfigure(nd.Schedule, lat, long)
+		if err != nil {
+			closeNew()
+			return nil, nil, fmt.Errorf("couldn't reconfigure scheduler: %v", err)
+		}
+	}
+
+	// Now nothing can go wrong
+	n.setFlags()
+	s.setAuth(a)
+	if newTCP {
+		err = s.listen("tcp", l)
+		if err != nil {
+			log.Printf("Failed closing old listener: %v", err)
+		}
+	}
+	if newUnix {
+		err = s.listen("unix", ul)
+		if err != nil {
+			log.Printf("Failed closing old Unix socket: %v", err)
+		}
+	} else if !s.activated && nl.Unix != "" && ol.UnixMode != nl.UnixMode {
+		mode, _ := parseUnixMode(nl.UnixMode) // Checked by validate
+		err = os.Chmod(nl.Unix, mode)
+		if err != nil {
+			log.Printf("Failed setting permissions on %s: %v", nl.Unix, err)
+		}
+	}
+	for _, p := range pals {
+		effects.DefinePalette(p)
+	}
+	changed := diffConfig("defaults", od, nd)
+	applied = append(applied, changed...)
+	for _, c := range changed {
+		if c == "defaults.state" {
+			s.stateMu.Lock()
+			running := s.running
+			s.stateMu.Unlock()
+			s.saveState(running)
+		}
+	}
+	log.Printf("Reloaded, applied %v, restart needed for %v", applied, restart)
+	return applied, restart, nil
+}
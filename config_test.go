@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testConfig() *Config {
+	return &Config{
+		Output: OutputConfig{
+			Chip:       "ws281x",
+			Pixels:     160,
+			Order:      "GRB",
+			Freq:       800000,
+			DMA:        10,
+			Pin0:       18,
+			Pin1:       13,
+			Dev:        "/dev/spidev0.0",
+			Brightness: 1,
+			Gamma:      1,
+		},
+		Power: PowerConfig{
+			CtrlPin:    -1,
+			StatusPin:  -1,
+			StatusWait: "2s",
+		},
+		Listen: ListenConfig{
+			Port:     24601,
+			UnixMode: "0660",
+		},
+		Layout: LayoutConfig{
+			Shape: "linear",
+			Width: 40,
+		},
+		Defaults: DefaultsConfig{
+			ShutdownFade: "0s",
+		},
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr string
+	}{
+		{"empty", "", ""},
+		{"valid", "output:\n  chip: ws281x\n  pixels: 60\n  order: RGB\nsegments:\n  - name: shelf\n    start: 10\n    length: 20\npower:\n  ctrlpin: 4\n  statuspin: 17\n  statuswait: 500ms\n", ""},
+		{"unknown field", "output:\n  chipp: ws281x\n", "field chipp not found"},
+		{"bad chip", "output:\n  chip: apa102\n", "output.chip 'apa102'"},
+		{"spi", "output:\n  chip: ws281xspi\n  spibits: 4\n", ""},
+		{"bad spi bits", "output:\n  chip: ws281xspi\n  spibits: 5\n", "output.spibits"},
+		{"correction", "output:\n  brightness: 0.4\n  gamma: 2.2\n", ""},
+		{"bad brightness", "output:\n  brightness: 1.5\n", "output.brightness"},
+		{"bad gamma", "output:\n  gamma: 0\n", "output.gamma"},
+		{"bad order", "output:\n  order: BRGX\n", "output.order 'BRGX'"},
+		{"no pixels", "output:\n  pixels: 0\n", "output.pixels must be positive"},
+		{"segment too long", "segments:\n  - name: all\n    start: 100\n    length: 61\n", "segment 'all'"},
+		{"duplicate segment", "segments:\n  - name: a\n    start: 0\n    length: 1\n  - name: a\n    start: 1\n    length: 1\n", "more than once"},
+		{"pin clash", "power:\n  ctrlpin: 18\n", "already in use"},
+		{"bad wait", "power:\n  statuswait: soon\n", "power.statuswait"},
+		{"bad port", "listen:\n  port: 70000\n", "listen.port"},
+		{"bad shutdown fade", "defaults:\n  shutdownfade: -1s\n", "defaults.shutdownfade"},
+		{"restore without state", "defaults:\n  restore: true\n", "defaults.restore"},
+		{"bad unix mode", "listen:\n  unix: /run/ledctl.sock\n  unixmode: rw-rw----\n", "listen.unixmode"},
+		{"bad layout", "layout:\n  shape: hexagon\n", "layout"},
+		{"no matrix width", "layout:\n  shape: matrix\n  width: 0\n", "layout"},
+	}
+	for _, tc := range tests {
+		c := testConfig()
+		err := parseConfig(strings.NewReader(tc.in), c)
+		if err == nil {
+			err = c.validate()
+		}
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: no error, wanted '%s'", tc.name, tc.wantErr)
+		} else if !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error '%v', wanted '%s'", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	c := testConfig()
+	lat := 52.5
+	c.Defaults.Latitude = &lat
+	c.Segments = []SegmentConfig{{Name: "shelf", Start: 10, Length: 20}}
+	c2 := &Config{}
+	err := parseConfig(strings.NewReader(c.String()), c2)
+	if err != nil {
+		t.Fatalf("Parsing printed config failed: %v", err)
+	}
+	if c2.String() != c.String() {
+		t.Errorf("Round trip changed config, got\n%s\nwanted\n%s", c2, c)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ledctl.yaml")
+	write := func(c string) {
+		err := ioutil.WriteFile(path, []byte(c), 0644)
+		if err != nil {
+			t.Fatalf("Couldn't write config: %v", err)
+		}
+	}
+	*configFile = path
+	defer func() { *configFile = "" }()
+	write("output:\n  pixels: 60\n")
+	_, err = loadConfig()
+	if err != nil {
+		t.Fatalf("Couldn't load config: %v", err)
+	}
+	defer baseConfig.setFlags()
+	s := &Server{}
+
+	write("output:\n  pixels: 30\n  order: RGB\nsegments:\n  - name: shelf\n    start: 0\n    length: 40\n")
+	applied, restart, err := s.reload()
+	if err != nil {
+		t.Fatalf("Couldn't reload config: %v", err)
+	}
+	if !reflect.DeepEqual(applied, []string{"segments"}) {
+		t.Errorf("Wrong applied settings, got: %v, want: [segments]", applied)
+	}
+	if !reflect.DeepEqual(restart, []string{"output.pixels", "output.order"}) {
+		t.Errorf("Wrong restart settings, got: %v, want: [output.pixels output.order]", restart)
+	}
+	if sg := getSegments(); *pixels != 60 || *pixelOrder != "GRB" || len(sg) != 1 {
+		t.Errorf("Wrong settings after reload: pixels %d, order %s, segments %v", *pixels, *pixelOrder, sg)
+	}
+
+	// A segment that doesn't fit the pixels actually in use means nothing is applied
+	write("output:\n  pixels: 100\nsegments:\n  - name: shelf\n    start: 0\n    length: 80\n")
+	_, _, err = s.reload()
+	if err == nil {
+		t.Errorf("Reloaded invalid config without error")
+	}
+	if sg := getSegments(); *pixels != 60 || len(sg) != 1 || sg[0].Length != 40 {
+		t.Errorf("Settings changed by invalid reload: pixels %d, segments %v", *pixels, sg)
+	}
+
+	// Nor is anything applied if a later step fails
+	write("segments:\n  - name: shelf\n    start: 0\n    length: 10\ndefaults:\n  palettes: " + filepath.Join(dir, "missing") + "\n")
+	_, _, err = s.reload()
+	if err == nil {
+		t.Errorf("Reloaded config with missing palette file without error")
+	}
+	if sg := getSegments(); len(sg) != 1 || sg[0].Length != 40 || *paletteFile != "" {
+		t.Errorf("Settings changed by failed reload: segments %v, palettes '%s'", sg, *paletteFile)
+	}
+}
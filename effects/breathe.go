@@ -0,0 +1,104 @@
+package effects
+
+import (
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	WaveSine = iota
+	WaveTriangle
+	WaveExp
+)
+
+var StringWaveforms map[string]int = map[string]int{
+	"SINE":     WaveSine,
+	"TRIANGLE": WaveTriangle,
+	"EXP":      WaveExp,
+}
+
+// breatheLevel returns how far through a single breath (0.0 = low colour, 1.0 = high colour) the
+// given waveform is at x, which runs from 0.0 (start of breath) to 1.0 (end of breath).
+func breatheLevel(wave int, x float64) float64 {
+	switch wave {
+	case WaveTriangle:
+		return 1.0 - math.Abs(2.0*x-1.0)
+	case WaveExp:
+		// The "Apple sleep light" curve: lingers near the low end, with a quick swell at the top.
+		return (math.Exp(math.Sin(2.0*math.Pi*x-math.Pi/2.0)) - 1.0/math.E) / (math.E - 1.0/math.E)
+	}
+	return (1.0 - math.Cos(2.0*math.Pi*x)) / 2.0
+}
+
+// Breathe moves all LEDs between a low and a high colour and back once per period. Only the first
+// duty fraction of each period is spent breathing, the rest is spent resting at the low colour.
+type Breathe struct {
+	period   time.Duration
+	low      pixarray.Pixel
+	high     pixarray.Pixel
+	wave     int
+	duty     float64
+	timeStep time.Duration
+	start    time.Time
+}
+
+func NewBreathe(period time.Duration, low pixarray.Pixel, high pixarray.Pixel, wave int, duty float64) *Breathe {
+	b := Breathe{}
+	b.period = period
+	b.low = low
+	b.high = high
+	b.wave = wave
+	b.duty = duty
+	return &b
+}
+
+func (b *Breathe) Start(pa *pixarray.PixArray, now time.Time) {
+	log.Printf("Starting Breathe, %v<->%v", b.low, b.high)
+	b.start = now
+	var diff pixarray.Pixel
+	diff.R = abs(b.high.R - b.low.R)
+	diff.G = abs(b.high.G - b.low.G)
+	diff.B = abs(b.high.B - b.low.B)
+	diff.W = abs(b.high.W - b.low.W)
+	// Each breath goes up and back down through every dithered level, so we want at least that
+	// many steps per breath.
+	levels := int64(2 * maxP(diff) * pa.NumPixels())
+	if levels == 0 {
+		b.timeStep = b.period
+	} else {
+		b.timeStep = time.Duration(float64(b.period.Nanoseconds())*b.duty) / time.Duration(levels)
+	}
+	if b.timeStep < time.Millisecond {
+		b.timeStep = time.Millisecond
+	}
+	log.Printf("Breathe timestep %v", b.timeStep)
+}
+
+func (b *Breathe) NextStep(pa *pixarray.PixArray, now time.Time) time.Duration {
+	pos := float64(now.Sub(b.start).Nanoseconds()) / float64(b.period.Nanoseconds())
+	pos -= math.Floor(pos)
+	if pos >= b.duty {
+		// Resting until the next breath starts
+		pa.SetAll(b.low)
+		r := time.Duration(float64(b.period.Nanoseconds()) * (1.0 - pos))
+		if r < b.timeStep {
+			// Never return 0, that would mean we're done
+			r = b.timeStep
+		}
+		return r
+	}
+	l := breatheLevel(b.wave, pos/b.duty)
+	setDithered(pa, fPixel{
+		R: float64(b.low.R) + float64(b.high.R-b.low.R)*l,
+		G: float64(b.low.G) + float64(b.high.G-b.low.G)*l,
+		B: float64(b.low.B) + float64(b.high.B-b.low.B)*l,
+		W: float64(b.low.W) + float64(b.high.W-b.low.W)*l,
+	})
+	return b.timeStep
+}
+
+func (b *Breathe) Name() string {
+	return "BREATHE"
+}
@@ -0,0 +1,179 @@
+package effects
+
+import (
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"math"
+)
+
+const (
+	SpaceRGB = iota
+	SpaceHSV
+	SpaceHSL
+	SpaceLab
+	SpaceOKLab
+)
+
+var StringColorSpaces map[string]int = map[string]int{
+	"RGB":   SpaceRGB,
+	"HSV":   SpaceHSV,
+	"HSL":   SpaceHSL,
+	"LAB":   SpaceLab,
+	"OKLAB": SpaceOKLab,
+}
+
+func lerp(a, b, pct float64) float64 {
+	return a + (b-a)*pct
+}
+
+// lerpHue interpolates between two hues (0-360) the shortest way round the colour wheel.
+func lerpHue(a, b, pct float64) float64 {
+	d := b - a
+	if d > 180.0 {
+		d -= 360.0
+	} else if d < -180.0 {
+		d += 360.0
+	}
+	h := math.Mod(a+d*pct, 360.0)
+	if h < 0.0 {
+		h += 360.0
+	}
+	return h
+}
+
+// interpolate returns the colour pct of the way from one Pixel to another, travelling through the
+// given colour space. max is the value of a fully-lit channel. The result is clamped to 0-max.
+func interpolate(space int, from, to pixarray.Pixel, max int, pct float64) fPixel {
+	var r, g, b float64
+	switch space {
+	case SpaceHSV, SpaceHSL:
+		var h1, s1, v1, h2, s2, v2 float64
+		if space == SpaceHSV {
+			h1, s1, v1 = from.ToHSV(max)
+			h2, s2, v2 = to.ToHSV(max)
+		} else {
+			h1, s1, v1 = from.ToHSL(max)
+			h2, s2, v2 = to.ToHSL(max)
+		}
+		// Greys (including black) have no meaningful hue: take the other end's, so that e.g. a
+		// fade up from black doesn't sweep through other hues on the way.
+		if s1 == 0.0 {
+			h1 = h2
+		} else if s2 == 0.0 {
+			h2 = h1
+		}
+		h := lerpHue(h1, h2, pct)
+		if space == SpaceHSV {
+			r, g, b = pixarray.HSVToRGB(h, lerp(s1, s2, pct), lerp(v1, v2, pct))
+		} else {
+			r, g, b = pixarray.HSLToRGB(h, lerp(s1, s2, pct), lerp(v1, v2, pct))
+		}
+	case SpaceLab:
+		l1, a1, b1 := from.ToLab(max)
+		l2, a2, b2 := to.ToLab(max)
+		r, g, b = pixarray.LabToRGB(lerp(l1, l2, pct), lerp(a1, a2, pct), lerp(b1, b2, pct))
+	case SpaceOKLab:
+		l1, a1, b1 := from.ToOKLab(max)
+		l2, a2, b2 := to.ToOKLab(max)
+		r, g, b = pixarray.OKLabToRGB(lerp(l1, l2, pct), lerp(a1, a2, pct), lerp(b1, b2, pct))
+	default:
+		r, g, b = from.Normalized(max)
+		r2, g2, b2 := to.Normalized(max)
+		r, g, b = lerp(r, r2, pct), lerp(g, g2, pct), lerp(b, b2, pct)
+	}
+	m := float64(max)
+	return fPixel{
+		R: math.Max(0.0, math.Min(m, r*m)),
+		G: math.Max(0.0, math.Min(m, g*m)),
+		B: math.Max(0.0, math.Min(m, b*m)),
+		W: lerp(float64(from.W), float64(to.W), pct),
+	}
+}
+
+// spaceLevels estimates how many whole-number levels the fastest-changing channel passes through
+// when interpolating from one Pixel to another in the given colour space.
+func spaceLevels(space int, from, to pixarray.Pixel, max int) float64 {
+	const samples = 64
+	var levels float64
+	last := interpolate(space, from, to, max, 0.0)
+	for i := 1; i <= samples; i++ {
+		p := interpolate(space, from, to, max, float64(i)/samples)
+		levels = math.Max(levels, max4(math.Abs(p.R-last.R), math.Abs(p.G-last.G), math.Abs(p.B-last.B), math.Abs(p.W-last.W)))
+		last = p
+	}
+	return levels * samples
+}
+
+func max4(a, b, c, d float64) float64 {
+	return math.Max(math.Max(a, b), math.Max(c, d))
+}
+
+// Lightnesses used for hue wheels in the perceptual spaces. Every hue at these lightnesses has at
+// least some chroma within the RGB gamut.
+const (
+	hueWheelLabL   = 65.0
+	hueWheelOKLabL = 0.75
+)
+
+// hueColor returns the colour at position hue (0.0-1.0) around a colour wheel in the given colour
+// space, scaled so that max is a fully-lit channel. In RGB, HSV and HSL, this is the fully
+// saturated, fully bright hue. In Lab and OKLab, it's the most saturated in-gamut colour at a
+// constant lightness, so that all hues appear equally bright.
+func hueColor(space int, hue float64, max int) fPixel {
+	var r, g, b float64
+	switch space {
+	case SpaceLab, SpaceOKLab:
+		angle := hue * 2.0 * math.Pi
+		toRGB := func(c float64) (float64, float64, float64) {
+			if space == SpaceLab {
+				return pixarray.LabToRGB(hueWheelLabL, c*math.Cos(angle), c*math.Sin(angle))
+			}
+			return pixarray.OKLabToRGB(hueWheelOKLabL, c*math.Cos(angle), c*math.Sin(angle))
+		}
+		// Find the highest chroma that's still in gamut
+		lo, hi := 0.0, 150.0
+		if space == SpaceOKLab {
+			hi = 0.4
+		}
+		for i := 0; i < 30; i++ {
+			c := (lo + hi) / 2.0
+			r, g, b = toRGB(c)
+			if math.Min(r, math.Min(g, b)) < 0.0 || math.Max(r, math.Max(g, b)) > 1.0 {
+				hi = c
+			} else {
+				lo = c
+			}
+		}
+		r, g, b = toRGB(lo)
+	default:
+		r, g, b = pixarray.HSVToRGB(hue*360.0, 1.0, 1.0)
+	}
+	m := float64(max)
+	return fPixel{
+		R: math.Max(0.0, math.Min(m, r*m)),
+		G: math.Max(0.0, math.Min(m, g*m)),
+		B: math.Max(0.0, math.Min(m, b*m)),
+	}
+}
+
+// hueOf returns where around the given colour space's colour wheel (0.0-1.0) p lies.
+func hueOf(space int, p pixarray.Pixel, max int) float64 {
+	var a, b float64
+	switch space {
+	case SpaceLab:
+		_, a, b = p.ToLab(max)
+	case SpaceOKLab:
+		_, a, b = p.ToOKLab(max)
+	default:
+		h, _, _ := p.ToHSV(max)
+		return h / 360.0
+	}
+	h := math.Atan2(b, a) / (2.0 * math.Pi)
+	if h < 0.0 {
+		h += 1.0
+	}
+	return h
+}
+
+func (fp fPixel) round() pixarray.Pixel {
+	return pixarray.Pixel{R: round(fp.R), G: round(fp.G), B: round(fp.B), W: round(fp.W)}
+}
@@ -0,0 +1,212 @@
+package effects
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// An Easing maps linear progress through an effect (0.0 at the start, 1.0 at the end) to how far
+// the effect should actually have progressed. Every Easing returns 0.0 for 0.0 and 1.0 for 1.0.
+type Easing func(t float64) float64
+
+func EaseLinear(t float64) float64 {
+	return t
+}
+
+func EaseInQuad(t float64) float64 {
+	return t * t
+}
+
+func EaseOutQuad(t float64) float64 {
+	return 1.0 - EaseInQuad(1.0-t)
+}
+
+func EaseInOutQuad(t float64) float64 {
+	if t < 0.5 {
+		return 2.0 * t * t
+	}
+	return 1.0 - 2.0*(1.0-t)*(1.0-t)
+}
+
+func EaseInCubic(t float64) float64 {
+	return t * t * t
+}
+
+func EaseOutCubic(t float64) float64 {
+	return 1.0 - EaseInCubic(1.0-t)
+}
+
+func EaseInOutCubic(t float64) float64 {
+	if t < 0.5 {
+		return 4.0 * t * t * t
+	}
+	return 1.0 - 4.0*(1.0-t)*(1.0-t)*(1.0-t)
+}
+
+func EaseInSine(t float64) float64 {
+	return 1.0 - math.Cos(t*math.Pi/2.0)
+}
+
+func EaseOutSine(t float64) float64 {
+	return math.Sin(t * math.Pi / 2.0)
+}
+
+func EaseInOutSine(t float64) float64 {
+	return (1.0 - math.Cos(t*math.Pi)) / 2.0
+}
+
+func EaseInExpo(t float64) float64 {
+	if t <= 0.0 {
+		return 0.0
+	}
+	return math.Pow(2.0, 10.0*t-10.0)
+}
+
+func EaseOutExpo(t float64) float64 {
+	return 1.0 - EaseInExpo(1.0-t)
+}
+
+func EaseInOutExpo(t float64) float64 {
+	if t < 0.5 {
+		return EaseInExpo(2.0*t) / 2.0
+	}
+	return 1.0 - EaseInExpo(2.0-2.0*t)/2.0
+}
+
+// EaseOutBounce decelerates towards the end and then bounces off it, like a dropped ball.
+func EaseOutBounce(t float64) float64 {
+	const (
+		n = 7.5625
+		d = 2.75
+	)
+	switch {
+	case t < 1.0/d:
+		return n * t * t
+	case t < 2.0/d:
+		t -= 1.5 / d
+		return n*t*t + 0.75
+	case t < 2.5/d:
+		t -= 2.25 / d
+		return n*t*t + 0.9375
+	}
+	t -= 2.625 / d
+	return n*t*t + 0.984375
+}
+
+func EaseInBounce(t float64) float64 {
+	return 1.0 - EaseOutBounce(1.0-t)
+}
+
+func EaseInOutBounce(t float64) float64 {
+	if t < 0.5 {
+		return EaseInBounce(2.0*t) / 2.0
+	}
+	return 0.5 + EaseOutBounce(2.0*t-1.0)/2.0
+}
+
+var StringEasings map[string]Easing = map[string]Easing{
+	"LINEAR":        EaseLinear,
+	"IN_QUAD":       EaseInQuad,
+	"OUT_QUAD":      EaseOutQuad,
+	"IN_OUT_QUAD":   EaseInOutQuad,
+	"IN_CUBIC":      EaseInCubic,
+	"OUT_CUBIC":     EaseOutCubic,
+	"IN_OUT_CUBIC":  EaseInOutCubic,
+	"IN_SINE":       EaseInSine,
+	"OUT_SINE":      EaseOutSine,
+	"IN_OUT_SINE":   EaseInOutSine,
+	"IN_EXPO":       EaseInExpo,
+	"OUT_EXPO":      EaseOutExpo,
+	"IN_OUT_EXPO":   EaseInOutExpo,
+	"IN_BOUNCE":     EaseInBounce,
+	"OUT_BOUNCE":    EaseOutBounce,
+	"IN_OUT_BOUNCE": EaseInOutBounce,
+}
+
+// NewCubicBezier returns an Easing following the CSS-style cubic Bézier curve from (0,0) to (1,1)
+// with control points (x1,y1) and (x2,y2). x1 and x2 must be between 0.0 and 1.0, so that the curve
+// only ever moves forward in time.
+func NewCubicBezier(x1, y1, x2, y2 float64) (Easing, error) {
+	if x1 < 0.0 || x1 > 1.0 || x2 < 0.0 || x2 > 1.0 {
+		return nil, fmt.Errorf("x control points %f, %f must be between 0.0 and 1.0", x1, x2)
+	}
+	// Polynomial coefficients of each axis, as e.g. x(s) = ((ax*s + bx)*s + cx)*s
+	cx := 3.0 * x1
+	bx := 3.0*(x2-x1) - cx
+	ax := 1.0 - cx - bx
+	cy := 3.0 * y1
+	by := 3.0*(y2-y1) - cy
+	ay := 1.0 - cy - by
+	return func(t float64) float64 {
+		if t <= 0.0 {
+			return 0.0
+		}
+		if t >= 1.0 {
+			return 1.0
+		}
+		// Find s such that x(s) == t. Newton's method usually gets there in a few steps, with
+		// bisection as a fallback for flat parts of the curve.
+		s := t
+		for i := 0; i < 8; i++ {
+			x := ((ax*s+bx)*s+cx)*s - t
+			if math.Abs(x) < 1e-7 {
+				return ((ay*s+by)*s + cy) * s
+			}
+			dx := (3.0*ax*s+2.0*bx)*s + cx
+			if math.Abs(dx) < 1e-6 {
+				break
+			}
+			s -= x / dx
+		}
+		lo, hi := 0.0, 1.0
+		s = t
+		for i := 0; i < 50; i++ {
+			x := ((ax*s+bx)*s + cx) * s
+			if math.Abs(x-t) < 1e-7 {
+				break
+			}
+			if x < t {
+				lo = s
+			} else {
+				hi = s
+			}
+			s = (lo + hi) / 2.0
+		}
+		return ((ay*s+by)*s + cy) * s
+	}, nil
+}
+
+// ParseEasing returns the Easing named by s: either one of the names in StringEasings, or
+// CUBIC_BEZIER(x1,y1,x2,y2).
+func ParseEasing(s string) (Easing, error) {
+	u := strings.ToUpper(s)
+	if e, ok := StringEasings[u]; ok {
+		return e, nil
+	}
+	if strings.HasPrefix(u, "CUBIC_BEZIER(") && strings.HasSuffix(u, ")") {
+		var x1, y1, x2, y2 float64
+		_, err := fmt.Sscanf(u[len("CUBIC_BEZIER("):len(u)-1], "%g,%g,%g,%g", &x1, &y1, &x2, &y2)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse cubic Bézier '%s': %v", s, err)
+		}
+		return NewCubicBezier(x1, y1, x2, y2)
+	}
+	return nil, fmt.Errorf("unknown easing '%s'", s)
+}
+
+// maxSlope estimates the steepest part of an Easing, i.e. how many times faster than linear it
+// progresses at its fastest.
+func maxSlope(e Easing) float64 {
+	const samples = 1000
+	m := 1.0
+	last := e(0.0)
+	for i := 1; i <= samples; i++ {
+		v := e(float64(i) / samples)
+		if s := math.Abs(v-last) * samples; s > m {
+			m = s
+		}
+		last = v
+	}
+	return m
+}
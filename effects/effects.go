@@ -106,9 +106,41 @@ func lcm(p pixarray.Pixel) int {
 	return m / p.G
 }
 
+// fPixel is a Pixel whose channels may take fractional values, e.g. partway through a fade.
+type fPixel struct {
+	R float64
+	G float64
+	B float64
+	W float64
+}
+
+// setDithered sets every pixel so that, averaged over the strip, it shows the fractional colour fp.
+// Each channel alternates between the whole values either side of the fractional one, in the
+// proportion needed to reach it - the same trick all-same Fades use to fade more slowly than the
+// LEDs' own PWM allows.
+func setDithered(pa *pixarray.PixArray, fp fPixel) {
+	this := pixarray.Pixel{
+		R: int(math.Floor(fp.R)),
+		G: int(math.Floor(fp.G)),
+		B: int(math.Floor(fp.B)),
+		W: int(math.Floor(fp.W)),
+	}
+	next := pixarray.Pixel{R: this.R + 1, G: this.G + 1, B: this.B + 1, W: this.W + 1}
+	np := float64(pa.NumPixels())
+	num := pixarray.Pixel{
+		R: int(np * (fp.R - float64(this.R))),
+		G: int(np * (fp.G - float64(this.G))),
+		B: int(np * (fp.B - float64(this.B))),
+		W: int(np * (fp.W - float64(this.W))),
+	}
+	pa.SetPerChanAlternate(num, pa.NumPixels(), this, next)
+}
+
 type Fade struct {
 	fadeTime time.Duration
 	dest     pixarray.Pixel
+	ease     Easing // nil means linear
+	space    int
 	startPix []pixarray.Pixel
 	diffs    []pixarray.Pixel
 	allSame  bool
@@ -117,9 +149,22 @@ type Fade struct {
 }
 
 func NewFade(fadeTime time.Duration, dest pixarray.Pixel) *Fade {
+	return NewEasedFade(fadeTime, dest, nil)
+}
+
+// NewEasedFade returns a Fade whose progress follows ease rather than being linear in time.
+func NewEasedFade(fadeTime time.Duration, dest pixarray.Pixel, ease Easing) *Fade {
+	return NewColorFade(fadeTime, dest, ease, SpaceRGB)
+}
+
+// NewColorFade returns a Fade whose progress follows ease and which travels through the given
+// colour space (one of the Space* constants) from each pixel's start colour to dest.
+func NewColorFade(fadeTime time.Duration, dest pixarray.Pixel, ease Easing, space int) *Fade {
 	f := Fade{}
 	f.fadeTime = fadeTime
 	f.dest = dest
+	f.ease = ease
+	f.space = space
 	return &f
 }
 
@@ -155,11 +200,29 @@ func (f *Fade) Start(pa *pixarray.PixArray, now time.Time) {
 	if maxdiff.R == 0 && maxdiff.G == 0 && maxdiff.B == 0 && maxdiff.W == 0 {
 		f.timeStep = f.fadeTime
 	} else {
-		nsStep := f.fadeTime.Nanoseconds() / int64(lcm(maxdiff))
+		var nsStep int64
+		if f.space == SpaceRGB {
+			nsStep = f.fadeTime.Nanoseconds() / int64(lcm(maxdiff))
+		} else {
+			// Outside RGB, channels don't change at a constant rate, so look for the fastest
+			levels := 1.0
+			for i, v := range f.startPix {
+				levels = math.Max(levels, spaceLevels(f.space, v, f.dest, pa.MaxPerChannel()))
+				if f.allSame && i == 0 {
+					break
+				}
+			}
+			nsStep = int64(float64(f.fadeTime.Nanoseconds()) / levels)
+		}
 		if f.allSame {
 			log.Printf("Starting all-same")
 			nsStep = nsStep / int64(pa.NumPixels())
 		}
+		if f.ease != nil {
+			// The steepest part of the easing passes through levels fastest, so needs the
+			// shortest steps
+			nsStep = int64(float64(nsStep) / maxSlope(f.ease))
+		}
 		f.timeStep = time.Duration(nsStep)
 	}
 	log.Printf("Fade md.R %d, md.G %d, md.B %d, md.W %d, timestep %v", maxdiff.R, maxdiff.G, maxdiff.B, maxdiff.W, f.timeStep)
@@ -174,6 +237,19 @@ func (f *Fade) NextStep(pa *pixarray.PixArray, now time.Time) time.Duration {
 		pa.SetAll(f.dest)
 		return 0
 	}
+	if f.ease != nil {
+		pct = math.Max(0.0, math.Min(1.0, f.ease(pct)))
+	}
+	if f.space != SpaceRGB {
+		if f.allSame {
+			setDithered(pa, interpolate(f.space, f.startPix[0], f.dest, pa.MaxPerChannel(), pct))
+			return f.timeStep
+		}
+		for i, v := range f.startPix {
+			pa.SetOne(i, interpolate(f.space, v, f.dest, pa.MaxPerChannel(), pct).round())
+		}
+		return f.timeStep
+	}
 	if f.allSame {
 		var this, next pixarray.Pixel
 		var trp, tgp, tbp, twp float64
@@ -253,10 +329,10 @@ func (f *Fade) NextStep(pa *pixarray.PixArray, now time.Time) time.Duration {
 		}
 		np := float64(pa.NumPixels())
 		num := pixarray.Pixel{
-			int(np * pctThroughStepR),
-			int(np * pctThroughStepG),
-			int(np * pctThroughStepB),
-			int(np * pctThroughStepW),
+			R: int(np * pctThroughStepR),
+			G: int(np * pctThroughStepG),
+			B: int(np * pctThroughStepB),
+			W: int(np * pctThroughStepW),
 		}
 		pa.SetPerChanAlternate(num, pa.NumPixels(), this, next)
 		return f.timeStep
@@ -291,12 +367,29 @@ func (f *Fade) Name() string {
 
 type Rainbow struct {
 	cycleTime time.Duration
+	space     int
+	palette   *Palette
 	start     time.Time
 }
 
 func NewRainbow(cycleTime time.Duration) *Rainbow {
+	return NewColorRainbow(cycleTime, SpaceRGB)
+}
+
+// NewColorRainbow returns a Rainbow whose hues are spaced evenly around the given colour space's
+// colour wheel (see hueColor).
+func NewColorRainbow(cycleTime time.Duration, space int) *Rainbow {
+	r := Rainbow{}
+	r.cycleTime = cycleTime
+	r.space = space
+	return &r
+}
+
+// NewPaletteRainbow returns a Rainbow drawn from the given palette instead of a colour wheel.
+func NewPaletteRainbow(cycleTime time.Duration, palette *Palette) *Rainbow {
 	r := Rainbow{}
 	r.cycleTime = cycleTime
+	r.palette = palette
 	return &r
 }
 
@@ -330,9 +423,15 @@ func (r *Rainbow) NextStep(pa *pixarray.PixArray, now time.Time) time.Duration {
 	for i := 0; i < pa.NumPixels(); i++ {
 		var p pixarray.Pixel
 		f := float64(i) / float64(pa.NumPixels())
-		p.R = fToPix(f, 0.0)
-		p.G = fToPix(f, 0.333334)
-		p.B = fToPix(f, 0.666667)
+		if r.palette != nil {
+			p = r.palette.sample(f, pa.MaxPerChannel()).round()
+		} else if r.space == SpaceRGB {
+			p.R = fToPix(f, 0.0)
+			p.G = fToPix(f, 0.333334)
+			p.B = fToPix(f, 0.666667)
+		} else {
+			p = hueColor(r.space, f, pa.MaxPerChannel()).round()
+		}
 		pa.SetOne((i+offs)%pa.NumPixels(), p)
 	}
 	return r.cycleTime / time.Duration(768)
@@ -344,25 +443,61 @@ func (r *Rainbow) Name() string {
 
 // A full cycle goes across 128*6=768 steps: R->R+G->G->G+B->B->B+R->R with each of the six arrows
 // representing the 128 increments between 127 and 0 inclusive of the relevant increase or decrease.
+//
+// Outside RGB, a Cycle instead moves continuously around the colour space's colour wheel (see
+// hueColor), after first fading from the current colour to the nearest point on that wheel. Given
+// a palette, it moves around the palette in the same way, starting from the palette's beginning.
 type Cycle struct {
 	cycleTime time.Duration
 	fadeTime  time.Duration
+	space     int
+	palette   *Palette
 	start     time.Time
+	hue       float64
 	last      pixarray.Pixel
 	fade      *Fade
 }
 
 func NewCycle(cycleTime time.Duration) *Cycle {
+	return NewColorCycle(cycleTime, SpaceRGB)
+}
+
+func NewColorCycle(cycleTime time.Duration, space int) *Cycle {
 	c := Cycle{}
 	c.cycleTime = cycleTime
 	c.fadeTime = cycleTime / time.Duration(768)
+	c.space = space
 	return &c
 }
 
+func NewPaletteCycle(cycleTime time.Duration, palette *Palette) *Cycle {
+	c := NewColorCycle(cycleTime, SpaceRGB)
+	c.palette = palette
+	return c
+}
+
+// onWheel returns whether this Cycle moves continuously around a wheel or palette, rather than
+// stepping through the RGB cycle.
+func (c *Cycle) onWheel() bool {
+	return c.space != SpaceRGB || c.palette != nil
+}
+
+// wheel returns the colour pos (0.0-1.0) of the way round this Cycle's colour wheel or palette.
+func (c *Cycle) wheel(pos float64, max int) fPixel {
+	if c.palette != nil {
+		return c.palette.sample(pos, max)
+	}
+	return hueColor(c.space, pos, max)
+}
+
 func (c *Cycle) Start(pa *pixarray.PixArray, now time.Time) {
 	log.Printf("Starting Cycle")
 	c.start = now
 	p := pa.GetPixel(0)
+	if c.onWheel() {
+		c.startWheel(pa, p, now)
+		return
+	}
 	c.last = p
 	m := maxP(c.last)
 	switch m {
@@ -422,6 +557,30 @@ func (c *Cycle) Start(pa *pixarray.PixArray, now time.Time) {
 	}
 }
 
+// startWheel starts a Cycle outside RGB, fading from p to the closest colour on the wheel.
+func (c *Cycle) startWheel(pa *pixarray.PixArray, p pixarray.Pixel, now time.Time) {
+	max := pa.MaxPerChannel()
+	if maxP(p) > 0 && c.palette == nil {
+		c.hue = hueOf(c.space, p, max)
+	} else {
+		c.hue = 0.0
+	}
+	c.last = c.wheel(c.hue, max).round()
+	var d pixarray.Pixel
+	d.R = abs(p.R - c.last.R)
+	d.G = abs(p.G - c.last.G)
+	d.B = abs(p.B - c.last.B)
+	if maxP(d) == 0 {
+		log.Printf("Already on the wheel at hue %f, no initial fade needed", c.hue)
+		c.NextStep(pa, now)
+		return
+	}
+	t := c.fadeTime * time.Duration(maxP(d))
+	log.Printf("First fade to %v at hue %f, max dist %d -> time %s", c.last, c.hue, maxP(d), t)
+	c.fade = NewColorFade(t, c.last, nil, c.space)
+	c.fade.Start(pa, now)
+}
+
 func (c *Cycle) NextStep(pa *pixarray.PixArray, now time.Time) time.Duration {
 	if c.fade != nil {
 		t := c.fade.NextStep(pa, now)
@@ -429,6 +588,17 @@ func (c *Cycle) NextStep(pa *pixarray.PixArray, now time.Time) time.Duration {
 			// This fade will continue
 			return t
 		}
+		if c.onWheel() {
+			// The initial fade's done, the hue starts moving from here
+			c.fade = nil
+			c.start = now
+		}
+	}
+	if c.onWheel() {
+		pos := c.hue + float64(now.Sub(c.start).Nanoseconds())/float64(c.cycleTime.Nanoseconds())
+		pos -= math.Floor(pos)
+		setDithered(pa, c.wheel(pos, pa.MaxPerChannel()))
+		return c.cycleTime / time.Duration(768*pa.NumPixels())
 	}
 	// Time for a new fade
 	if c.last.R == 127 {
@@ -470,14 +640,22 @@ func (f *Cycle) Name() string {
 type Zip struct {
 	zipTime time.Duration
 	dest    pixarray.Pixel
+	ease    Easing // nil means linear
 	start   time.Time
 	lastSet int
 }
 
 func NewZip(zipTime time.Duration, dest pixarray.Pixel) *Zip {
+	return NewEasedZip(zipTime, dest, nil)
+}
+
+// NewEasedZip returns a Zip whose progress along the strip follows ease rather than being linear
+// in time.
+func NewEasedZip(zipTime time.Duration, dest pixarray.Pixel, ease Easing) *Zip {
 	z := Zip{}
 	z.zipTime = zipTime
 	z.dest = dest
+	z.ease = ease
 	z.lastSet = -1
 	return &z
 }
@@ -488,7 +666,12 @@ func (z *Zip) Start(pa *pixarray.PixArray, now time.Time) {
 }
 
 func (z *Zip) NextStep(pa *pixarray.PixArray, now time.Time) time.Duration {
-	p := int((float64(now.Sub(z.start).Nanoseconds()) / float64(z.zipTime.Nanoseconds())) * float64(pa.NumPixels()))
+	pct := float64(now.Sub(z.start).Nanoseconds()) / float64(z.zipTime.Nanoseconds())
+	if z.ease != nil && pct < 1.0 {
+		// Some easings (e.g. bounces) touch 1.0 early, but we're only done once the time's up
+		pct = math.Max(0.0, math.Min(0.999999, z.ease(pct)))
+	}
+	p := int(pct * float64(pa.NumPixels()))
 	for i := z.lastSet + 1; i < pa.NumPixels() && i <= p; i++ {
 		pa.SetOne(i, z.dest)
 	}
@@ -518,7 +701,7 @@ func NewKnightRider(pulseTime time.Duration, pulseLen int) *KnightRider {
 func (kr *KnightRider) Start(pa *pixarray.PixArray, now time.Time) {
 	log.Printf("Starting KnightRider")
 	kr.start = now
-	pa.SetAll(pixarray.Pixel{0, 0, 0, 0})
+	pa.SetAll(pixarray.Pixel{R: 0, G: 0, B: 0, W: 0})
 }
 
 func (kr *KnightRider) NextStep(pa *pixarray.PixArray, now time.Time) time.Duration {
@@ -548,7 +731,7 @@ func (kr *KnightRider) NextStep(pa *pixarray.PixArray, now time.Time) time.Durat
 	}
 	for i := pulseTail; i != rangeHead; i = i + pulseDir {
 		v := int((float64(kr.pulseLen-abs(pulseHead-i))/float64(kr.pulseLen))*126.0) + 1
-		pa.SetOne(i, pixarray.Pixel{v, 0, 0, 0})
+		pa.SetOne(i, pixarray.Pixel{R: v, G: 0, B: 0, W: 0})
 	}
 	return time.Millisecond
 }
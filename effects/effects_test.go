@@ -2,7 +2,9 @@ package effects
 
 import (
 	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	rpi "github.com/Jon-Bright/ledctl/rpi"
 	"math"
+	"strings"
 	"testing"
 	"time"
 )
@@ -11,6 +13,10 @@ type testLeds struct {
 	pixels []pixarray.Pixel
 }
 
+func (l *testLeds) RPi() *rpi.RPi {
+	return nil
+}
+
 func (l *testLeds) GetPixel(i int) pixarray.Pixel {
 	return l.pixels[i]
 }
@@ -23,6 +29,10 @@ func (l *testLeds) Write() error {
 	return nil
 }
 
+func (l *testLeds) Close() error {
+	return nil
+}
+
 func (l *testLeds) MaxPerChannel() int {
 	return 160
 }
@@ -52,14 +62,14 @@ func TestAllSameFade(t *testing.T) {
 		b       float64
 		w       float64
 	}{
-		{pixarray.Pixel{0, 0, 0, 0}, pixarray.Pixel{127, 0, 0, 0}, d("1.0s", t), d("0.5s", t), 63.5, 0, 0, 0},
-		{pixarray.Pixel{0, 127, 0, 0}, pixarray.Pixel{127, 0, 0, 0}, d("1.0s", t), d("0.5s", t), 63.5, 63.5, 0, 0},
-		{pixarray.Pixel{127, 127, 127, 127}, pixarray.Pixel{127, 0, 127, 0}, d("3.0s", t), d("1.0s", t), 127, 84.66666, 127, 84.66666},
-		{pixarray.Pixel{127, 127, 127, 127}, pixarray.Pixel{127, 0, 127, 0}, d("3.0s", t), d("2.0s", t), 127, 42.33333, 127, 42.33333},
-		{pixarray.Pixel{127, 127, 127, 127}, pixarray.Pixel{0, 0, 0, 0}, d("127.0s", t), d("10.5s", t), 116.5, 116.5, 116.5, 116.5},
-		{pixarray.Pixel{127, 127, 0, 0}, pixarray.Pixel{0, 0, 127, 127}, d("127.0s", t), d("10.5s", t), 116.5, 116.5, 10.5, 10.5},
-		{pixarray.Pixel{126, 126, 0, 0}, pixarray.Pixel{0, 63, 126, 63}, d("126.0s", t), d("10.5s", t), 115.5, 120.75, 10.5, 5.25},
-		{pixarray.Pixel{0, 0, 0, 0}, pixarray.Pixel{120, 10, 0, 5}, d("120.0s", t), d("6.0s", t), 6.0, 0.5, 0, 0.25},
+		{pixarray.Pixel{R: 0, G: 0, B: 0, W: 0}, pixarray.Pixel{R: 127, G: 0, B: 0, W: 0}, d("1.0s", t), d("0.5s", t), 63.5, 0, 0, 0},
+		{pixarray.Pixel{R: 0, G: 127, B: 0, W: 0}, pixarray.Pixel{R: 127, G: 0, B: 0, W: 0}, d("1.0s", t), d("0.5s", t), 63.5, 63.5, 0, 0},
+		{pixarray.Pixel{R: 127, G: 127, B: 127, W: 127}, pixarray.Pixel{R: 127, G: 0, B: 127, W: 0}, d("3.0s", t), d("1.0s", t), 127, 84.66666, 127, 84.66666},
+		{pixarray.Pixel{R: 127, G: 127, B: 127, W: 127}, pixarray.Pixel{R: 127, G: 0, B: 127, W: 0}, d("3.0s", t), d("2.0s", t), 127, 42.33333, 127, 42.33333},
+		{pixarray.Pixel{R: 127, G: 127, B: 127, W: 127}, pixarray.Pixel{R: 0, G: 0, B: 0, W: 0}, d("127.0s", t), d("10.5s", t), 116.5, 116.5, 116.5, 116.5},
+		{pixarray.Pixel{R: 127, G: 127, B: 0, W: 0}, pixarray.Pixel{R: 0, G: 0, B: 127, W: 127}, d("127.0s", t), d("10.5s", t), 116.5, 116.5, 10.5, 10.5},
+		{pixarray.Pixel{R: 126, G: 126, B: 0, W: 0}, pixarray.Pixel{R: 0, G: 63, B: 126, W: 63}, d("126.0s", t), d("10.5s", t), 115.5, 120.75, 10.5, 5.25},
+		{pixarray.Pixel{R: 0, G: 0, B: 0, W: 0}, pixarray.Pixel{R: 120, G: 10, B: 0, W: 5}, d("120.0s", t), d("6.0s", t), 6.0, 0.5, 0, 0.25},
 	}
 
 	tm := time.Now()
@@ -121,16 +131,329 @@ func TestAllSameFade(t *testing.T) {
 
 func BenchmarkFadeStep(b *testing.B) {
 	pa := pixarray.NewPixArray(100, 4, newTestLeds(100))
-	pa.SetAll(pixarray.Pixel{127, 0, 0, 0})
+	pa.SetAll(pixarray.Pixel{R: 127, G: 0, B: 0, W: 0})
 	tm := time.Now()
 	add := time.Duration((7200 * time.Second).Nanoseconds() / int64(b.N))
 	if add == 0 {
 		b.Fatalf("Zero delay")
 	}
-	f := NewFade(d("7200.0s", b), pixarray.Pixel{0, 127, 0, 0})
+	f := NewFade(d("7200.0s", b), pixarray.Pixel{R: 0, G: 127, B: 0, W: 0})
 	f.Start(pa, tm)
 	for i := 0; i < b.N; i++ {
 		tm = tm.Add(add)
 		f.NextStep(pa, tm)
 	}
 }
+
+func TestBreatheLevel(t *testing.T) {
+	tests := []struct {
+		wave int
+		x    float64
+		want float64
+	}{
+		{WaveSine, 0.0, 0.0},
+		{WaveSine, 0.25, 0.5},
+		{WaveSine, 0.5, 1.0},
+		{WaveSine, 1.0, 0.0},
+		{WaveTriangle, 0.0, 0.0},
+		{WaveTriangle, 0.25, 0.5},
+		{WaveTriangle, 0.5, 1.0},
+		{WaveTriangle, 0.75, 0.5},
+		{WaveExp, 0.0, 0.0},
+		{WaveExp, 0.25, 0.26894},
+		{WaveExp, 0.5, 1.0},
+		{WaveExp, 1.0, 0.0},
+	}
+
+	for _, test := range tests {
+		if got := breatheLevel(test.wave, test.x); math.Abs(got-test.want) > 0.0001 {
+			t.Errorf("Wrong level for wave %d at %f, want %f, got %f", test.wave, test.x, test.want, got)
+		}
+	}
+}
+
+func TestBreatheDither(t *testing.T) {
+	pa := pixarray.NewPixArray(100, 3, newTestLeds(100))
+	b := NewBreathe(d("10.0s", t), pixarray.Pixel{R: 0, G: 0, B: 0, W: 0}, pixarray.Pixel{R: 3, G: 0, B: 1, W: 0}, WaveTriangle, 0.5)
+	tm := time.Now()
+	b.Start(pa, tm)
+
+	// A quarter of the way through the active half, the triangle is at 0.5
+	b.NextStep(pa, tm.Add(d("1.25s", t)))
+	totR := 0
+	totB := 0
+	for _, p := range pa.GetPixels() {
+		totR += p.R
+		totB += p.B
+	}
+	if totR != 150 {
+		t.Errorf("Wrong total red, want 150, got %d", totR)
+	}
+	if totB != 50 {
+		t.Errorf("Wrong total blue, want 50, got %d", totB)
+	}
+
+	// In the resting half, everything should be at the low colour
+	if r := b.NextStep(pa, tm.Add(d("7.5s", t))); r != d("2.5s", t) {
+		t.Errorf("Wrong rest duration, want 2.5s, got %v", r)
+	}
+	for i, p := range pa.GetPixels() {
+		if p.R != 0 || p.B != 0 {
+			t.Errorf("Pixel %d not at low colour while resting: %v", i, p)
+		}
+	}
+}
+
+func TestEasingEndpoints(t *testing.T) {
+	for n, e := range StringEasings {
+		if got := e(0.0); math.Abs(got) > 0.0001 {
+			t.Errorf("%s(0.0), want 0.0, got %f", n, got)
+		}
+		if got := e(1.0); math.Abs(got-1.0) > 0.0001 {
+			t.Errorf("%s(1.0), want 1.0, got %f", n, got)
+		}
+	}
+}
+
+func TestParseEasing(t *testing.T) {
+	tests := []struct {
+		s    string
+		x    float64
+		want float64
+	}{
+		{"linear", 0.3, 0.3},
+		{"IN_QUAD", 0.5, 0.25},
+		{"out_cubic", 0.5, 0.875},
+		{"IN_OUT_SINE", 0.25, 0.146447},
+		{"OUT_BOUNCE", 0.5, 0.765625},
+		// CSS "ease"
+		{"cubic_bezier(0.25,0.1,0.25,1)", 0.5, 0.802403},
+		// A Bézier that's really linear
+		{"CUBIC_BEZIER(0.333333,0.333333,0.666667,0.666667)", 0.7, 0.7},
+	}
+
+	for _, test := range tests {
+		e, err := ParseEasing(test.s)
+		if err != nil {
+			t.Errorf("Couldn't parse %s: %v", test.s, err)
+			continue
+		}
+		if got := e(test.x); math.Abs(got-test.want) > 0.0001 {
+			t.Errorf("%s(%f), want %f, got %f", test.s, test.x, test.want, got)
+		}
+	}
+
+	for _, s := range []string{"IN_WOBBLE", "CUBIC_BEZIER(1.5,0,0.5,1)", "CUBIC_BEZIER(0,0,1)"} {
+		if _, err := ParseEasing(s); err == nil {
+			t.Errorf("Parsed invalid easing %s without error", s)
+		}
+	}
+}
+
+func TestEasedFadeDithers(t *testing.T) {
+	pa := pixarray.NewPixArray(100, 3, newTestLeds(100))
+	pa.SetAll(pixarray.Pixel{R: 0, G: 0, B: 0, W: 0})
+	f := NewEasedFade(d("10.0s", t), pixarray.Pixel{R: 100, G: 0, B: 0, W: 0}, EaseInQuad)
+	tm := time.Now()
+	f.Start(pa, tm)
+	// 30% through the time, IN_QUAD is 9% through the fade: 9.0 on average
+	f.NextStep(pa, tm.Add(d("3.0s", t)))
+	totR := 0
+	for i, p := range pa.GetPixels() {
+		if p.R != 9 && p.R != 10 {
+			t.Errorf("Wrong red at pixel %d, want 9/10, got %d", i, p.R)
+		}
+		totR += p.R
+	}
+	if math.Abs(float64(totR)/100.0-9.0) > 0.01 {
+		t.Errorf("Wrong average red, want 9.0, got %f", float64(totR)/100.0)
+	}
+	// 50% through, 25.0
+	f.NextStep(pa, tm.Add(d("5.0s", t)))
+	totR = 0
+	for _, p := range pa.GetPixels() {
+		totR += p.R
+	}
+	if math.Abs(float64(totR)/100.0-25.0) > 0.01 {
+		t.Errorf("Wrong average red, want 25.0, got %f", float64(totR)/100.0)
+	}
+}
+
+func TestColorFade(t *testing.T) {
+	red := pixarray.Pixel{R: 127, G: 0, B: 0, W: 0}
+	green := pixarray.Pixel{R: 0, G: 127, B: 0, W: 0}
+	tests := []struct {
+		space int
+		pct   string
+		r     float64
+		g     float64
+		b     float64
+	}{
+		{SpaceRGB, "5.0s", 63.5, 63.5, 0},
+		{SpaceHSV, "5.0s", 127, 127, 0},
+		{SpaceHSL, "5.0s", 127, 127, 0},
+		{SpaceHSV, "2.5s", 127, 63.5, 0},
+		{SpaceOKLab, "0.0s", 127, 0, 0},
+		{SpaceOKLab, "10.0s", 0, 127, 0},
+	}
+
+	for _, test := range tests {
+		pa := pixarray.NewPixArray(100, 3, newTestLeds(100))
+		pa.SetAll(red)
+		f := NewColorFade(d("10.0s", t), green, nil, test.space)
+		tm := time.Now()
+		f.Start(pa, tm)
+		f.NextStep(pa, tm.Add(d(test.pct, t)))
+		var totR, totG, totB int
+		for _, p := range pa.GetPixels() {
+			totR += p.R
+			totG += p.G
+			totB += p.B
+		}
+		got := []float64{float64(totR) / 100.0, float64(totG) / 100.0, float64(totB) / 100.0}
+		want := []float64{test.r, test.g, test.b}
+		for i := range got {
+			if math.Abs(got[i]-want[i]) > 0.01 {
+				t.Errorf("Space %d at %s: wrong average, want %v, got %v", test.space, test.pct, want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestHueColor(t *testing.T) {
+	for _, space := range []int{SpaceRGB, SpaceHSV, SpaceLab, SpaceOKLab} {
+		for i := 0; i < 12; i++ {
+			h := float64(i) / 12.0
+			p := hueColor(space, h, 255)
+			if p.R < 0 || p.R > 255 || p.G < 0 || p.G > 255 || p.B < 0 || p.B > 255 {
+				t.Errorf("Space %d hue %f out of gamut: %v", space, h, p)
+			}
+			if got := hueOf(space, p.round(), 255); math.Abs(got-h) > 0.01 && math.Abs(got-h) < 0.99 {
+				t.Errorf("Space %d hue %f came back as %f", space, h, got)
+			}
+		}
+	}
+}
+
+func TestPaletteSample(t *testing.T) {
+	p, err := ParsePalette("Test 0.5:0000ff 0:ff0000 0.25:00ff00")
+	if err != nil {
+		t.Fatalf("Couldn't parse palette: %v", err)
+	}
+	if got, want := p.String(), "test 0:ff0000 0.25:00ff00 0.5:0000ff"; got != want {
+		t.Errorf("Wrong palette string, got: %s, want: %s", got, want)
+	}
+
+	tests := []struct {
+		pos  float64
+		want pixarray.Pixel
+	}{
+		{0.0, pixarray.Pixel{R: 254, G: 0, B: 0, W: 0}},
+		{0.125, pixarray.Pixel{R: 127, G: 127, B: 0, W: 0}},
+		{0.25, pixarray.Pixel{R: 0, G: 254, B: 0, W: 0}},
+		{0.5, pixarray.Pixel{R: 0, G: 0, B: 254, W: 0}},
+		// Wraps from the last stop back to the first
+		{0.75, pixarray.Pixel{R: 127, G: 0, B: 127, W: 0}},
+		{1.25, pixarray.Pixel{R: 0, G: 254, B: 0, W: 0}},
+	}
+	for _, test := range tests {
+		if got := p.sample(test.pos, 254).round(); got != test.want {
+			t.Errorf("Sample at %f, got: %v, want: %v", test.pos, got, test.want)
+		}
+	}
+
+	for _, def := range []string{"nostops", "bad 1.5:ff0000", "bad 0:ff00", "bad 0-ff0000", "bad 0:gg0000"} {
+		if _, err := ParsePalette(def); err == nil {
+			t.Errorf("Parsed invalid palette '%s' without error", def)
+		}
+	}
+}
+
+func TestLoadPalettes(t *testing.T) {
+	err := LoadPalettes(strings.NewReader("# A comment\n\nsunset 0:ff8000 0.5:800040\n"))
+	if err != nil {
+		t.Fatalf("Couldn't load palettes: %v", err)
+	}
+	if _, ok := LookupPalette("SUNSET"); !ok {
+		t.Errorf("Loaded palette not found")
+	}
+	if _, ok := LookupPalette("ocean"); !ok {
+		t.Errorf("Built-in palette not found")
+	}
+	if err := LoadPalettes(strings.NewReader("good 0:000000\nbad\n")); err == nil {
+		t.Errorf("Loaded bad palette without error")
+	}
+	if _, ok := LookupPalette("good"); ok {
+		t.Errorf("Palette defined from file with a bad line")
+	}
+}
+
+func TestSunrise(t *testing.T) {
+	pa := pixarray.NewPixArray(100, 3, newTestLeds(100))
+	pa.SetAll(pixarray.Pixel{R: 0, G: 0, B: 0, W: 0})
+	s := NewSunrise(d("1800.0s", t))
+	tm := time.Now()
+	s.Start(pa, tm)
+
+	// Five minutes in, it should be barely on, and red
+	s.NextStep(pa, tm.Add(d("300.0s", t)))
+	var totR, totG, totB int
+	for _, p := range pa.GetPixels() {
+		totR += p.R
+		totG += p.G
+		totB += p.B
+	}
+	if totR == 0 || totR > 100 {
+		t.Errorf("Wrong total red after 5 mins, want >0, <=100, got %d", totR)
+	}
+	if totG > totR/4 || totB != 0 {
+		t.Errorf("Not red enough after 5 mins, got totals %d,%d,%d", totR, totG, totB)
+	}
+
+	if r := s.NextStep(pa, tm.Add(d("1800.0s", t))); r != 0 {
+		t.Errorf("Sunrise not finished at end, wants another step in %v", r)
+	}
+	want := pixarray.Pixel{R: 160, G: 131, B: 88, W: 0}
+	for i, p := range pa.GetPixels() {
+		if p != want {
+			t.Errorf("Wrong colour at pixel %d after sunrise, got: %v, want: %v", i, p, want)
+			break
+		}
+	}
+
+	s = NewSunset(d("60.0s", t))
+	s.Start(pa, tm)
+	if s.NextStep(pa, tm.Add(d("60.0s", t))); pa.GetPixel(0) != (pixarray.Pixel{R: 0, G: 0, B: 0, W: 0}) {
+		t.Errorf("Sunset didn't end black, got: %v", pa.GetPixel(0))
+	}
+}
+
+func TestPlayback(t *testing.T) {
+	rec := &pixarray.Recording{NumPixels: 2, NumColors: 3, MaxPerChannel: 80, Frames: []pixarray.Frame{
+		{At: 0, Pixels: []pixarray.Pixel{{R: 80, G: 0, B: 0, W: -1}, {R: 0, G: 80, B: 0, W: -1}}},
+		{At: d("100ms", t), Pixels: []pixarray.Pixel{{R: 0, G: 0, B: 80, W: -1}, {R: 0, G: 0, B: 80, W: -1}}},
+	}}
+	// Twice as many pixels, twice the channel depth, twice the speed
+	pa := pixarray.NewPixArray(4, 3, newTestLeds(4))
+	p := NewPlayback(rec, 2.0)
+	tm := time.Now()
+	p.Start(pa, tm)
+	if r := p.NextStep(pa, tm); r != d("50ms", t) {
+		t.Errorf("Wrong time to next frame, got: %v, want: 50ms", r)
+	}
+	want := []pixarray.Pixel{{R: 160, G: 0, B: 0, W: 0}, {R: 120, G: 40, B: 0, W: 0}, {R: 40, G: 120, B: 0, W: 0}, {R: 0, G: 160, B: 0, W: 0}}
+	for i, w := range want {
+		if got := pa.GetPixel(i); got != w {
+			t.Errorf("Wrong pixel %d in first frame, got: %v, want: %v", i, got, w)
+		}
+	}
+	if r := p.NextStep(pa, tm.Add(d("60ms", t))); r != 0 {
+		t.Errorf("Playback not finished after last frame, wants another step in %v", r)
+	}
+	for i, got := range pa.GetPixels() {
+		if w := (pixarray.Pixel{R: 0, G: 0, B: 160, W: 0}); got != w {
+			t.Errorf("Wrong pixel %d in last frame, got: %v, want: %v", i, got, w)
+		}
+	}
+}
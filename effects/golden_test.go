@@ -0,0 +1,111 @@
+package effects
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	clock "github.com/Jon-Bright/ledctl/clock"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// goldenStart is when golden effects start, on the fake clock.
+var goldenStart = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var update = flag.Bool("update", false, "Write the golden files in testdata/golden, rather than checking effects against them")
+
+// A goldenCase is an effect run from a given start, with the pixels sampled at given offsets into
+// the effect and compared to testdata/golden/<name>.golden.
+type goldenCase struct {
+	name    string
+	pixels  int
+	start   pixarray.Pixel
+	effect  func() Effect
+	samples []string
+}
+
+func TestGolden(t *testing.T) {
+	black := pixarray.Pixel{R: 0, G: 0, B: 0, W: 0}
+	tests := []goldenCase{
+		{"rainbow", 16, black, func() Effect { return NewRainbow(d("8s", t)) },
+			[]string{"0s", "1s", "2.5s", "4s", "7.99s", "8s", "11s"}},
+		{"cycle", 4, black, func() Effect { return NewCycle(d("7.68s", t)) },
+			[]string{"0s", "500ms", "1.27s", "2s", "3.5s", "5s", "6.5s", "8s", "9s"}},
+		{"cycle_from_green", 4, pixarray.Pixel{R: 20, G: 100, B: 60, W: 0}, func() Effect { return NewCycle(d("7.68s", t)) },
+			[]string{"0s", "200ms", "600ms", "1.5s", "3s"}},
+		{"knightrider", 20, pixarray.Pixel{R: 50, G: 50, B: 50, W: 0}, func() Effect { return NewKnightRider(d("1s", t), 5) },
+			[]string{"0s", "100ms", "250ms", "500ms", "999ms", "1.1s", "1.5s", "1.9s", "2.3s"}},
+		{"fade", 4, pixarray.Pixel{R: 160, G: 0, B: 40, W: 0}, func() Effect { return NewFade(d("2s", t), pixarray.Pixel{R: 0, G: 80, B: 0, W: 0}) },
+			[]string{"0s", "500ms", "1s", "1.5s", "2s", "3s"}},
+		{"zip", 10, black, func() Effect { return NewZip(d("1s", t), pixarray.Pixel{R: 0, G: 0, B: 160, W: 0}) },
+			[]string{"0s", "250ms", "500ms", "750ms", "1s"}},
+		{"breathe", 2, black, func() Effect {
+			return NewBreathe(d("2s", t), black, pixarray.Pixel{R: 160, G: 100, B: 0, W: 0}, WaveTriangle, 0.5)
+		}, []string{"0s", "250ms", "500ms", "750ms", "1s", "1.5s", "2.25s"}},
+	}
+	for _, tc := range tests {
+		got := runGolden(t, tc)
+		path := filepath.Join("testdata", "golden", tc.name+".golden")
+		if *update {
+			err := ioutil.WriteFile(path, []byte(got), 0644)
+			if err != nil {
+				t.Fatalf("Couldn't update golden file: %v", err)
+			}
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Couldn't read golden file (run with -update to create it): %v", err)
+		}
+		if got == string(b) {
+			continue
+		}
+		gl := strings.Split(got, "\n")
+		wl := strings.Split(string(b), "\n")
+		if len(gl) != len(wl) {
+			t.Errorf("%s: wrong number of frames (run with -update if this is intended), got: %d, want: %d", tc.name, len(gl)-1, len(wl)-1)
+			continue
+		}
+		for i := range gl {
+			if gl[i] != wl[i] {
+				t.Errorf("%s: wrong frame (run with -update if this is intended)\n got: %s\nwant: %s", tc.name, gl[i], wl[i])
+				break
+			}
+		}
+	}
+}
+
+// runGolden runs tc's effect on a fake clock, making every step at the time it was asked for, and
+// returns a line for each sample: its offset, then the colour of each pixel at that offset.
+func runGolden(t *testing.T, tc goldenCase) string {
+	pa := pixarray.NewPixArray(tc.pixels, 3, newTestLeds(tc.pixels))
+	pa.SetAll(tc.start)
+	fc := clock.NewFake(goldenStart)
+	e := tc.effect()
+	e.Start(pa, fc.Now())
+	step := e.NextStep(pa, fc.Now())
+	due := fc.Now().Add(step)
+	var buf bytes.Buffer
+	for _, s := range tc.samples {
+		at := goldenStart.Add(d(s, t))
+		if at.Before(fc.Now()) {
+			t.Fatalf("%s: samples out of order at %s", tc.name, s)
+		}
+		for step != 0 && !due.After(at) {
+			fc.Advance(due.Sub(fc.Now()))
+			step = e.NextStep(pa, fc.Now())
+			due = due.Add(step)
+		}
+		fc.Advance(at.Sub(fc.Now()))
+		fmt.Fprintf(&buf, "%-6s", s)
+		for _, p := range pa.GetPixels() {
+			fmt.Fprintf(&buf, " %s", p.String())
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,205 @@
+package effects
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A PaletteStop is one colour in a Palette's gradient. Pos runs from 0.0 to 1.0, R, G and B are
+// normalised to 0.0-1.0, so that palettes work the same whatever the LEDs' channel depth.
+type PaletteStop struct {
+	Pos float64
+	R   float64
+	G   float64
+	B   float64
+}
+
+// A Palette is a gradient through a number of stops. Palettes wrap around: after the last stop,
+// the gradient continues back to the first one, so that e.g. a Rainbow drawn from a palette has no
+// visible seam.
+type Palette struct {
+	name  string
+	stops []PaletteStop
+}
+
+func NewPalette(name string, stops []PaletteStop) (*Palette, error) {
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return nil, fmt.Errorf("invalid palette name '%s'", name)
+	}
+	if len(stops) == 0 {
+		return nil, fmt.Errorf("palette %s has no stops", name)
+	}
+	p := Palette{strings.ToLower(name), make([]PaletteStop, len(stops))}
+	copy(p.stops, stops)
+	for _, s := range p.stops {
+		if s.Pos < 0.0 || s.Pos > 1.0 {
+			return nil, fmt.Errorf("palette %s stop position %f must be between 0.0 and 1.0", name, s.Pos)
+		}
+	}
+	sort.SliceStable(p.stops, func(i, j int) bool { return p.stops[i].Pos < p.stops[j].Pos })
+	return &p, nil
+}
+
+// ParsePalette parses a palette definition of the form "<name> <pos>:<colour> <pos>:<colour> ...",
+// where each colour is six hex digits of 8-bit RGB.
+func ParsePalette(def string) (*Palette, error) {
+	t := strings.Fields(def)
+	if len(t) < 2 {
+		return nil, fmt.Errorf("palette definition '%s' needs a name and at least one stop", def)
+	}
+	var stops []PaletteStop
+	for _, st := range t[1:] {
+		ps := strings.SplitN(st, ":", 2)
+		if len(ps) != 2 {
+			return nil, fmt.Errorf("stop '%s' isn't <pos>:<colour>", st)
+		}
+		pos, err := strconv.ParseFloat(ps[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse stop position '%s': %v", ps[0], err)
+		}
+		var r, g, b int
+		if len(ps[1]) != 6 {
+			return nil, fmt.Errorf("stop colour '%s' isn't six hex digits", ps[1])
+		}
+		_, err = fmt.Sscanf(ps[1], "%02x%02x%02x", &r, &g, &b)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse stop colour '%s': %v", ps[1], err)
+		}
+		stops = append(stops, PaletteStop{pos, float64(r) / 255.0, float64(g) / 255.0, float64(b) / 255.0})
+	}
+	return NewPalette(t[0], stops)
+}
+
+func (p *Palette) Name() string {
+	return p.name
+}
+
+// String returns the palette in the form accepted by ParsePalette.
+func (p *Palette) String() string {
+	var sb strings.Builder
+	sb.WriteString(p.name)
+	for _, s := range p.stops {
+		fmt.Fprintf(&sb, " %s:%02x%02x%02x", strconv.FormatFloat(s.Pos, 'f', -1, 64), round(s.R*255.0), round(s.G*255.0), round(s.B*255.0))
+	}
+	return sb.String()
+}
+
+// sample returns the palette's colour at pos, wrapping pos into 0.0-1.0. max is the value of a
+// fully-lit channel.
+func (p *Palette) sample(pos float64, max int) fPixel {
+	pos -= math.Floor(pos)
+	// Find the stops either side of pos, wrapping round from the last to the first
+	n := len(p.stops)
+	i := sort.Search(n, func(i int) bool { return p.stops[i].Pos > pos })
+	prev := p.stops[(i+n-1)%n]
+	next := p.stops[i%n]
+	prevPos := prev.Pos
+	nextPos := next.Pos
+	if i == 0 {
+		prevPos -= 1.0
+	}
+	if i == n {
+		nextPos += 1.0
+	}
+	pct := 0.0
+	if nextPos > prevPos {
+		pct = (pos - prevPos) / (nextPos - prevPos)
+	}
+	m := float64(max)
+	return fPixel{
+		R: lerp(prev.R, next.R, pct) * m,
+		G: lerp(prev.G, next.G, pct) * m,
+		B: lerp(prev.B, next.B, pct) * m,
+	}
+}
+
+var (
+	palettesMu sync.Mutex
+	palettes   = map[string]*Palette{}
+)
+
+func init() {
+	for _, def := range []string{
+		"rainbow 0:ff0000 0.166667:ffff00 0.333333:00ff00 0.5:00ffff 0.666667:0000ff 0.833333:ff00ff",
+		"ocean 0:000030 0.25:003070 0.5:0070a0 0.7:00b0c0 0.85:60e0f0",
+		"lava 0:000000 0.2:500000 0.45:c00000 0.65:ff4000 0.8:ff9000 0.9:ffe080",
+		"forest 0:002000 0.3:006010 0.5:208020 0.7:609000 0.85:205010",
+		"party 0:5500ab 0.125:84007c 0.25:b5004b 0.375:e5001b 0.5:e81700 0.625:b84700 0.75:ab7700 0.875:abab00",
+	} {
+		p, err := ParsePalette(def)
+		if err != nil {
+			panic(fmt.Sprintf("broken built-in palette '%s': %v", def, err))
+		}
+		palettes[p.name] = p
+	}
+}
+
+// LookupPalette returns the palette with the given (case-insensitive) name.
+func LookupPalette(name string) (*Palette, bool) {
+	palettesMu.Lock()
+	defer palettesMu.Unlock()
+	p, ok := palettes[strings.ToLower(name)]
+	return p, ok
+}
+
+// DefinePalette makes p available to LookupPalette, replacing any palette of the same name.
+func DefinePalette(p *Palette) {
+	palettesMu.Lock()
+	defer palettesMu.Unlock()
+	palettes[p.name] = p
+}
+
+// Palettes returns all defined palettes, sorted by name.
+func Palettes() []*Palette {
+	palettesMu.Lock()
+	defer palettesMu.Unlock()
+	ps := make([]*Palette, 0, len(palettes))
+	for _, p := range palettes {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].name < ps[j].name })
+	return ps
+}
+
+// ReadPalettes reads palette definitions, one per line in the form accepted by ParsePalette.
+// Blank lines and lines starting with # are ignored.
+func ReadPalettes(r io.Reader) ([]*Palette, error) {
+	s := bufio.NewScanner(r)
+	n := 0
+	var ps []*Palette
+	for s.Scan() {
+		n++
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		p, err := ParsePalette(l)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		ps = append(ps, p)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// LoadPalettes reads palette definitions as ReadPalettes does and defines them. If any definition
+// is bad, none are defined.
+func LoadPalettes(r io.Reader) error {
+	ps, err := ReadPalettes(r)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		DefinePalette(p)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package effects
+
+import (
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// Playback replays a recording, speed times as fast as it was recorded. If the strip has a
+// different number of pixels from the recording, each pixel shows the colour at the same place
+// along the recorded strip, blending the recorded pixels either side. Colours are scaled to the
+// strip's channel depth.
+type Playback struct {
+	rec   *pixarray.Recording
+	speed float64
+	start time.Time
+}
+
+func NewPlayback(rec *pixarray.Recording, speed float64) *Playback {
+	return &Playback{rec: rec, speed: speed}
+}
+
+func (p *Playback) Start(pa *pixarray.PixArray, now time.Time) {
+	log.Printf("Starting Playback, %d frames over %v, speed %f", len(p.rec.Frames), p.rec.Duration(), p.speed)
+	p.start = now
+}
+
+func (p *Playback) NextStep(pa *pixarray.PixArray, now time.Time) time.Duration {
+	fs := p.rec.Frames
+	if len(fs) == 0 {
+		return 0
+	}
+	at := time.Duration(float64(now.Sub(p.start)) * p.speed)
+	// The latest frame that's due, skipping any we were too late for
+	i := sort.Search(len(fs), func(i int) bool { return fs[i].At > at }) - 1
+	if i < 0 {
+		i = 0
+	}
+	p.show(pa, fs[i].Pixels)
+	if i == len(fs)-1 {
+		return 0
+	}
+	d := time.Duration(float64(fs[i+1].At-at) / p.speed)
+	if d <= 0 {
+		// Step returning 0 would end the effect
+		d = time.Nanosecond
+	}
+	return d
+}
+
+// show sets the strip to a recorded frame, resampled and scaled to fit.
+func (p *Playback) show(pa *pixarray.PixArray, f []pixarray.Pixel) {
+	n := len(f)
+	if n == 0 {
+		return
+	}
+	scale := float64(pa.MaxPerChannel()) / float64(p.rec.MaxPerChannel)
+	m := pa.NumPixels()
+	for j := 0; j < m; j++ {
+		// Pixel centres line up with the same fraction of the way along each strip
+		x := (float64(j)+0.5)*float64(n)/float64(m) - 0.5
+		x = math.Max(0.0, math.Min(x, float64(n-1)))
+		i := int(x)
+		frac := x - float64(i)
+		a := f[i]
+		b := f[i]
+		if i+1 < n {
+			b = f[i+1]
+		}
+		fp := fPixel{
+			R: (float64(a.R)*(1-frac) + float64(b.R)*frac) * scale,
+			G: (float64(a.G)*(1-frac) + float64(b.G)*frac) * scale,
+			B: (float64(a.B)*(1-frac) + float64(b.B)*frac) * scale,
+		}
+		if a.W >= 0 && b.W >= 0 {
+			fp.W = (float64(a.W)*(1-frac) + float64(b.W)*frac) * scale
+		}
+		pa.SetOne(j, fp.round())
+	}
+}
+
+func (p *Playback) Name() string {
+	return "PLAYBACK"
+}
@@ -0,0 +1,92 @@
+package effects
+
+import (
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"log"
+	"math"
+	"time"
+)
+
+// The colours a sunrise passes through, ignoring brightness: deep red, through orange, to a warm
+// white. These are linear-light values, like all channel values.
+var sunriseStops = []PaletteStop{
+	{0.0, 1.0, 0.0, 0.0},
+	{0.35, 1.0, 0.12, 0.0},
+	{0.6, 1.0, 0.35, 0.04},
+	{0.85, 1.0, 0.65, 0.25},
+	{1.0, 1.0, 0.82, 0.55},
+}
+
+// sunriseColor returns the normalised colour of a sunrise pos (0.0-1.0) of the way through.
+func sunriseColor(pos float64) (r, g, b float64) {
+	// Brightness rises slowly at first, so the first minutes of a long sunrise are barely visible
+	l := pos * pos * pos
+	for i := 1; i < len(sunriseStops); i++ {
+		prev := sunriseStops[i-1]
+		next := sunriseStops[i]
+		if pos <= next.Pos || i == len(sunriseStops)-1 {
+			pct := math.Max(0.0, math.Min(1.0, (pos-prev.Pos)/(next.Pos-prev.Pos)))
+			return lerp(prev.R, next.R, pct) * l, lerp(prev.G, next.G, pct) * l, lerp(prev.B, next.B, pct) * l
+		}
+	}
+	return 0.0, 0.0, 0.0
+}
+
+// Sunrise simulates dawn over riseTime, from black through deep red and orange to a warm white.
+// Reversed, it simulates a sunset instead, ending at black.
+type Sunrise struct {
+	riseTime time.Duration
+	reverse  bool
+	timeStep time.Duration
+	start    time.Time
+}
+
+func NewSunrise(riseTime time.Duration) *Sunrise {
+	s := Sunrise{}
+	s.riseTime = riseTime
+	return &s
+}
+
+func NewSunset(setTime time.Duration) *Sunrise {
+	s := NewSunrise(setTime)
+	s.reverse = true
+	return s
+}
+
+func (s *Sunrise) Start(pa *pixarray.PixArray, now time.Time) {
+	log.Printf("Starting %s over %v", s.Name(), s.riseTime)
+	s.start = now
+	// Brightness changes fastest at the bright end, three times faster than average, and we'd
+	// like to step through every dithered level there.
+	levels := int64(3 * pa.MaxPerChannel() * pa.NumPixels())
+	s.timeStep = time.Duration(s.riseTime.Nanoseconds() / levels)
+	if s.timeStep < time.Millisecond {
+		s.timeStep = time.Millisecond
+	}
+}
+
+func (s *Sunrise) NextStep(pa *pixarray.PixArray, now time.Time) time.Duration {
+	pos := float64(now.Sub(s.start).Nanoseconds()) / float64(s.riseTime.Nanoseconds())
+	done := pos >= 1.0
+	if done {
+		pos = 1.0
+	}
+	if s.reverse {
+		pos = 1.0 - pos
+	}
+	r, g, b := sunriseColor(pos)
+	m := float64(pa.MaxPerChannel())
+	if done {
+		pa.SetAll(fPixel{R: r * m, G: g * m, B: b * m}.round())
+		return 0
+	}
+	setDithered(pa, fPixel{R: r * m, G: g * m, B: b * m})
+	return s.timeStep
+}
+
+func (s *Sunrise) Name() string {
+	if s.reverse {
+		return "SUNSET"
+	}
+	return "SUNRISE"
+}
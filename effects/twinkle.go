@@ -0,0 +1,72 @@
+package effects
+
+import (
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Twinkle lights random pixels in random colours from a palette, each brightening and then fading
+// away again over twinkleTime, against a black background. density is the fraction of pixels
+// that are twinkling at any one time, on average.
+type Twinkle struct {
+	twinkleTime time.Duration
+	palette     *Palette
+	density     float64
+	starts      []time.Time // Zero for pixels that aren't currently twinkling
+	colors      []fPixel
+	rnd         *rand.Rand
+	last        time.Time
+}
+
+func NewTwinkle(twinkleTime time.Duration, palette *Palette, density float64) *Twinkle {
+	t := Twinkle{}
+	t.twinkleTime = twinkleTime
+	t.palette = palette
+	t.density = density
+	return &t
+}
+
+func (t *Twinkle) Start(pa *pixarray.PixArray, now time.Time) {
+	log.Printf("Starting Twinkle, palette %s", t.palette.Name())
+	t.starts = make([]time.Time, pa.NumPixels())
+	t.colors = make([]fPixel, pa.NumPixels())
+	t.rnd = rand.New(rand.NewSource(now.UnixNano()))
+	t.last = now
+	pa.SetAll(pixarray.Pixel{R: 0, G: 0, B: 0, W: 0})
+}
+
+func (t *Twinkle) NextStep(pa *pixarray.PixArray, now time.Time) time.Duration {
+	// Each twinkle lasts twinkleTime, so to keep density of the pixels busy, each idle pixel needs
+	// this chance of starting one in the time since our last step.
+	chance := t.density * float64(now.Sub(t.last).Nanoseconds()) / float64(t.twinkleTime.Nanoseconds())
+	t.last = now
+	for i := range t.starts {
+		if t.starts[i].IsZero() && t.rnd.Float64() < chance {
+			t.starts[i] = now
+			t.colors[i] = t.palette.sample(t.rnd.Float64(), pa.MaxPerChannel())
+		}
+		if t.starts[i].IsZero() {
+			continue
+		}
+		x := float64(now.Sub(t.starts[i]).Nanoseconds()) / float64(t.twinkleTime.Nanoseconds())
+		if x >= 1.0 {
+			t.starts[i] = time.Time{}
+			pa.SetOne(i, pixarray.Pixel{R: 0, G: 0, B: 0, W: 0})
+			continue
+		}
+		l := breatheLevel(WaveSine, x)
+		c := t.colors[i]
+		pa.SetOne(i, fPixel{R: c.R * l, G: c.G * l, B: c.B * l}.round())
+	}
+	step := t.twinkleTime / 50
+	if step < 10*time.Millisecond {
+		step = 10 * time.Millisecond
+	}
+	return step
+}
+
+func (t *Twinkle) Name() string {
+	return "TWINKLE"
+}
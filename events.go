@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// How many events a subscriber can fall behind by before further events are dropped for it.
+const eventBacklog = 64
+
+// eventHub fans events out to subscribers. Publishing never blocks: a subscriber that isn't
+// keeping up misses events rather than holding up the effect loop.
+type eventHub struct {
+	mu       sync.Mutex
+	subs     map[chan string]bool
+	lastMode string
+}
+
+func (h *eventHub) subscribe() chan string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = map[chan string]bool{}
+	}
+	c := make(chan string, eventBacklog)
+	h.subs[c] = true
+	return c
+}
+
+func (h *eventHub) unsubscribe(c chan string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, c)
+}
+
+// publish sends an event to all subscribers.
+func (h *eventHub) publish(format string, a ...interface{}) {
+	ev := fmt.Sprintf(format, a...)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.subs {
+		select {
+		case c <- ev:
+		default:
+			log.Printf("Subscriber too slow, dropping event '%s'", ev)
+		}
+	}
+}
+
+// mode returns the server's current mode, as returned by MODE.
+func (s *Server) mode() (string, error) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.modeLocked()
+}
+
+// modeLocked is mode, for when s.stateMu is already held.
+func (s *Server) modeLocked() (string, error) {
+	if s.off {
+		return "OFF", nil
+	}
+	if s.running {
+		if s.laste == nil {
+			return "", fmt.Errorf("s running, but laste nil!")
+		}
+		return s.laste.Name(), nil
+	}
+	return "CONST", nil
+}
+
+// checkMode publishes a MODE event if the mode has changed since it was last published. s.stateMu
+// must be held, so that the mode can't change again before it's published.
+func (s *Server) checkMode() {
+	m, err := s.modeLocked()
+	if err != nil {
+		return
+	}
+	s.events.mu.Lock()
+	changed := m != s.events.lastMode
+	s.events.lastMode = m
+	s.events.mu.Unlock()
+	if changed {
+		s.events.publish("MODE %s", m)
+	}
+}
+
+// subscribe turns a connection into an event stream, writing events to w until the client
+// disconnects (or sends anything) or a write fails.
+func (s *Server) subscribe(r *bufio.Reader, w *bufio.Writer, version int, id string) {
+	c := s.events.subscribe()
+	defer s.events.unsubscribe(c)
+	if version >= 2 {
+		writeV2(w, id, nil, statusOK, "OK")
+	} else {
+		w.WriteString("OK\n")
+	}
+	err := w.Flush()
+	if err != nil {
+		log.Printf("error writing reply: %v", err)
+		return
+	}
+	done := make(chan bool)
+	go func() {
+		// Whatever the client sends (QUIT, or just closing the connection) ends the subscription
+		_, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Printf("Error reading from subscriber: %v", err)
+		}
+		close(done)
+	}()
+	pfx := ""
+	if version >= 2 {
+		pfx = fmt.Sprintf("%d ", statusEvent)
+		if id != "" {
+			pfx = id + " " + pfx
+		}
+	}
+	for {
+		select {
+		case ev := <-c:
+			w.WriteString(pfx + "EVENT " + ev + "\n")
+			err := w.Flush()
+			if err != nil {
+				log.Printf("error writing event: %v", err)
+				return
+			}
+		case <-done:
+			log.Printf("Subscriber finished")
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	effects "github.com/Jon-Bright/ledctl/effects"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventHubDoesntBlock(t *testing.T) {
+	var h eventHub
+	c := h.subscribe()
+	for i := 0; i < 2*eventBacklog; i++ {
+		h.publish("TEST %d", i)
+	}
+	if len(c) != eventBacklog {
+		t.Errorf("Wrong number of queued events, got: %d, want: %d", len(c), eventBacklog)
+	}
+	if ev := <-c; ev != "TEST 0" {
+		t.Errorf("Wrong first event, got: '%s', want: 'TEST 0'", ev)
+	}
+	h.unsubscribe(c)
+	h.publish("AFTER")
+	if len(c) != eventBacklog-1 {
+		t.Errorf("Event delivered after unsubscribing")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s := newTestServer(4)
+	go s.runEffects()
+	defer func() {
+		done := make(chan bool)
+		s.quit <- done
+		<-done
+	}()
+	client, srv := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(srv)
+	r := bufio.NewReader(client)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("SUBSCRIBE\n"))
+	if l, err := r.ReadString('\n'); err != nil || l != "OK\n" {
+		t.Fatalf("Wrong reply to SUBSCRIBE: '%s' (%v)", l, err)
+	}
+
+	s.startEffect(effects.NewFade(50*time.Millisecond, pixarray.Pixel{R: 0, G: 0, B: 0, W: -1}), "FADE_ALL 000000 0.05")
+	want := map[string]bool{
+		"EVENT ON":                   true,
+		"EVENT EFFECT_STARTED FADE":  true,
+		"EVENT MODE FADE":            true,
+		"EVENT EFFECT_FINISHED FADE": true,
+		"EVENT MODE CONST":           true,
+	}
+	for len(want) > 0 {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Couldn't read event, still waiting for %v: %v", want, err)
+		}
+		l = strings.TrimSuffix(l, "\n")
+		if !want[l] {
+			t.Errorf("Unexpected event '%s'", l)
+		}
+		delete(want, l)
+	}
+}
+
+func TestSubscribeV2(t *testing.T) {
+	s := newTestServer(4)
+	client, srv := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(srv)
+	r := bufio.NewReader(client)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("PROTOCOL 2\n#s SUBSCRIBE\n"))
+	for _, want := range []string{"200 OK\n", "#s 200 OK\n"} {
+		if l, err := r.ReadString('\n'); err != nil || l != want {
+			t.Fatalf("Wrong reply, got: '%s' (%v), want: '%s'", l, err, want)
+		}
+	}
+	// Wait for the subscription to be registered before publishing
+	for {
+		s.events.mu.Lock()
+		n := len(s.events.subs)
+		s.events.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.events.publish("ERROR test")
+	if l, err := r.ReadString('\n'); err != nil || l != "#s 100 EVENT ERROR test\n" {
+		t.Errorf("Wrong event, got: '%s' (%v)", l, err)
+	}
+}
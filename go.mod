@@ -1,8 +1,11 @@
 module github.com/Jon-Bright/ledctl
 
-go 1.11
+go 1.17
 
 require (
 	github.com/edsrzf/mmap-go v1.0.0
-	golang.org/x/sys v0.0.0-20201231184435-2d18734c6014 // indirect
+	golang.org/x/crypto v0.1.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.1.0 // indirect
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	clock "github.com/Jon-Bright/ledctl/clock"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSimServer runs the whole server on simulated LEDs, talking to it over TCP.
+func TestSimServer(t *testing.T) {
+	sim := pixarray.NewSim(10, 3)
+	pa := pixarray.NewPixArray(10, 3, sim)
+	s, err := NewServer(ListenConfig{Bind: "127.0.0.1", Port: 0, UnixMode: "0660"}, pa, clock.Real)
+	if err != nil {
+		t.Fatalf("Couldn't create server: %v", err)
+	}
+	go s.runEffects()
+	s.serve()
+	defer s.shutdown(0)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", s.l["tcp"].Addr().String())
+		if err != nil {
+			t.Fatalf("Couldn't connect: %v", err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	conn, r := dial()
+	defer conn.Close()
+	send := func(l string) string {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		_, err := conn.Write([]byte(l + "\n"))
+		if err != nil {
+			t.Fatalf("Couldn't send '%s': %v", l, err)
+		}
+		rep, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Couldn't read reply to '%s': %v", l, err)
+		}
+		return strings.TrimSuffix(rep, "\n")
+	}
+	// Events say when the fade's finished, rather than polling MODE for it
+	ec, er := dial()
+	defer ec.Close()
+	ec.SetDeadline(time.Now().Add(5 * time.Second))
+	ec.Write([]byte("SUBSCRIBE\n"))
+	if l, err := er.ReadString('\n'); l != "OK\n" {
+		t.Fatalf("Couldn't subscribe, got: '%s', %v", l, err)
+	}
+
+	if got := send("FADE_ALL red 0.05"); got != "OK" {
+		t.Fatalf("Wrong reply to fade, got: '%s', want: 'OK'", got)
+	}
+	for {
+		l, err := er.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Fade didn't finish: %v", err)
+		}
+		if l == "EVENT MODE CONST\n" {
+			break
+		}
+	}
+	if got := send("MODE"); got != "CONST" {
+		t.Errorf("Wrong mode after fade, got: '%s', want: 'CONST'", got)
+	}
+	if got := send("COLOUR"); got != "ff0000" {
+		t.Errorf("Wrong colour after fade, got: '%s', want: 'ff0000'", got)
+	}
+	f, n := sim.Frame()
+	if n == 0 {
+		t.Errorf("No frames written")
+	}
+	for i, p := range f {
+		if want := (pixarray.Pixel{R: 255, G: 0, B: 0, W: -1}); p != want {
+			t.Errorf("Wrong pixel %d in last frame, got: %v, want: %v", i, p, want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package pixarray
+
+import (
+	"math"
+)
+
+// Conversions between a Pixel's RGB channels and other colour spaces. The normalised RGB values
+// used here run from 0.0 to 1.0 and are treated as linear light: LEDs are driven by PWM, so
+// doubling a channel's value doubles its light output, with no sRGB-style gamma involved. Any W
+// channel is left out of these conversions entirely.
+
+// Normalized returns p's R, G and B channels scaled to 0.0-1.0, where max is the value of a
+// fully-lit channel.
+func (p *Pixel) Normalized(max int) (r, g, b float64) {
+	m := float64(max)
+	return float64(p.R) / m, float64(p.G) / m, float64(p.B) / m
+}
+
+func clampChannel(f float64, max int) int {
+	v := int(math.Floor(f*float64(max) + 0.5))
+	if v < 0 {
+		return 0
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// PixelFromNormalized returns the Pixel closest to the given normalised RGB values, where max is
+// the value of a fully-lit channel. Out-of-range values are clamped.
+func PixelFromNormalized(r, g, b float64, max int) Pixel {
+	return Pixel{R: clampChannel(r, max), G: clampChannel(g, max), B: clampChannel(b, max), W: 0}
+}
+
+// RGBToHSV converts normalised RGB to hue (0-360), saturation and value (0.0-1.0).
+func RGBToHSV(r, g, b float64) (h, s, v float64) {
+	v = math.Max(r, math.Max(g, b))
+	c := v - math.Min(r, math.Min(g, b))
+	if v > 0.0 {
+		s = c / v
+	}
+	return rgbHue(r, g, b, v, c), s, v
+}
+
+// rgbHue returns the hue (0-360) shared by HSV and HSL, given the largest channel value mx and the
+// chroma c (largest minus smallest channel value).
+func rgbHue(r, g, b, mx, c float64) float64 {
+	if c == 0.0 {
+		return 0.0
+	}
+	var h float64
+	switch mx {
+	case r:
+		h = math.Mod((g-b)/c, 6.0)
+	case g:
+		h = (b-r)/c + 2.0
+	default:
+		h = (r-g)/c + 4.0
+	}
+	h *= 60.0
+	if h < 0.0 {
+		h += 360.0
+	}
+	return h
+}
+
+// hueToRGB returns the normalised RGB colour with the given hue (0-360) and chroma c, with the
+// smallest channel at m.
+func hueToRGB(h, c, m float64) (r, g, b float64) {
+	h = math.Mod(h, 360.0)
+	if h < 0.0 {
+		h += 360.0
+	}
+	hp := h / 60.0
+	x := c * (1.0 - math.Abs(math.Mod(hp, 2.0)-1.0))
+	switch {
+	case hp < 1.0:
+		r, g, b = c, x, 0.0
+	case hp < 2.0:
+		r, g, b = x, c, 0.0
+	case hp < 3.0:
+		r, g, b = 0.0, c, x
+	case hp < 4.0:
+		r, g, b = 0.0, x, c
+	case hp < 5.0:
+		r, g, b = x, 0.0, c
+	default:
+		r, g, b = c, 0.0, x
+	}
+	return r + m, g + m, b + m
+}
+
+// HSVToRGB converts hue (0-360), saturation and value (0.0-1.0) to normalised RGB.
+func HSVToRGB(h, s, v float64) (r, g, b float64) {
+	c := v * s
+	return hueToRGB(h, c, v-c)
+}
+
+// RGBToHSL converts normalised RGB to hue (0-360), saturation and lightness (0.0-1.0).
+func RGBToHSL(r, g, b float64) (h, s, l float64) {
+	mx := math.Max(r, math.Max(g, b))
+	mn := math.Min(r, math.Min(g, b))
+	c := mx - mn
+	l = (mx + mn) / 2.0
+	if c > 0.0 {
+		s = c / (1.0 - math.Abs(2.0*l-1.0))
+	}
+	return rgbHue(r, g, b, mx, c), s, l
+}
+
+// HSLToRGB converts hue (0-360), saturation and lightness (0.0-1.0) to normalised RGB.
+func HSLToRGB(h, s, l float64) (r, g, b float64) {
+	c := (1.0 - math.Abs(2.0*l-1.0)) * s
+	return hueToRGB(h, c, l-c/2.0)
+}
+
+// D65 reference white, for CIE L*a*b*
+const (
+	whiteX = 0.95047
+	whiteY = 1.0
+	whiteZ = 1.08883
+	labD   = 6.0 / 29.0
+)
+
+func labF(t float64) float64 {
+	if t > labD*labD*labD {
+		return math.Cbrt(t)
+	}
+	return t/(3.0*labD*labD) + 4.0/29.0
+}
+
+func labFInv(t float64) float64 {
+	if t > labD {
+		return t * t * t
+	}
+	return 3.0 * labD * labD * (t - 4.0/29.0)
+}
+
+// RGBToLab converts normalised RGB (with sRGB primaries) to CIE L*a*b*. L runs from 0.0 to 100.0.
+func RGBToLab(r, g, b float64) (l, a, bb float64) {
+	x := 0.4124564*r + 0.3575761*g + 0.1804375*b
+	y := 0.2126729*r + 0.7151522*g + 0.0721750*b
+	z := 0.0193339*r + 0.1191920*g + 0.9503041*b
+	fx := labF(x / whiteX)
+	fy := labF(y / whiteY)
+	fz := labF(z / whiteZ)
+	return 116.0*fy - 16.0, 500.0 * (fx - fy), 200.0 * (fy - fz)
+}
+
+// LabToRGB converts CIE L*a*b* to normalised RGB (with sRGB primaries). Colours outside the RGB
+// gamut give values outside 0.0-1.0.
+func LabToRGB(l, a, bb float64) (r, g, b float64) {
+	fy := (l + 16.0) / 116.0
+	x := whiteX * labFInv(fy+a/500.0)
+	y := whiteY * labFInv(fy)
+	z := whiteZ * labFInv(fy-bb/200.0)
+	r = 3.2404542*x - 1.5371385*y - 0.4985314*z
+	g = -0.9692660*x + 1.8760108*y + 0.0415560*z
+	b = 0.0556434*x - 0.2040259*y + 1.0572252*z
+	return r, g, b
+}
+
+// RGBToOKLab converts normalised RGB (with sRGB primaries) to Björn Ottosson's OKLab. L runs from
+// 0.0 to 1.0.
+func RGBToOKLab(r, g, b float64) (l, a, bb float64) {
+	lc := math.Cbrt(0.4122214708*r + 0.5363325363*g + 0.0514459929*b)
+	mc := math.Cbrt(0.2119034982*r + 0.6806995451*g + 0.1073969566*b)
+	sc := math.Cbrt(0.0883024619*r + 0.2817188376*g + 0.6299787005*b)
+	l = 0.2104542553*lc + 0.7936177850*mc - 0.0040720468*sc
+	a = 1.9779984951*lc - 2.4285922050*mc + 0.4505937099*sc
+	bb = 0.0259040371*lc + 0.7827717662*mc - 0.8086757660*sc
+	return l, a, bb
+}
+
+// OKLabToRGB converts OKLab to normalised RGB (with sRGB primaries). Colours outside the RGB gamut
+// give values outside 0.0-1.0.
+func OKLabToRGB(l, a, bb float64) (r, g, b float64) {
+	lc := l + 0.3963377774*a + 0.2158037573*bb
+	mc := l - 0.1055613458*a - 0.0638541728*bb
+	sc := l - 0.0894841775*a - 1.2914855480*bb
+	lc = lc * lc * lc
+	mc = mc * mc * mc
+	sc = sc * sc * sc
+	r = 4.0767416621*lc - 3.3077115913*mc + 0.2309699292*sc
+	g = -1.2684380046*lc + 2.6097574011*mc - 0.3413193965*sc
+	b = -0.0041960863*lc - 0.7034186147*mc + 1.7076147010*sc
+	return r, g, b
+}
+
+// ToHSV returns p's hue (0-360), saturation and value (0.0-1.0), where max is the value of a
+// fully-lit channel.
+func (p *Pixel) ToHSV(max int) (h, s, v float64) {
+	return RGBToHSV(p.Normalized(max))
+}
+
+// PixelFromHSV returns the Pixel closest to the given hue (0-360), saturation and value (0.0-1.0).
+func PixelFromHSV(h, s, v float64, max int) Pixel {
+	r, g, b := HSVToRGB(h, s, v)
+	return PixelFromNormalized(r, g, b, max)
+}
+
+// ToHSL returns p's hue (0-360), saturation and lightness (0.0-1.0), where max is the value of a
+// fully-lit channel.
+func (p *Pixel) ToHSL(max int) (h, s, l float64) {
+	return RGBToHSL(p.Normalized(max))
+}
+
+// PixelFromHSL returns the Pixel closest to the given hue (0-360), saturation and lightness
+// (0.0-1.0).
+func PixelFromHSL(h, s, l float64, max int) Pixel {
+	r, g, b := HSLToRGB(h, s, l)
+	return PixelFromNormalized(r, g, b, max)
+}
+
+// ToLab returns p as CIE L*a*b*, where max is the value of a fully-lit channel.
+func (p *Pixel) ToLab(max int) (l, a, b float64) {
+	return RGBToLab(p.Normalized(max))
+}
+
+// PixelFromLab returns the Pixel closest to the given CIE L*a*b* colour.
+func PixelFromLab(l, a, bb float64, max int) Pixel {
+	r, g, b := LabToRGB(l, a, bb)
+	return PixelFromNormalized(r, g, b, max)
+}
+
+// ToOKLab returns p as OKLab, where max is the value of a fully-lit channel.
+func (p *Pixel) ToOKLab(max int) (l, a, b float64) {
+	return RGBToOKLab(p.Normalized(max))
+}
+
+// PixelFromOKLab returns the Pixel closest to the given OKLab colour.
+func PixelFromOKLab(l, a, bb float64, max int) Pixel {
+	r, g, b := OKLabToRGB(l, a, bb)
+	return PixelFromNormalized(r, g, b, max)
+}
@@ -0,0 +1,71 @@
+package pixarray
+
+import (
+	"sync"
+)
+
+// Feed mirrors another LEDStrip, passing each frame written to it on to any number of watchers.
+// A watcher that falls behind misses frames, but always gets the latest one: watchers never hold
+// up the LEDs.
+type Feed struct {
+	LEDStrip
+	numPixels int
+
+	mu       sync.Mutex
+	frame    []Pixel
+	watchers map[chan []Pixel]bool
+}
+
+// NewFeed returns a Feed mirroring leds, which has numPixels pixels.
+func NewFeed(leds LEDStrip, numPixels int) *Feed {
+	f := make([]Pixel, numPixels)
+	for i := range f {
+		f[i] = leds.GetPixel(i)
+	}
+	return &Feed{LEDStrip: leds, numPixels: numPixels, frame: f, watchers: map[chan []Pixel]bool{}}
+}
+
+func (f *Feed) Write() error {
+	err := f.LEDStrip.Write()
+	fr := make([]Pixel, f.numPixels)
+	for i := range fr {
+		fr[i] = f.LEDStrip.GetPixel(i)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.frame = fr
+	for c := range f.watchers {
+		select {
+		case <-c:
+			// Not yet seen, and now out of date
+		default:
+		}
+		c <- fr
+	}
+	return err
+}
+
+// Frame returns the last frame written. It mustn't be modified.
+func (f *Feed) Frame() []Pixel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.frame
+}
+
+// Watch returns a channel on which frames are sent as they're written, starting with the last
+// frame written. The frames mustn't be modified.
+func (f *Feed) Watch() chan []Pixel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan []Pixel, 1)
+	c <- f.frame
+	f.watchers[c] = true
+	return c
+}
+
+// Unwatch stops frames being sent on c.
+func (f *Feed) Unwatch(c chan []Pixel) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.watchers, c)
+}
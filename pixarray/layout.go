@@ -0,0 +1,96 @@
+package pixarray
+
+import (
+	"fmt"
+	"math"
+)
+
+// A Layout describes how the pixels are arranged physically, for anything that shows them.
+type Layout struct {
+	// Shape is "linear" (a strip, shown wrapped into rows of Width), "matrix" (Width columns) or
+	// "ring" (a circle, clockwise from the top)
+	Shape string
+	// Width is the number of pixels per row
+	Width int
+	// Serpentine is for matrices wired back and forth, with every other row running right to left
+	Serpentine bool
+}
+
+// Validate checks that l makes sense.
+func (l Layout) Validate() error {
+	switch l.Shape {
+	case "linear", "matrix", "ring":
+	default:
+		return fmt.Errorf("shape '%s' isn't one of linear, matrix, ring", l.Shape)
+	}
+	if l.Width <= 0 {
+		return fmt.Errorf("width must be positive, not %d", l.Width)
+	}
+	return nil
+}
+
+// Rows returns how many rows numPixels take up.
+func (l Layout) Rows(numPixels int) int {
+	return (numPixels + l.Width - 1) / l.Width
+}
+
+// Position returns the row and column at which pixel i is shown, for displays that can only show
+// rows, like terminals. Rings are shown like linear strips.
+func (l Layout) Position(i int) (row, col int) {
+	row = i / l.Width
+	col = i % l.Width
+	if l.Shape == "matrix" && l.Serpentine && row%2 == 1 {
+		col = l.Width - 1 - col
+	}
+	return row, col
+}
+
+// Point returns where pixel i of numPixels is, in units of the distance between neighbouring
+// pixels, with the top left pixel's centre at 0.5,0.5.
+func (l Layout) Point(i, numPixels int) (x, y float64) {
+	if l.Shape != "ring" {
+		row, col := l.Position(i)
+		return float64(col) + 0.5, float64(row) + 0.5
+	}
+	r := l.radius(numPixels)
+	a := 2*math.Pi*float64(i)/float64(numPixels) - math.Pi/2
+	return r + 0.5 + r*math.Cos(a), r + 0.5 + r*math.Sin(a)
+}
+
+// Size returns the width and height that numPixels take up, in the same units as Point.
+func (l Layout) Size(numPixels int) (w, h float64) {
+	if l.Shape == "ring" {
+		d := 2*l.radius(numPixels) + 1
+		return d, d
+	}
+	w = float64(l.Width)
+	if numPixels < l.Width {
+		w = float64(numPixels)
+	}
+	return w, float64(l.Rows(numPixels))
+}
+
+// radius returns the radius of a ring of numPixels.
+func (l Layout) radius(numPixels int) float64 {
+	return math.Max(float64(numPixels)/(2*math.Pi), 0.5)
+}
+
+// To8Bit returns p as 8-bit RGB, where max is the value of a fully-lit channel. Any white is
+// added to all three channels.
+func (p *Pixel) To8Bit(max int) (r, g, b uint8) {
+	w := 0
+	if p.W > 0 {
+		w = p.W
+	}
+	c := func(v int) uint8 {
+		v = (v + w) * 255 / max
+		if v > 255 {
+			return 255
+		}
+		if v < 0 {
+			return 0
+		}
+		return uint8(v)
+	}
+	return c(p.R), c(p.G), c(p.B)
+}
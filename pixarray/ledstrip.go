@@ -10,4 +10,5 @@ type LEDStrip interface {
 	GetPixel(i int) Pixel
 	SetPixel(i int, p Pixel)
 	Write() error
+	Close() error
 }
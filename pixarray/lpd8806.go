@@ -3,6 +3,7 @@ package pixarray
 import (
 	"fmt"
 	rpi "github.com/Jon-Bright/ledctl/rpi"
+	"io"
 )
 
 type LPD8806 struct {
@@ -55,6 +56,19 @@ func (la *LPD8806) Write() error {
 	return err
 }
 
+// Close closes the SPI device (if it can be closed) and releases the RPi.
+func (la *LPD8806) Close() error {
+	var err error
+	if c, ok := la.dev.(io.Closer); ok {
+		err = c.Close()
+	}
+	te := la.rp.Close()
+	if err == nil {
+		err = te
+	}
+	return err
+}
+
 func (la *LPD8806) GetPixel(i int) Pixel {
 	if la.numColors == 4 {
 		return Pixel{
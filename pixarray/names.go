@@ -0,0 +1,277 @@
+package pixarray
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// cssColors holds the CSS named colours, as 8-bit RGB.
+var cssColors = map[string]uint32{
+	"aliceblue":            0xf0f8ff,
+	"antiquewhite":         0xfaebd7,
+	"aqua":                 0x00ffff,
+	"aquamarine":           0x7fffd4,
+	"azure":                0xf0ffff,
+	"beige":                0xf5f5dc,
+	"bisque":               0xffe4c4,
+	"black":                0x000000,
+	"blanchedalmond":       0xffebcd,
+	"blue":                 0x0000ff,
+	"blueviolet":           0x8a2be2,
+	"brown":                0xa52a2a,
+	"burlywood":            0xdeb887,
+	"cadetblue":            0x5f9ea0,
+	"chartreuse":           0x7fff00,
+	"chocolate":            0xd2691e,
+	"coral":                0xff7f50,
+	"cornflowerblue":       0x6495ed,
+	"cornsilk":             0xfff8dc,
+	"crimson":              0xdc143c,
+	"cyan":                 0x00ffff,
+	"darkblue":             0x00008b,
+	"darkcyan":             0x008b8b,
+	"darkgoldenrod":        0xb8860b,
+	"darkgray":             0xa9a9a9,
+	"darkgreen":            0x006400,
+	"darkgrey":             0xa9a9a9,
+	"darkkhaki":            0xbdb76b,
+	"darkmagenta":          0x8b008b,
+	"darkolivegreen":       0x556b2f,
+	"darkorange":           0xff8c00,
+	"darkorchid":           0x9932cc,
+	"darkred":              0x8b0000,
+	"darksalmon":           0xe9967a,
+	"darkseagreen":         0x8fbc8f,
+	"darkslateblue":        0x483d8b,
+	"darkslategray":        0x2f4f4f,
+	"darkslategrey":        0x2f4f4f,
+	"darkturquoise":        0x00ced1,
+	"darkviolet":           0x9400d3,
+	"deeppink":             0xff1493,
+	"deepskyblue":          0x00bfff,
+	"dimgray":              0x696969,
+	"dimgrey":              0x696969,
+	"dodgerblue":           0x1e90ff,
+	"firebrick":            0xb22222,
+	"floralwhite":          0xfffaf0,
+	"forestgreen":          0x228b22,
+	"fuchsia":              0xff00ff,
+	"gainsboro":            0xdcdcdc,
+	"ghostwhite":           0xf8f8ff,
+	"gold":                 0xffd700,
+	"goldenrod":            0xdaa520,
+	"gray":                 0x808080,
+	"green":                0x008000,
+	"greenyellow":          0xadff2f,
+	"grey":                 0x808080,
+	"honeydew":             0xf0fff0,
+	"hotpink":              0xff69b4,
+	"indianred":            0xcd5c5c,
+	"indigo":               0x4b0082,
+	"ivory":                0xfffff0,
+	"khaki":                0xf0e68c,
+	"lavender":             0xe6e6fa,
+	"lavenderblush":        0xfff0f5,
+	"lawngreen":            0x7cfc00,
+	"lemonchiffon":         0xfffacd,
+	"lightblue":            0xadd8e6,
+	"lightcoral":           0xf08080,
+	"lightcyan":            0xe0ffff,
+	"lightgoldenrodyellow": 0xfafad2,
+	"lightgray":            0xd3d3d3,
+	"lightgreen":           0x90ee90,
+	"lightgrey":            0xd3d3d3,
+	"lightpink":            0xffb6c1,
+	"lightsalmon":          0xffa07a,
+	"lightseagreen":        0x20b2aa,
+	"lightskyblue":         0x87cefa,
+	"lightslategray":       0x778899,
+	"lightslategrey":       0x778899,
+	"lightsteelblue":       0xb0c4de,
+	"lightyellow":          0xffffe0,
+	"lime":                 0x00ff00,
+	"limegreen":            0x32cd32,
+	"linen":                0xfaf0e6,
+	"magenta":              0xff00ff,
+	"maroon":               0x800000,
+	"mediumaquamarine":     0x66cdaa,
+	"mediumblue":           0x0000cd,
+	"mediumorchid":         0xba55d3,
+	"mediumpurple":         0x9370db,
+	"mediumseagreen":       0x3cb371,
+	"mediumslateblue":      0x7b68ee,
+	"mediumspringgreen":    0x00fa9a,
+	"mediumturquoise":      0x48d1cc,
+	"mediumvioletred":      0xc71585,
+	"midnightblue":         0x191970,
+	"mintcream":            0xf5fffa,
+	"mistyrose":            0xffe4e1,
+	"moccasin":             0xffe4b5,
+	"navajowhite":          0xffdead,
+	"navy":                 0x000080,
+	"oldlace":              0xfdf5e6,
+	"olive":                0x808000,
+	"olivedrab":            0x6b8e23,
+	"orange":               0xffa500,
+	"orangered":            0xff4500,
+	"orchid":               0xda70d6,
+	"palegoldenrod":        0xeee8aa,
+	"palegreen":            0x98fb98,
+	"paleturquoise":        0xafeeee,
+	"palevioletred":        0xdb7093,
+	"papayawhip":           0xffefd5,
+	"peachpuff":            0xffdab9,
+	"peru":                 0xcd853f,
+	"pink":                 0xffc0cb,
+	"plum":                 0xdda0dd,
+	"powderblue":           0xb0e0e6,
+	"purple":               0x800080,
+	"rebeccapurple":        0x663399,
+	"red":                  0xff0000,
+	"rosybrown":            0xbc8f8f,
+	"royalblue":            0x4169e1,
+	"saddlebrown":          0x8b4513,
+	"salmon":               0xfa8072,
+	"sandybrown":           0xf4a460,
+	"seagreen":             0x2e8b57,
+	"seashell":             0xfff5ee,
+	"sienna":               0xa0522d,
+	"silver":               0xc0c0c0,
+	"skyblue":              0x87ceeb,
+	"slateblue":            0x6a5acd,
+	"slategray":            0x708090,
+	"slategrey":            0x708090,
+	"snow":                 0xfffafa,
+	"springgreen":          0x00ff7f,
+	"steelblue":            0x4682b4,
+	"tan":                  0xd2b48c,
+	"teal":                 0x008080,
+	"thistle":              0xd8bfd8,
+	"tomato":               0xff6347,
+	"turquoise":            0x40e0d0,
+	"violet":               0xee82ee,
+	"wheat":                0xf5deb3,
+	"white":                0xffffff,
+	"whitesmoke":           0xf5f5f5,
+	"yellow":               0xffff00,
+	"yellowgreen":          0x9acd32,
+}
+
+// from8Bit scales an 8-bit channel to 0-max.
+func from8Bit(v uint32, max int) int {
+	return clampChannel(float64(v)/255.0, max)
+}
+
+// The range of colour temperatures kelvinToRGB covers.
+const (
+	minKelvin = 1000
+	maxKelvin = 40000
+)
+
+// kelvinToRGB returns the normalised RGB colour of a black body at the given temperature, using
+// Tanner Helland's approximation.
+func kelvinToRGB(k float64) (r, g, b float64) {
+	t := k / 100.0
+	if t <= 66.0 {
+		r = 255.0
+		g = 99.4708025861*math.Log(t) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(t-60.0, -0.1332047592)
+		g = 288.1221695283 * math.Pow(t-60.0, -0.0755148492)
+	}
+	switch {
+	case t >= 66.0:
+		b = 255.0
+	case t <= 19.0:
+		b = 0.0
+	default:
+		b = 138.5177312231*math.Log(t-10.0) - 305.0447927307
+	}
+	return r / 255.0, g / 255.0, b / 255.0
+}
+
+// ParseColor parses a colour given in a form that means the same whatever the LEDs' channel
+// depth, returning it scaled so that a fully-lit channel is max:
+//
+//   - a CSS colour name, e.g. "orange"
+//   - "#rrggbb", 8-bit RGB, or "#rrggbbww" with white
+//   - "rgbw(r,g,b,w)", 8-bit RGB and white
+//   - "hsv(h,s,v)", with hue in degrees and saturation and value from 0.0 to 1.0
+//   - a colour temperature from 1000K to 40000K, e.g. "2700K" for warm white, at full brightness
+//
+// Like the rest of this package, it doesn't apply any gamma: "#808080" is half of each channel's
+// maximum. W is 0 unless white was given.
+func ParseColor(s string, max int) (Pixel, error) {
+	ls := strings.ToLower(s)
+	if v, ok := cssColors[ls]; ok {
+		return Pixel{R: from8Bit(v>>16, max), G: from8Bit((v>>8)&0xff, max), B: from8Bit(v&0xff, max), W: 0}, nil
+	}
+	switch {
+	case strings.HasPrefix(ls, "#"):
+		if len(ls) != 7 && len(ls) != 9 {
+			return Pixel{}, fmt.Errorf("'%s' isn't #rrggbb or #rrggbbww", s)
+		}
+		v, err := strconv.ParseUint(ls[1:], 16, 32)
+		if err != nil {
+			return Pixel{}, fmt.Errorf("'%s' isn't #rrggbb or #rrggbbww", s)
+		}
+		w := uint32(0)
+		if len(ls) == 9 {
+			w = uint32(v) & 0xff
+			v >>= 8
+		}
+		return Pixel{R: from8Bit(uint32(v)>>16, max), G: from8Bit(uint32(v>>8)&0xff, max), B: from8Bit(uint32(v)&0xff, max), W: from8Bit(w, max)}, nil
+	case strings.HasPrefix(ls, "rgbw(") && strings.HasSuffix(ls, ")"):
+		f, err := parseFloats(ls[5:len(ls)-1], 4)
+		if err != nil {
+			return Pixel{}, fmt.Errorf("'%s' isn't rgbw(r,g,b,w): %v", s, err)
+		}
+		var c [4]uint32
+		for i, v := range f {
+			if v < 0 || v > 255 || v != math.Trunc(v) {
+				return Pixel{}, fmt.Errorf("'%s' needs whole numbers from 0 to 255", s)
+			}
+			c[i] = uint32(v)
+		}
+		return Pixel{R: from8Bit(c[0], max), G: from8Bit(c[1], max), B: from8Bit(c[2], max), W: from8Bit(c[3], max)}, nil
+	case strings.HasSuffix(ls, "k"):
+		k, err := strconv.ParseFloat(ls[:len(ls)-1], 64)
+		if err != nil {
+			return Pixel{}, fmt.Errorf("unknown colour '%s'", s)
+		}
+		if k < minKelvin || k > maxKelvin {
+			return Pixel{}, fmt.Errorf("colour temperature '%s' must be from %dK to %dK", s, minKelvin, maxKelvin)
+		}
+		r, g, b := kelvinToRGB(k)
+		return PixelFromNormalized(r, g, b, max), nil
+	case strings.HasPrefix(ls, "hsv(") && strings.HasSuffix(ls, ")"):
+		f, err := parseFloats(ls[4:len(ls)-1], 3)
+		if err != nil {
+			return Pixel{}, fmt.Errorf("'%s' isn't hsv(h,s,v): %v", s, err)
+		}
+		if f[1] < 0.0 || f[1] > 1.0 || f[2] < 0.0 || f[2] > 1.0 {
+			return Pixel{}, fmt.Errorf("'%s' needs saturation and value from 0.0 to 1.0", s)
+		}
+		return PixelFromHSV(f[0], f[1], f[2], max), nil
+	}
+	return Pixel{}, fmt.Errorf("unknown colour '%s'", s)
+}
+
+// parseFloats parses n comma-separated numbers.
+func parseFloats(s string, n int) ([]float64, error) {
+	t := strings.Split(s, ",")
+	if len(t) != n {
+		return nil, fmt.Errorf("want %d numbers, got %d", n, len(t))
+	}
+	f := make([]float64, n)
+	for i, v := range t {
+		var err error
+		f[i], err = strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
@@ -2,7 +2,10 @@ package pixarray
 
 import (
 	"fmt"
+	clock "github.com/Jon-Bright/ledctl/clock"
 	rpi "github.com/Jon-Bright/ledctl/rpi"
+	"math"
+	"sync"
 )
 
 const (
@@ -63,10 +66,17 @@ type PixArray struct {
 	numPixels int
 	numColors int
 	leds      LEDStrip
+	recMu     sync.Mutex
+	rec       *Recorder
+	recClock  clock.Clock
+	// corrMu protects corr, and stops the pixels being read while the LEDs hold corrected ones
+	corrMu sync.Mutex
+	corr   []int
+	orig   []Pixel
 }
 
 func NewPixArray(numPixels int, numColors int, leds LEDStrip) *PixArray {
-	return &PixArray{numPixels, numColors, leds}
+	return &PixArray{numPixels: numPixels, numColors: numColors, leds: leds}
 }
 
 func (pa *PixArray) NumPixels() int {
@@ -86,10 +96,84 @@ func (pa *PixArray) MaxPerChannel() int {
 }
 
 func (pa *PixArray) Write() error {
-	return pa.leds.Write()
+	err := pa.write()
+	pa.recMu.Lock()
+	defer pa.recMu.Unlock()
+	if pa.rec != nil {
+		pa.rec.Frame(pa.recClock.Now(), pa.GetPixels()) // Ignore error, Recorder keeps it for Flush
+	}
+	return err
+}
+
+// write sends the pixels to the LEDs, corrected as given to SetCorrection. The corrected pixels are
+// only set for the write, the LEDs hold the uncorrected ones again afterwards.
+func (pa *PixArray) write() error {
+	pa.corrMu.Lock()
+	defer pa.corrMu.Unlock()
+	if pa.corr == nil {
+		return pa.leds.Write()
+	}
+	for i := range pa.orig {
+		p := pa.leds.GetPixel(i)
+		pa.orig[i] = p
+		pa.leds.SetPixel(i, Pixel{pa.correct(p.R), pa.correct(p.G), pa.correct(p.B), pa.correct(p.W)})
+	}
+	err := pa.leds.Write()
+	for i, p := range pa.orig {
+		pa.leds.SetPixel(i, p)
+	}
+	return err
+}
+
+// correct returns the value sent to the LEDs for a channel set to v. A W of -1 (no white channel)
+// stays as it is.
+func (pa *PixArray) correct(v int) int {
+	switch {
+	case v < 0:
+		return v
+	case v >= len(pa.corr):
+		return pa.corr[len(pa.corr)-1]
+	}
+	return pa.corr[v]
+}
+
+// SetCorrection makes every frame be sent to the LEDs with each channel limited to brightness (0
+// to 1) of its maximum, and gamma corrected: a channel set to v of max is sent as
+// max*brightness*(v/max)^gamma. A brightness and gamma of 1 send the pixels exactly as set. Either
+// way, GetPixel and GetPixels return the pixels as set, and frames are recorded as set.
+func (pa *PixArray) SetCorrection(brightness, gamma float64) {
+	pa.corrMu.Lock()
+	defer pa.corrMu.Unlock()
+	if brightness == 1 && gamma == 1 {
+		pa.corr = nil
+		return
+	}
+	max := pa.leds.MaxPerChannel()
+	pa.corr = make([]int, max+1)
+	for v := range pa.corr {
+		pa.corr[v] = int(math.Round(float64(max) * brightness * math.Pow(float64(v)/float64(max), gamma)))
+	}
+	pa.orig = make([]Pixel, pa.numPixels)
+}
+
+// Record makes every frame written from now on be recorded by r, with the time on clk when it was
+// written, replacing any previous Recorder. nil stops recording. It's safe to call while another
+// goroutine is writing.
+func (pa *PixArray) Record(r *Recorder, clk clock.Clock) {
+	pa.recMu.Lock()
+	defer pa.recMu.Unlock()
+	pa.rec, pa.recClock = r, clk
+}
+
+// Close stops output to the LEDs and frees any hardware resources they hold. The PixArray can't
+// be written afterwards.
+func (pa *PixArray) Close() error {
+	return pa.leds.Close()
 }
 
 func (pa *PixArray) GetPixels() []Pixel {
+	pa.corrMu.Lock()
+	defer pa.corrMu.Unlock()
 	p := make([]Pixel, pa.numPixels)
 	for i := 0; i < pa.numPixels; i++ {
 		p[i] = pa.leds.GetPixel(i)
@@ -98,6 +182,8 @@ func (pa *PixArray) GetPixels() []Pixel {
 }
 
 func (pa *PixArray) GetPixel(i int) Pixel {
+	pa.corrMu.Lock()
+	defer pa.corrMu.Unlock()
 	return pa.leds.GetPixel(i)
 }
 
@@ -1,11 +1,22 @@
 package pixarray
 
 import (
+	"bytes"
+	clock "github.com/Jon-Bright/ledctl/clock"
+	rpi "github.com/Jon-Bright/ledctl/rpi"
+	"math"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testLeds struct {
 	pixels []Pixel
+	closed bool
+}
+
+func (l *testLeds) RPi() *rpi.RPi {
+	return nil
 }
 
 func (l *testLeds) GetPixel(i int) Pixel {
@@ -20,12 +31,17 @@ func (l *testLeds) Write() error {
 	return nil
 }
 
+func (l *testLeds) Close() error {
+	l.closed = true
+	return nil
+}
+
 func (l *testLeds) MaxPerChannel() int {
 	return 160
 }
 
 func newTestLeds(numPixels int) LEDStrip {
-	return &testLeds{make([]Pixel, numPixels)}
+	return &testLeds{pixels: make([]Pixel, numPixels)}
 }
 
 func TestSetOneThenGetOneByOne(t *testing.T) {
@@ -269,3 +285,409 @@ func BenchmarkSetPerChanAlternate(b *testing.B) {
 		pa.SetPerChanAlternate(s2, 7, p1, p2)
 	}
 }
+
+func TestColorRoundTrips(t *testing.T) {
+	pixels := []Pixel{
+		{R: 0, G: 0, B: 0, W: 0},
+		{R: 255, G: 255, B: 255, W: 0},
+		{R: 255, G: 0, B: 0, W: 0},
+		{R: 12, G: 200, B: 97, W: 0},
+		{R: 1, G: 2, B: 3, W: 0},
+		{R: 128, G: 128, B: 0, W: 0},
+	}
+
+	for _, p := range pixels {
+		h, s, v := p.ToHSV(255)
+		if got := PixelFromHSV(h, s, v, 255); got != p {
+			t.Errorf("HSV round trip, got: %v, want %v", got, p)
+		}
+		h, s, l := p.ToHSL(255)
+		if got := PixelFromHSL(h, s, l, 255); got != p {
+			t.Errorf("HSL round trip, got: %v, want %v", got, p)
+		}
+		l, a, b := p.ToLab(255)
+		if got := PixelFromLab(l, a, b, 255); got != p {
+			t.Errorf("Lab round trip, got: %v, want %v", got, p)
+		}
+		l, a, b = p.ToOKLab(255)
+		if got := PixelFromOKLab(l, a, b, 255); got != p {
+			t.Errorf("OKLab round trip, got: %v, want %v", got, p)
+		}
+	}
+}
+
+func TestColorConversions(t *testing.T) {
+	tests := []struct {
+		p       Pixel
+		h, s, v float64
+		l       float64 // HSL lightness
+		labL    float64
+		okL     float64
+	}{
+		{Pixel{R: 127, G: 0, B: 0, W: 0}, 0, 1, 1, 0.5, 53.2408, 0.627955},
+		{Pixel{R: 0, G: 127, B: 0, W: 0}, 120, 1, 1, 0.5, 87.7347, 0.866440},
+		{Pixel{R: 127, G: 127, B: 127, W: 0}, 0, 0, 1, 1, 100, 1},
+		{Pixel{R: 0, G: 127, B: 127, W: 0}, 180, 1, 1, 0.5, 91.1132, 0.905399},
+	}
+
+	for _, test := range tests {
+		h, s, v := test.p.ToHSV(127)
+		if math.Abs(h-test.h) > 0.001 || math.Abs(s-test.s) > 0.001 || math.Abs(v-test.v) > 0.001 {
+			t.Errorf("%v ToHSV, got: %f,%f,%f, want %f,%f,%f", test.p, h, s, v, test.h, test.s, test.v)
+		}
+		if _, _, l := test.p.ToHSL(127); math.Abs(l-test.l) > 0.001 {
+			t.Errorf("%v ToHSL lightness, got: %f, want %f", test.p, l, test.l)
+		}
+		if l, _, _ := test.p.ToLab(127); math.Abs(l-test.labL) > 0.001 {
+			t.Errorf("%v ToLab lightness, got: %f, want %f", test.p, l, test.labL)
+		}
+		if l, _, _ := test.p.ToOKLab(127); math.Abs(l-test.okL) > 0.001 {
+			t.Errorf("%v ToOKLab lightness, got: %f, want %f", test.p, l, test.okL)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	leds := &testLeds{pixels: make([]Pixel, 10)}
+	pa := NewPixArray(10, 3, leds)
+	err := pa.Close()
+	if err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if !leds.closed {
+		t.Errorf("Close didn't close the LEDs")
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want Pixel
+		ok   bool
+	}{
+		{"red", 255, Pixel{R: 255, G: 0, B: 0, W: 0}, true},
+		{"Orange", 127, Pixel{R: 127, G: 82, B: 0, W: 0}, true},
+		{"#808080", 255, Pixel{R: 128, G: 128, B: 128, W: 0}, true},
+		{"#ff0000", 127, Pixel{R: 127, G: 0, B: 0, W: 0}, true},
+		{"hsv(120,1,1)", 127, Pixel{R: 0, G: 127, B: 0, W: 0}, true},
+		{"hsv(0, 0, 0.5)", 255, Pixel{R: 128, G: 128, B: 128, W: 0}, true},
+		{"#ff000080", 255, Pixel{R: 255, G: 0, B: 0, W: 128}, true},
+		{"rgbw(0,0,0,255)", 127, Pixel{R: 0, G: 0, B: 0, W: 127}, true},
+		{"rgbw(0,0,0,256)", 127, Pixel{}, false},
+		{"6600K", 255, Pixel{R: 255, G: 255, B: 255, W: 0}, true},
+		{"2700k", 255, Pixel{R: 255, G: 167, B: 87, W: 0}, true},
+		{"1000K", 127, Pixel{R: 127, G: 34, B: 0, W: 0}, true},
+		{"500K", 255, Pixel{}, false},
+		{"hsv(0,2,1)", 255, Pixel{}, false},
+		{"#ff00", 255, Pixel{}, false},
+		{"#gg0000", 255, Pixel{}, false},
+		{"ff0000", 255, Pixel{}, false},
+		{"notacolour", 255, Pixel{}, false},
+	}
+	for _, tc := range tests {
+		got, err := ParseColor(tc.in, tc.max)
+		if (err == nil) != tc.ok {
+			t.Errorf("Wrong error for '%s', got: %v, want ok: %v", tc.in, err, tc.ok)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Wrong colour for '%s', got: %v, want: %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSim(t *testing.T) {
+	sm := NewSim(3, 3)
+	sm.SetPixel(1, Pixel{R: 1, G: 2, B: 300, W: 4})
+	if got, want := sm.GetPixel(1), (Pixel{R: 1, G: 2, B: 44, W: -1}); got != want {
+		t.Errorf("Wrong pixel, got: %v, want: %v", got, want)
+	}
+	f, n := sm.Frame()
+	if n != 0 || f[1] != (Pixel{R: 0, G: 0, B: 0, W: -1}) {
+		t.Errorf("Frame changed before Write: %v, %d writes", f, n)
+	}
+	sm.Write()
+	f, n = sm.Frame()
+	if n != 1 || f[1] != sm.GetPixel(1) {
+		t.Errorf("Frame not updated by Write: %v, %d writes", f, n)
+	}
+}
+
+func TestLayout(t *testing.T) {
+	tests := []struct {
+		l        Layout
+		i        int
+		row, col int
+	}{
+		{Layout{"linear", 4, false}, 5, 1, 1},
+		{Layout{"linear", 4, true}, 5, 1, 1}, // Serpentine only matters for matrices
+		{Layout{"matrix", 4, false}, 5, 1, 1},
+		{Layout{"matrix", 4, true}, 5, 1, 2},
+		{Layout{"matrix", 4, true}, 8, 2, 0},
+	}
+	for _, tc := range tests {
+		row, col := tc.l.Position(tc.i)
+		if row != tc.row || col != tc.col {
+			t.Errorf("Wrong position for %d in %v, got: %d,%d, want: %d,%d", tc.i, tc.l, row, col, tc.row, tc.col)
+		}
+	}
+	if got := (Layout{"matrix", 4, false}).Rows(9); got != 3 {
+		t.Errorf("Wrong rows, got: %d, want: 3", got)
+	}
+	if err := (Layout{"spiral", 4, false}).Validate(); err == nil {
+		t.Errorf("Unknown shape validated")
+	}
+	if err := (Layout{"linear", 0, false}).Validate(); err == nil {
+		t.Errorf("Zero width validated")
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	var out bytes.Buffer
+	sm := NewSim(3, 3)
+	tm := NewTerminal(sm, 3, &out, Layout{"linear", 2, false}, 0)
+	tm.SetPixel(0, Pixel{R: 255, G: 0, B: 0, W: -1})
+	tm.SetPixel(2, Pixel{R: 0, G: 0, B: 128, W: -1})
+	tm.Write()
+	want := "\x1b[38;2;255;0;0m██\x1b[38;2;0;0;0m██\x1b[0m\n\x1b[38;2;0;0;128m██  \x1b[0m\n"
+	if got := out.String(); got != want {
+		t.Errorf("Wrong first frame, got: %q, want: %q", got, want)
+	}
+	if _, n := sm.Frame(); n != 1 {
+		t.Errorf("Underlying strip not written, %d writes", n)
+	}
+	out.Reset()
+	tm.Write()
+	if got := out.String(); !strings.HasPrefix(got, "\x1b[2A\r") {
+		t.Errorf("Second frame doesn't overwrite the first: %q", got)
+	}
+}
+
+func TestLayoutRing(t *testing.T) {
+	l := Layout{"ring", 1, false}
+	w, h := l.Size(8)
+	x, y := l.Point(0, 8)
+	if math.Abs(x-w/2) > 1e-9 || math.Abs(y-0.5) > 1e-9 {
+		t.Errorf("First pixel not at the top middle: %f,%f in %fx%f", x, y, w, h)
+	}
+	x, y = l.Point(2, 8)
+	if math.Abs(x-(w-0.5)) > 1e-9 || math.Abs(y-h/2) > 1e-9 {
+		t.Errorf("Quarter way round not at the right middle: %f,%f in %fx%f", x, y, w, h)
+	}
+	// Neighbouring pixels are about one unit apart
+	x1, y1 := l.Point(1, 8)
+	x0, y0 := l.Point(0, 8)
+	if d := math.Hypot(x1-x0, y1-y0); d < 0.9 || d > 1.1 {
+		t.Errorf("Wrong distance between neighbours: %f", d)
+	}
+}
+
+func TestFeed(t *testing.T) {
+	sm := NewSim(2, 3)
+	f := NewFeed(sm, 2)
+	c := f.Watch()
+	if fr := <-c; fr[0] != (Pixel{R: 0, G: 0, B: 0, W: -1}) {
+		t.Errorf("Wrong first frame: %v", fr)
+	}
+	f.SetPixel(0, Pixel{R: 1, G: 2, B: 3, W: -1})
+	f.Write()
+	f.SetPixel(0, Pixel{R: 4, G: 5, B: 6, W: -1})
+	f.Write() // Replaces the frame not yet received
+	if fr := <-c; fr[0] != (Pixel{R: 4, G: 5, B: 6, W: -1}) {
+		t.Errorf("Wrong latest frame: %v", fr)
+	}
+	if _, n := sm.Frame(); n != 2 {
+		t.Errorf("Underlying strip not written, %d writes", n)
+	}
+	f.Unwatch(c)
+	f.Write()
+	select {
+	case fr := <-c:
+		t.Errorf("Frame sent after Unwatch: %v", fr)
+	default:
+	}
+	if fr := f.Frame(); fr[0] != (Pixel{R: 4, G: 5, B: 6, W: -1}) {
+		t.Errorf("Wrong last frame: %v", fr)
+	}
+}
+
+func TestCorrection(t *testing.T) {
+	sm := NewSim(3, 3)
+	pa := NewPixArray(3, 3, sm)
+	set := []Pixel{{255, 128, 0, -1}, {64, 192, 255, -1}, {0, 0, 0, -1}}
+	for i, p := range set {
+		pa.SetOne(i, p)
+	}
+	pa.SetCorrection(0.5, 2)
+	pa.Write()
+	fr, _ := sm.Frame()
+	want := []Pixel{{128, 32, 0, -1}, {8, 72, 128, -1}, {0, 0, 0, -1}}
+	for i := range want {
+		if fr[i] != want[i] {
+			t.Errorf("Wrong pixel %d sent, got: %v, want: %v", i, fr[i], want[i])
+		}
+		if got := pa.GetPixel(i); got != set[i] {
+			t.Errorf("Pixel %d changed by writing, got: %v, want: %v", i, got, set[i])
+		}
+	}
+	pa.SetCorrection(1, 1)
+	pa.Write()
+	fr, _ = sm.Frame()
+	if fr[1] != set[1] {
+		t.Errorf("Pixel corrected after correction removed, got: %v, want: %v", fr[1], set[1])
+	}
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	for _, nc := range []int{3, 4} {
+		var b bytes.Buffer
+		r, err := NewRecorder(&b, 3, nc, 127)
+		if err != nil {
+			t.Fatalf("Couldn't start recording: %v", err)
+		}
+		w := 0
+		if nc == 3 {
+			w = -1
+		}
+		frames := []Frame{
+			{0, []Pixel{{0, 0, 0, w}, {0, 0, 0, w}, {0, 0, 0, w}}},
+			{20 * time.Millisecond, []Pixel{{1, 2, 3, w}, {0, 0, 0, w}, {127, 0, 5, w}}},
+			{25 * time.Millisecond, []Pixel{{1, 2, 3, w}, {0, 0, 0, w}, {127, 0, 5, w}}},
+			{40 * time.Millisecond, []Pixel{{1, 2, 4, w}, {9, 9, 9, w}, {127, 0, 5, w}}},
+		}
+		start := time.Now()
+		size := 0
+		for i, f := range frames {
+			err = r.Frame(start.Add(f.At), f.Pixels)
+			if err != nil {
+				t.Fatalf("Couldn't record frame %d: %v", i, err)
+			}
+			r.Flush()
+			// An unchanged frame is just the time and one run
+			if i == 2 && b.Len()-size > 4 {
+				t.Errorf("Unchanged frame took %d bytes", b.Len()-size)
+			}
+			size = b.Len()
+		}
+		rc, err := ReadRecording(&b)
+		if err != nil {
+			t.Fatalf("Couldn't read recording: %v", err)
+		}
+		if rc.NumPixels != 3 || rc.NumColors != nc || rc.MaxPerChannel != 127 || len(rc.Frames) != len(frames) {
+			t.Fatalf("Wrong recording: %+v", rc)
+		}
+		for i, f := range frames {
+			got := rc.Frames[i]
+			if got.At != f.At {
+				t.Errorf("Wrong time for frame %d, got: %v, want: %v", i, got.At, f.At)
+			}
+			for j := range f.Pixels {
+				if got.Pixels[j] != f.Pixels[j] {
+					t.Errorf("Wrong pixel %d in frame %d, got: %v, want: %v", j, i, got.Pixels[j], f.Pixels[j])
+				}
+			}
+		}
+		if rc.Duration() != 40*time.Millisecond {
+			t.Errorf("Wrong duration: %v", rc.Duration())
+		}
+	}
+}
+
+func TestReadBadRecording(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"LEDX\x01\x03\x03\x7f",
+		"LEDR\x02\x03\x03\x7f",
+		"LEDR\x01\x03\x05\x7f",
+		"LEDR\x01\x03\x03\x7f\x00\x02\x02\x01\x02\x03", // Truncated pixel
+		"LEDR\x01\x03\x03\x7f\x00\x04\x00",             // Skips too many
+		"LEDR\x01\x03\x03\x7f\x00\x01\x00",             // Ends early
+	} {
+		if _, err := ReadRecording(strings.NewReader(s)); err == nil {
+			t.Errorf("Read bad recording %q", s)
+		}
+	}
+}
+
+func TestPixArrayRecord(t *testing.T) {
+	leds := &testLeds{pixels: make([]Pixel, 2)}
+	pa := NewPixArray(2, 3, leds)
+	var b bytes.Buffer
+	r, _ := NewRecorder(&b, 2, 3, pa.MaxPerChannel())
+	fc := clock.NewFake(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	pa.Write() // Not recorded
+	pa.Record(r, fc)
+	pa.SetAll(Pixel{R: 1, G: 2, B: 3, W: -1})
+	pa.Write()
+	fc.Advance(40 * time.Millisecond)
+	pa.Write()
+	pa.Record(nil, nil)
+	pa.Write() // Not recorded
+	r.Flush()
+	rc, err := ReadRecording(&b)
+	if err != nil {
+		t.Fatalf("Couldn't read recording: %v", err)
+	}
+	if len(rc.Frames) != 2 || rc.Frames[1].At != 40*time.Millisecond || rc.Frames[1].Pixels[1] != (Pixel{R: 1, G: 2, B: 3, W: -1}) {
+		t.Errorf("Wrong frames recorded: %+v", rc.Frames)
+	}
+}
+
+// testDev is an SPI device that keeps what's written to it.
+type testDev struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (d *testDev) Fd() uintptr {
+	return 0
+}
+
+func (d *testDev) Close() error {
+	d.closed = true
+	return nil
+}
+
+func TestWS281xSPI(t *testing.T) {
+	reset3 := strings.Repeat("\x00", 17) // 55us at 2.4MHz is 132 bits
+	reset4 := strings.Repeat("\x00", 22) // 55us at 3.2MHz is 176 bits
+	tests := []struct {
+		bits int
+		want string
+	}{
+		// G 00: 100 x8, R ff: 110 x8, B 81: 110 100 x6 110
+		{3, "\x92\x49\x24" + "\xdb\x6d\xb6" + "\xd2\x49\x26" + reset3},
+		// G 00: 1000 x8, R ff: 1110 x8, B 81: 1110 1000 x6 1110
+		{4, "\x88\x88\x88\x88" + "\xee\xee\xee\xee" + "\xe8\x88\x88\x8e" + reset4},
+	}
+	for _, tc := range tests {
+		dev := &testDev{}
+		ws, err := newWS281xSPI(dev, 1, 3, GRB, 800000, tc.bits)
+		if err != nil {
+			t.Fatalf("%d bits: couldn't create: %v", tc.bits, err)
+		}
+		p := Pixel{R: 0xff, G: 0, B: 0x81, W: -1}
+		ws.SetPixel(0, p)
+		if got := ws.GetPixel(0); got != p {
+			t.Errorf("%d bits: wrong pixel, got: %v, want: %v", tc.bits, got, p)
+		}
+		// The second write shouldn't be affected by the first
+		ws.SetPixel(0, Pixel{R: 0xff, G: 0xff, B: 0xff, W: -1})
+		ws.Write()
+		dev.Reset()
+		ws.SetPixel(0, p)
+		if err := ws.Write(); err != nil {
+			t.Errorf("%d bits: couldn't write: %v", tc.bits, err)
+		}
+		if got := dev.String(); got != tc.want {
+			t.Errorf("%d bits: wrong bytes sent, got: %x, want: %x", tc.bits, got, tc.want)
+		}
+		if err := ws.Close(); err != nil || !dev.closed {
+			t.Errorf("%d bits: not closed: %v", tc.bits, err)
+		}
+	}
+	if _, err := newWS281xSPI(&testDev{}, 1, 3, GRB, 800000, 5); err == nil {
+		t.Errorf("5 bits per bit accepted")
+	}
+}
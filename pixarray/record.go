@@ -0,0 +1,226 @@
+package pixarray
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Recordings start with recordingMagic and a version byte, then the number of pixels (uvarint),
+// the number of colours (a byte, 3 or 4) and the maximum value per channel (uvarint). Each frame
+// is then the time since the previous frame, in microseconds (uvarint; the first frame's is 0),
+// followed by the pixels that changed since the previous frame, as runs: the number of unchanged
+// pixels to skip and the number of changed pixels that follow (both uvarints), then the changed
+// pixels, one byte per channel. A frame ends once its runs reach the last pixel. Before the first
+// frame, all pixels are black, and an unchanged frame is only a few bytes.
+const (
+	recordingMagic   = "LEDR"
+	recordingVersion = 1
+	// More than any real strip, to stop a bad file using up all the memory
+	maxRecordingPixels = 1 << 16
+)
+
+// A Frame is one frame of a recording, written At after the first.
+type Frame struct {
+	At     time.Duration
+	Pixels []Pixel
+}
+
+// A Recording is every frame written to a strip over some time.
+type Recording struct {
+	NumPixels     int
+	NumColors     int
+	MaxPerChannel int
+	Frames        []Frame
+}
+
+// Duration returns how long the recording lasts, from the first frame to the last.
+func (rc *Recording) Duration() time.Duration {
+	if len(rc.Frames) == 0 {
+		return 0
+	}
+	return rc.Frames[len(rc.Frames)-1].At
+}
+
+// A Recorder writes frames to a recording. Once writing fails, nothing further is written, and
+// every call returns the same error.
+type Recorder struct {
+	w         *bufio.Writer
+	numColors int
+	last      []Pixel
+	lastAt    time.Time
+	err       error
+}
+
+// NewRecorder starts a recording of numPixels pixels with numColors colours, each up to max, on
+// w.
+func NewRecorder(w io.Writer, numPixels, numColors, max int) (*Recorder, error) {
+	r := &Recorder{w: bufio.NewWriter(w), numColors: numColors, last: blackFrame(numPixels, numColors)}
+	r.w.WriteString(recordingMagic)
+	r.w.WriteByte(recordingVersion)
+	r.uvarint(numPixels)
+	r.w.WriteByte(byte(numColors))
+	r.uvarint(max)
+	r.err = r.w.Flush()
+	return r, r.err
+}
+
+func (r *Recorder) uvarint(v int) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], uint64(v))
+	r.w.Write(b[:n])
+}
+
+// Frame records the frame p, written at t.
+func (r *Recorder) Frame(t time.Time, p []Pixel) error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(p) != len(r.last) {
+		return fmt.Errorf("frame has %d pixels, recording has %d", len(p), len(r.last))
+	}
+	if r.lastAt.IsZero() {
+		r.uvarint(0)
+	} else {
+		r.uvarint(int(t.Sub(r.lastAt) / time.Microsecond))
+	}
+	r.lastAt = t
+	for i := 0; i < len(p); {
+		skip := 0
+		for i+skip < len(p) && r.same(p[i+skip], r.last[i+skip]) {
+			skip++
+		}
+		n := 0
+		for i+skip+n < len(p) && !r.same(p[i+skip+n], r.last[i+skip+n]) {
+			n++
+		}
+		r.uvarint(skip)
+		r.uvarint(n)
+		for _, px := range p[i+skip : i+skip+n] {
+			r.w.WriteByte(channelByte(px.R))
+			r.w.WriteByte(channelByte(px.G))
+			r.w.WriteByte(channelByte(px.B))
+			if r.numColors == 4 {
+				r.w.WriteByte(channelByte(px.W))
+			}
+		}
+		i += skip + n
+	}
+	copy(r.last, p)
+	return nil
+}
+
+// same returns whether a and b are recorded the same.
+func (r *Recorder) same(a, b Pixel) bool {
+	return a.R == b.R && a.G == b.G && a.B == b.B && (r.numColors < 4 || a.W == b.W)
+}
+
+// Flush writes any buffered frames.
+func (r *Recorder) Flush() error {
+	if r.err != nil {
+		return r.err
+	}
+	r.err = r.w.Flush()
+	return r.err
+}
+
+// blackFrame returns numPixels black pixels, with W -1 if there's no white.
+func blackFrame(numPixels, numColors int) []Pixel {
+	f := make([]Pixel, numPixels)
+	if numColors < 4 {
+		for i := range f {
+			f[i].W = -1
+		}
+	}
+	return f
+}
+
+func channelByte(v int) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+// ReadRecording reads a whole recording.
+func ReadRecording(r io.Reader) (*Recording, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(recordingMagic)+1)
+	_, err := io.ReadFull(br, magic)
+	if err != nil || string(magic[:len(recordingMagic)]) != recordingMagic {
+		return nil, fmt.Errorf("not a recording")
+	}
+	if magic[len(recordingMagic)] != recordingVersion {
+		return nil, fmt.Errorf("unsupported recording version %d", magic[len(recordingMagic)])
+	}
+	np, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("truncated header: %v", err)
+	}
+	nc, err := br.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("truncated header: %v", err)
+	}
+	max, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("truncated header: %v", err)
+	}
+	if np > maxRecordingPixels {
+		return nil, fmt.Errorf("recording has %d pixels, at most %d are supported", np, maxRecordingPixels)
+	}
+	rc := Recording{NumPixels: int(np), NumColors: int(nc), MaxPerChannel: int(max)}
+	if rc.NumColors != 3 && rc.NumColors != 4 {
+		return nil, fmt.Errorf("recording has %d colours, want 3 or 4", rc.NumColors)
+	}
+	if rc.MaxPerChannel < 1 || rc.MaxPerChannel > 255 {
+		return nil, fmt.Errorf("recording's channels go up to %d, want 1 to 255", rc.MaxPerChannel)
+	}
+	last := blackFrame(rc.NumPixels, rc.NumColors)
+	var at time.Duration
+	px := make([]byte, rc.NumColors)
+	for {
+		dt, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return &rc, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", len(rc.Frames), err)
+		}
+		at += time.Duration(dt) * time.Microsecond
+		f := Frame{At: at, Pixels: make([]Pixel, rc.NumPixels)}
+		copy(f.Pixels, last)
+		for i := 0; i < rc.NumPixels; {
+			skip, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, fmt.Errorf("frame %d: %v", len(rc.Frames), err)
+			}
+			n, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, fmt.Errorf("frame %d: %v", len(rc.Frames), err)
+			}
+			left := uint64(rc.NumPixels - i)
+			if skip > left || n > left-skip || (n == 0 && skip != left) {
+				return nil, fmt.Errorf("frame %d: bad run of %d after skipping %d from pixel %d", len(rc.Frames), n, skip, i)
+			}
+			i += int(skip)
+			for ; n > 0; n-- {
+				_, err = io.ReadFull(br, px)
+				if err != nil {
+					return nil, fmt.Errorf("frame %d: %v", len(rc.Frames), err)
+				}
+				f.Pixels[i] = Pixel{R: int(px[0]), G: int(px[1]), B: int(px[2]), W: -1}
+				if rc.NumColors == 4 {
+					f.Pixels[i].W = int(px[3])
+				}
+				i++
+			}
+		}
+		rc.Frames = append(rc.Frames, f)
+		last = f.Pixels
+	}
+}
@@ -0,0 +1,75 @@
+package pixarray
+
+import (
+	rpi "github.com/Jon-Bright/ledctl/rpi"
+	"sync"
+)
+
+// Sim is an LEDStrip that only exists in memory, so that everything else can be run and tested
+// without a Raspberry Pi. It behaves like a WS281x: channels go up to 255. It has no RPi, so
+// anything needing one (like power control) has to do without.
+type Sim struct {
+	numColors int
+	pixels    []Pixel
+	mu        sync.Mutex
+	frame     []Pixel
+	writes    int
+}
+
+func NewSim(numPixels int, numColors int) *Sim {
+	p := make([]Pixel, numPixels)
+	w := 0
+	if numColors < 4 {
+		w = -1
+	}
+	for i := range p {
+		p[i].W = w
+	}
+	f := make([]Pixel, numPixels)
+	copy(f, p)
+	return &Sim{numColors: numColors, pixels: p, frame: f}
+}
+
+func (sm *Sim) RPi() *rpi.RPi {
+	return nil
+}
+
+func (sm *Sim) MaxPerChannel() int {
+	return 255
+}
+
+func (sm *Sim) GetPixel(i int) Pixel {
+	return sm.pixels[i]
+}
+
+func (sm *Sim) SetPixel(i int, p Pixel) {
+	// Truncated to bytes, as the real strips do
+	np := Pixel{p.R & 0xff, p.G & 0xff, p.B & 0xff, -1}
+	if sm.numColors == 4 {
+		np.W = p.W & 0xff
+	}
+	sm.pixels[i] = np
+}
+
+// Write makes the current pixels the frame that's "shown".
+func (sm *Sim) Write() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	copy(sm.frame, sm.pixels)
+	sm.writes++
+	return nil
+}
+
+func (sm *Sim) Close() error {
+	return nil
+}
+
+// Frame returns a copy of the last frame written, and how many frames have been written. It's
+// safe to call while another goroutine is writing.
+func (sm *Sim) Frame() ([]Pixel, int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	f := make([]Pixel, len(sm.frame))
+	copy(f, sm.frame)
+	return f, sm.writes
+}
@@ -0,0 +1,93 @@
+package pixarray
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Terminal mirrors another LEDStrip to a terminal, drawing each pixel as a coloured block using
+// 24-bit ANSI colour. Each frame is drawn over the previous one. Frames written faster than the
+// frame rate allows aren't drawn, apart from the last, which is drawn once the frame rate allows,
+// so that what's shown doesn't lag behind the LEDs.
+type Terminal struct {
+	LEDStrip
+	numPixels int
+	out       io.Writer
+	layout    Layout
+	interval  time.Duration
+
+	mu      sync.Mutex
+	frame   []Pixel
+	last    time.Time
+	pending bool
+	drawn   bool
+}
+
+// NewTerminal returns a Terminal mirroring leds, which has numPixels pixels, to out. fps is the
+// maximum frame rate, 0 meaning no maximum.
+func NewTerminal(leds LEDStrip, numPixels int, out io.Writer, layout Layout, fps float64) *Terminal {
+	var interval time.Duration
+	if fps > 0 {
+		interval = time.Duration(float64(time.Second) / fps)
+	}
+	return &Terminal{LEDStrip: leds, numPixels: numPixels, out: out, layout: layout, interval: interval, frame: make([]Pixel, numPixels)}
+}
+
+func (t *Terminal) Write() error {
+	err := t.LEDStrip.Write()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.frame {
+		t.frame[i] = t.LEDStrip.GetPixel(i)
+	}
+	wait := t.interval - time.Since(t.last)
+	switch {
+	case wait <= 0:
+		t.draw()
+	case !t.pending:
+		t.pending = true
+		time.AfterFunc(wait, func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.draw()
+		})
+	}
+	return err
+}
+
+// draw draws the latest frame. t.mu must be held.
+func (t *Terminal) draw() {
+	t.pending = false
+	t.last = time.Now()
+	rows := t.layout.Rows(t.numPixels)
+	grid := make([][]*Pixel, rows)
+	for r := range grid {
+		grid[r] = make([]*Pixel, t.layout.Width)
+	}
+	for i := range t.frame {
+		r, c := t.layout.Position(i)
+		grid[r][c] = &t.frame[i]
+	}
+	var b bytes.Buffer
+	if t.drawn {
+		// Back to the start of the previous frame
+		fmt.Fprintf(&b, "\x1b[%dA\r", rows)
+	}
+	max := t.LEDStrip.MaxPerChannel()
+	for _, row := range grid {
+		for _, p := range row {
+			if p == nil {
+				b.WriteString("  ")
+				continue
+			}
+			r, g, bl := p.To8Bit(max)
+			fmt.Fprintf(&b, "\x1b[38;2;%d;%d;%dm██", r, g, bl)
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	t.out.Write(b.Bytes()) // Ignore error, the preview isn't important enough to fail for
+	t.drawn = true
+}
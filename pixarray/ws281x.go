@@ -118,6 +118,26 @@ func (ws *WS281x) SetPixel(i int, p Pixel) {
 	}
 }
 
+// Close waits for the last frame to be output, stops PWM, frees the DMA buffer and releases the
+// RPi.
+func (ws *WS281x) Close() error {
+	err := ws.rp.WaitForDMAEnd()
+	if err != nil {
+		err = fmt.Errorf("DMA wait failed: %v", err)
+		// Carry on, we still want to free everything
+	}
+	ws.rp.StopPWM()
+	te := ws.rp.FreeDMABuf(ws.pixDMA)
+	if err == nil && te != nil {
+		err = fmt.Errorf("couldn't free DMA buffer: %v", te)
+	}
+	te = ws.rp.Close()
+	if err == nil && te != nil {
+		err = fmt.Errorf("couldn't close RPi: %v", te)
+	}
+	return err
+}
+
 const (
 	SYMBOL_HIGH = 0x6 // 1 1 0
 	SYMBOL_LOW  = 0x4 // 1 0 0
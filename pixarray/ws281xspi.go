@@ -0,0 +1,138 @@
+package pixarray
+
+import (
+	"fmt"
+	rpi "github.com/Jon-Bright/ledctl/rpi"
+	"io"
+)
+
+// WS281xSPI drives WS281x LEDs from an SPI device's MOSI pin, rather than PWM and DMA. Each WS281x
+// bit is sent as several SPI bits, a symbol whose high part is short for a 0 and long for a 1, so
+// the SPI clock runs at the WS281x frequency times the bits per symbol.
+type WS281xSPI struct {
+	numColors int
+	g         int
+	r         int
+	b         int
+	w         int
+	pixels    []byte
+	spiBits   int
+	sendBytes []byte
+	dev       dev
+	rp        *rpi.RPi
+}
+
+// The SPI symbols for a WS281x 0 and 1, for each supported number of SPI bits per WS281x bit. At
+// 800kHz, three bits are high for 417ns (0) or 833ns (1), four bits for 313ns (0) or 938ns (1).
+var spiSymbols = map[int][2]byte{
+	3: {SYMBOL_LOW, SYMBOL_HIGH}, // 1 0 0, 1 1 0
+	4: {0x8, 0xe},                // 1 0 0 0, 1 1 1 0
+}
+
+func NewWS281xSPI(dev dev, numPixels int, numColors int, order int, freq uint, spiBits int) (LEDStrip, error) {
+	ws, err := newWS281xSPI(dev, numPixels, numColors, order, freq, spiBits)
+	if err != nil {
+		return nil, err
+	}
+	ws.rp, err = rpi.NewRPi()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't make RPi: %v", err)
+	}
+	err = ws.rp.SetSPISpeed(dev.Fd(), uint32(freq)*uint32(spiBits))
+	if err != nil {
+		ws.rp.Close() // Ignore error, we already have one
+		return nil, fmt.Errorf("couldn't set SPI speed: %v", err)
+	}
+	return ws, nil
+}
+
+// newWS281xSPI does everything for NewWS281xSPI that doesn't need a Raspberry Pi.
+func newWS281xSPI(dev dev, numPixels int, numColors int, order int, freq uint, spiBits int) (*WS281xSPI, error) {
+	if _, ok := spiSymbols[spiBits]; !ok {
+		return nil, fmt.Errorf("%d SPI bits per WS281x bit isn't supported, only 3 or 4", spiBits)
+	}
+	offsets := offsets[order]
+	// The LEDs latch once the line's been low for LED_RESET_US, so that many bits of zeroes follow
+	// the data
+	dataBytes := (numPixels*numColors*8*spiBits + 7) / 8
+	resetBytes := (LED_RESET_US*int(freq)*spiBits/1000000 + 7) / 8
+	return &WS281xSPI{
+		numColors: numColors,
+		g:         offsets[0],
+		r:         offsets[1],
+		b:         offsets[2],
+		w:         offsets[3],
+		pixels:    make([]byte, numPixels*numColors),
+		spiBits:   spiBits,
+		sendBytes: make([]byte, dataBytes+resetBytes),
+		dev:       dev,
+	}, nil
+}
+
+func (ws *WS281xSPI) RPi() *rpi.RPi {
+	return ws.rp
+}
+
+func (ws *WS281xSPI) MaxPerChannel() int {
+	return 255
+}
+
+func (ws *WS281xSPI) GetPixel(i int) Pixel {
+	p := Pixel{int(ws.pixels[i*ws.numColors+ws.r]), int(ws.pixels[i*ws.numColors+ws.g]), int(ws.pixels[i*ws.numColors+ws.b]), -1}
+	if ws.numColors == 4 {
+		p.W = int(ws.pixels[i*ws.numColors+ws.w])
+	}
+	return p
+}
+
+func (ws *WS281xSPI) SetPixel(i int, p Pixel) {
+	ws.pixels[i*ws.numColors+ws.r] = byte(p.R)
+	ws.pixels[i*ws.numColors+ws.g] = byte(p.G)
+	ws.pixels[i*ws.numColors+ws.b] = byte(p.B)
+	if ws.numColors == 4 {
+		ws.pixels[i*ws.numColors+ws.w] = byte(p.W)
+	}
+}
+
+// encode writes the pixels into sendBytes as SPI symbols, most significant bit first. The reset
+// bytes after them are never written, so stay zero.
+func (ws *WS281xSPI) encode() {
+	sym := spiSymbols[ws.spiBits]
+	data := ws.sendBytes[:(len(ws.pixels)*8*ws.spiBits+7)/8]
+	for i := range data {
+		data[i] = 0
+	}
+	pos := 0
+	for _, v := range ws.pixels {
+		for k := 7; k >= 0; k-- {
+			s := sym[(v>>uint(k))&1]
+			for l := ws.spiBits - 1; l >= 0; l-- {
+				if s&(1<<uint(l)) != 0 {
+					data[pos/8] |= 0x80 >> uint(pos%8)
+				}
+				pos++
+			}
+		}
+	}
+}
+
+func (ws *WS281xSPI) Write() error {
+	ws.encode()
+	_, err := ws.dev.Write(ws.sendBytes)
+	return err
+}
+
+// Close closes the SPI device (if it can be closed) and releases the RPi.
+func (ws *WS281xSPI) Close() error {
+	var err error
+	if c, ok := ws.dev.(io.Closer); ok {
+		err = c.Close()
+	}
+	if ws.rp != nil {
+		te := ws.rp.Close()
+		if err == nil {
+			err = te
+		}
+	}
+	return err
+}
@@ -12,8 +12,11 @@ var powerCtrlPin = flag.Int("powerCtrlPin", -1, "A GPIO pin which, when set high
 var powerStatusPin = flag.Int("powerStatusPin", -1, "A GPIO pin which indicates healthy power to the LEDs. -1 means no such pin exists. Only relevant if powerCtrlPin is specified.")
 var powerStatusWait = flag.Duration("powerStatusWait", 2*time.Second, "How long to wait for a healthy power signal. Only relevant if powerStatusPin is specified and relevant.")
 
+// Without an RPi (for simulated LEDs), there's nothing to control power with, so all of these do
+// nothing.
+
 func initPower(rp *rpi.RPi) error {
-	if *powerCtrlPin < 0 {
+	if *powerCtrlPin < 0 || rp == nil {
 		return nil
 	}
 	err := rp.GPIOSetOutput(*powerCtrlPin, rpi.PullNone)
@@ -27,7 +30,7 @@ func initPower(rp *rpi.RPi) error {
 }
 
 func powerOn(rp *rpi.RPi) error {
-	if *powerCtrlPin < 0 {
+	if *powerCtrlPin < 0 || rp == nil {
 		return nil
 	}
 	log.Printf("Power on")
@@ -57,7 +60,7 @@ func powerOn(rp *rpi.RPi) error {
 }
 
 func powerOff(rp *rpi.RPi) error {
-	if *powerCtrlPin < 0 {
+	if *powerCtrlPin < 0 || rp == nil {
 		return nil
 	}
 	log.Printf("Power off")
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	effects "github.com/Jon-Bright/ledctl/effects"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Connections start out speaking protocol 1: replies are bare, and any error closes the
+// connection. A client can switch to protocol 2 with PROTOCOL 2. In protocol 2, every reply ends
+// with a status line "<code> <message>", preceded by any data lines as "<code>-<data>". Errors
+// leave the connection open. A request may start with an ID ("#<id> "), which is then put at the
+// start of every line of its reply. After SUBSCRIBE, events are sent as "100 EVENT <event>".
+const maxProtocol = 2
+
+const (
+	statusEvent          = 100
+	statusOK             = 200
+	statusError          = 400
+	statusUnauthorized   = 401
+	statusForbidden      = 403
+	statusUnknownCommand = 404
+)
+
+// unknownCommandError is returned by createEffect for commands it doesn't recognise.
+type unknownCommandError struct {
+	cmd string
+}
+
+func (e unknownCommandError) Error() string {
+	return "unknown command: " + e.cmd
+}
+
+// statusFor returns the protocol 2 status code for an error from createEffect or authentication.
+func statusFor(err error) int {
+	if _, ok := err.(unknownCommandError); ok {
+		return statusUnknownCommand
+	}
+	if ae, ok := err.(authError); ok {
+		return ae.code
+	}
+	return statusError
+}
+
+// splitRequestID splits a protocol 2 request ID from the start of l, if it has one.
+func splitRequestID(l string) (string, string) {
+	if !strings.HasPrefix(l, "#") {
+		return "", l
+	}
+	t := strings.SplitN(l, " ", 2)
+	if len(t) == 1 {
+		return t[0], ""
+	}
+	return t[0], strings.TrimSpace(t[1])
+}
+
+// parseProtocol handles a PROTOCOL command, returning the connection's new protocol version
+// (which is unchanged for a plain PROTOCOL query). The reply is written in the new version's
+// form.
+func parseProtocol(parms string, version int, id string, w *bufio.Writer) (int, error) {
+	if parms == "" {
+		data := []string{strconv.Itoa(version)}
+		if version < 2 {
+			w.WriteString(data[0] + "\n")
+			return version, w.Flush()
+		}
+		writeV2(w, id, data, statusOK, "OK")
+		return version, w.Flush()
+	}
+	v, err := strconv.Atoi(parms)
+	if err != nil || v < 1 || v > maxProtocol {
+		return version, fmt.Errorf("unsupported protocol '%s', want 1 to %d", parms, maxProtocol)
+	}
+	log.Printf("Switching to protocol %d", v)
+	if v < 2 {
+		w.WriteString("OK\n")
+		return v, w.Flush()
+	}
+	writeV2(w, id, nil, statusOK, "OK")
+	return v, w.Flush()
+}
+
+// writeV2 writes a protocol 2 reply: the data lines, then the status line.
+func writeV2(w *bufio.Writer, id string, data []string, code int, msg string) {
+	pfx := ""
+	if id != "" {
+		pfx = id + " "
+	}
+	for _, d := range data {
+		w.WriteString(fmt.Sprintf("%s%d-%s\n", pfx, code, d))
+	}
+	w.WriteString(fmt.Sprintf("%s%d %s\n", pfx, code, msg))
+}
+
+// runV2 runs a command for a protocol 2 connection. Whatever the command writes is sent as data
+// lines, followed by the status line.
+func (s *Server) runV2(cmd, parms, l, id string, w *bufio.Writer) error {
+	e, data, err := s.collect(cmd, parms, l)
+	if err != nil {
+		writeV2(w, id, nil, statusFor(err), err.Error())
+		return w.Flush()
+	}
+	writeV2(w, id, data, statusOK, "OK")
+	err = w.Flush()
+	if e != nil {
+		s.startEffect(e, l)
+	}
+	return err
+}
+
+// collect creates the effect for a command, collecting whatever the command writes as lines (less
+// the final OK that list replies end with). The effect, if any, isn't started.
+func (s *Server) collect(cmd, parms, l string) (effects.Effect, []string, error) {
+	var b bytes.Buffer
+	bw := bufio.NewWriter(&b)
+	e, err := s.createEffect(cmd, parms, bw)
+	if err != nil {
+		log.Printf("Error running '%s': %v", l, err)
+		s.events.publish("ERROR %v", err)
+		return nil, nil, err
+	}
+	bw.Flush() // Can't fail, it's a bytes.Buffer
+	var data []string
+	if b.Len() > 0 {
+		data = strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+		if data[len(data)-1] == "OK" {
+			data = data[:len(data)-1]
+		}
+	}
+	return e, data, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	clock "github.com/Jon-Bright/ledctl/clock"
+	effects "github.com/Jon-Bright/ledctl/effects"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	rpi "github.com/Jon-Bright/ledctl/rpi"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testLeds struct {
+	pixels []pixarray.Pixel
+	closed bool
+}
+
+func (l *testLeds) RPi() *rpi.RPi {
+	return nil
+}
+
+func (l *testLeds) GetPixel(i int) pixarray.Pixel {
+	return l.pixels[i]
+}
+
+func (l *testLeds) SetPixel(i int, p pixarray.Pixel) {
+	l.pixels[i] = p
+}
+
+func (l *testLeds) Write() error {
+	return nil
+}
+
+func (l *testLeds) Close() error {
+	l.closed = true
+	return nil
+}
+
+func (l *testLeds) MaxPerChannel() int {
+	return 255
+}
+
+func newTestServer(numPixels int) *Server {
+	leds := &testLeds{pixels: make([]pixarray.Pixel, numPixels)}
+	pa := pixarray.NewPixArray(numPixels, 3, leds)
+	pa.SetAll(pixarray.Pixel{R: 1, G: 2, B: 3, W: -1})
+	return &Server{pa: pa, clock: clock.Real, c: make(chan effects.Effect, 10), quit: make(chan chan bool), off: true}
+}
+
+func TestProtocol(t *testing.T) {
+	s := newTestServer(4)
+	setSegments([]SegmentConfig{{Name: "shelf", Start: 0, Length: 2}})
+	defer setSegments(nil)
+	client, srv := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(srv)
+	r := bufio.NewReader(client)
+
+	tests := []struct {
+		send string
+		want []string
+	}{
+		{"PROTOCOL", []string{"1"}},
+		{"PROTOCOL 2", []string{"200 OK"}},
+		{"PROTOCOL", []string{"200-2", "200 OK"}},
+		{"#7 BOGUS", []string{"#7 404 unknown command: BOGUS"}},
+		{"PROTOCOL 3", []string{"400 unsupported protocol '3', want 1 to 2"}},
+		{"#x SEGMENTS", []string{"#x 200-shelf 0 2", "#x 200 OK"}},
+		{"COLOUR", []string{"200-010203", "200 OK"}},
+		{"#fade FADE_ALL 0a0b0c 1", []string{"#fade 200 OK"}},
+		{"PROTOCOL 1", []string{"OK"}},
+		{"COLOUR", []string{"010203"}},
+		{"BOGUS", []string{"ERR: Error creating effect: unknown command: BOGUS"}},
+	}
+	for _, tc := range tests {
+		client.SetDeadline(time.Now().Add(time.Second))
+		_, err := client.Write([]byte(tc.send + "\n"))
+		if err != nil {
+			t.Fatalf("Couldn't send '%s': %v", tc.send, err)
+		}
+		for _, w := range tc.want {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Couldn't read reply to '%s': %v", tc.send, err)
+			}
+			if got := strings.TrimSuffix(l, "\n"); got != w {
+				t.Errorf("Wrong reply to '%s', got: '%s', want: '%s'", tc.send, got, w)
+			}
+		}
+	}
+	if len(s.c) != 1 || s.lastCmd != "FADE_ALL 0a0b0c 1" {
+		t.Errorf("Wrong effect started, %d effects, last command '%s'", len(s.c), s.lastCmd)
+	}
+	// A protocol 1 error closes the connection
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Errorf("Connection not closed after protocol 1 error: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	effects "github.com/Jon-Bright/ledctl/effects"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var recordingsDir = flag.String("recordings", "", "A directory in which RECORD saves recordings and PLAYBACK finds them. Empty means recording and playback aren't available")
+
+// recordingPath returns the path of the recording with the given name, which must be a plain file
+// name, so that clients can't read or write files outside the recordings directory.
+func recordingPath(name string) (string, error) {
+	if *recordingsDir == "" {
+		return "", fmt.Errorf("no recordings directory configured")
+	}
+	if name == "" || strings.HasPrefix(name, ".") || filepath.Base(name) != name {
+		return "", fmt.Errorf("bad recording name '%s'", name)
+	}
+	return filepath.Join(*recordingsDir, name), nil
+}
+
+// record handles a RECORD command: with no parameters, it replies with the recording in progress
+// (or NONE), otherwise it starts or stops recording.
+func (s *Server) record(parms string, w *bufio.Writer) error {
+	s.recMu.Lock()
+	defer s.recMu.Unlock()
+	t := strings.Fields(parms)
+	switch {
+	case len(t) == 0:
+		r := "NONE\n"
+		if s.rec != nil {
+			r = s.recName + "\n"
+		}
+		w.WriteString(r)
+	case strings.ToUpper(t[0]) == "START" && len(t) == 2:
+		if s.rec != nil {
+			return fmt.Errorf("already recording to '%s'", s.recName)
+		}
+		path, err := recordingPath(t[1])
+		if err != nil {
+			return err
+		}
+		// Never replace an existing recording, which may be the only copy of something
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			return fmt.Errorf("recording '%s' already exists", t[1])
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't create recording: %v", err)
+		}
+		rec, err := pixarray.NewRecorder(f, s.pa.NumPixels(), s.pa.NumColors(), s.pa.MaxPerChannel())
+		if err != nil {
+			f.Close() // Ignore error, we already have one
+			return fmt.Errorf("couldn't start recording: %v", err)
+		}
+		s.rec, s.recFile, s.recName = rec, f, t[1]
+		s.pa.Record(rec, s.clock)
+		log.Printf("Recording to %s", path)
+		w.WriteString("OK\n")
+	case strings.ToUpper(t[0]) == "STOP" && len(t) == 1:
+		if s.rec == nil {
+			return fmt.Errorf("not recording")
+		}
+		err := s.stopRecording()
+		if err != nil {
+			return err
+		}
+		w.WriteString("OK\n")
+	default:
+		return fmt.Errorf("RECORD needs START <name>, STOP or nothing")
+	}
+	return w.Flush()
+}
+
+// stopRecording stops the recording in progress, if any, and saves it. s.recMu must be held.
+func (s *Server) stopRecording() error {
+	if s.rec == nil {
+		return nil
+	}
+	s.pa.Record(nil, nil)
+	err := s.rec.Flush()
+	cerr := s.recFile.Close()
+	if err == nil {
+		err = cerr
+	}
+	log.Printf("Stopped recording to %s", s.recName)
+	s.rec, s.recFile, s.recName = nil, nil, ""
+	if err != nil {
+		return fmt.Errorf("couldn't save recording: %v", err)
+	}
+	return nil
+}
+
+// createPlayback creates a PLAYBACK effect from its parameters: a recording's name and optionally
+// speed=<factor>.
+func createPlayback(parms string) (effects.Effect, error) {
+	t := strings.SplitN(parms, " ", 2)
+	path, err := recordingPath(t[0])
+	if err != nil {
+		return nil, err
+	}
+	rest := ""
+	if len(t) > 1 {
+		rest = t[1]
+	}
+	o, err := parseOptions(rest, "speed")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing options: %v", err)
+	}
+	speed := 1.0
+	if sp, ok := o["speed"]; ok {
+		speed, err = strconv.ParseFloat(sp, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing speed: %v", err)
+		}
+		if speed <= 0.0 {
+			return nil, fmt.Errorf("speed %f must be >0.0", speed)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open recording: %v", err)
+	}
+	defer f.Close()
+	rec, err := pixarray.ReadRecording(f)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read recording '%s': %v", t[0], err)
+	}
+	if len(rec.Frames) == 0 {
+		return nil, fmt.Errorf("recording '%s' is empty", t[0])
+	}
+	return effects.NewPlayback(rec, speed), nil
+}
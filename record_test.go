@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndPlayback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledctl")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	old := *recordingsDir
+	defer func() { *recordingsDir = old }()
+	s := newTestServer(4)
+	run := func(l string) (string, error) {
+		var b bytes.Buffer
+		w := bufio.NewWriter(&b)
+		tk := strings.SplitN(l, " ", 2)
+		parms := ""
+		if len(tk) > 1 {
+			parms = tk[1]
+		}
+		_, err := s.createEffect(tk[0], parms, w)
+		return strings.TrimSpace(b.String()), err
+	}
+
+	*recordingsDir = ""
+	if _, err := run("RECORD START show"); err == nil {
+		t.Errorf("Recorded without a recordings directory")
+	}
+	*recordingsDir = dir
+	for _, l := range []string{"RECORD START ../show", "RECORD START .hidden", "RECORD STOP", "RECORD PAUSE", "PLAYBACK missing"} {
+		if _, err := run(l); err == nil {
+			t.Errorf("'%s' accepted, wanted an error", l)
+		}
+	}
+	if got, err := run("RECORD"); err != nil || got != "NONE" {
+		t.Errorf("Wrong reply to RECORD before recording, got: '%s', %v", got, err)
+	}
+	if _, err := run("RECORD START show"); err != nil {
+		t.Fatalf("Couldn't start recording: %v", err)
+	}
+	if _, err := run("RECORD START other"); err == nil {
+		t.Errorf("Started a second recording")
+	}
+	if got, err := run("RECORD"); err != nil || got != "show" {
+		t.Errorf("Wrong reply to RECORD while recording, got: '%s', %v", got, err)
+	}
+	s.pa.SetAll(pixarray.Pixel{R: 10, G: 20, B: 30, W: -1})
+	s.pa.Write()
+	s.pa.SetOne(3, pixarray.Pixel{R: 40, G: 50, B: 60, W: -1})
+	s.pa.Write()
+	if _, err := run("RECORD STOP"); err != nil {
+		t.Fatalf("Couldn't stop recording: %v", err)
+	}
+	s.pa.Write() // Not recorded
+	if _, err := run("RECORD START show"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Wrong error recording over an existing recording: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "show"))
+	if err != nil {
+		t.Fatalf("Couldn't open recording: %v", err)
+	}
+	defer f.Close()
+	rc, err := pixarray.ReadRecording(f)
+	if err != nil {
+		t.Fatalf("Couldn't read recording: %v", err)
+	}
+	if len(rc.Frames) != 2 || rc.Frames[1].Pixels[3] != (pixarray.Pixel{R: 40, G: 50, B: 60, W: -1}) {
+		t.Errorf("Wrong frames recorded: %+v", rc.Frames)
+	}
+
+	for _, l := range []string{"PLAYBACK show speed=0", "PLAYBACK show speed=fast", "PLAYBACK show loop=1"} {
+		if _, err := run(l); err == nil {
+			t.Errorf("'%s' accepted, wanted an error", l)
+		}
+	}
+	e, err := s.createEffect("PLAYBACK", "show speed=0.5", bufio.NewWriter(ioutil.Discard))
+	if err != nil || e == nil || e.Name() != "PLAYBACK" {
+		t.Errorf("Couldn't create playback: %v, %v", e, err)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	clock "github.com/Jon-Bright/ledctl/clock"
+	effects "github.com/Jon-Bright/ledctl/effects"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// renderStart is when rendered effects start, on their virtual clock. It's fixed so that effects
+// using randomness (like TWINKLE) render the same way every time.
+var renderStart = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// render runs the render subcommand: it runs an effect on simulated LEDs against a virtual clock,
+// as fast as it can, and writes what it did as a PNG strip-chart (one row of pixels per frame,
+// time running downwards) and an animated GIF.
+func render(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	effect := fs.String("effect", "RAINBOW", "The effect to render, as a command, e.g. 'FADE_ALL orange 5'. Without parameters, --duration is given as the effect's duration")
+	duration := fs.Duration("duration", 10*time.Second, "How long to render for")
+	numPixels := fs.Int("pixels", 5*32, "The number of pixels to render")
+	fps := fs.Float64("fps", 25, "The number of frames per second to render")
+	scale := fs.Int("scale", 4, "The size, in image pixels, of each LED in the images")
+	pngFile := fs.String("png", "render.png", "The file to write the strip-chart to. Empty means none")
+	gifFile := fs.String("gif", "render.gif", "The file to write the animation to. Empty means none")
+	shape := fs.String("layout", "linear", "How the pixels are arranged in the animation: linear, matrix or ring")
+	width := fs.Int("layoutwidth", 40, "The number of pixels per row in the animation: the matrix width, or where a linear strip wraps")
+	serp := fs.Bool("serpentine", false, "Whether every other row of a matrix runs right to left")
+	palettes := fs.String("palettes", "", "A file of palette definitions to load before rendering, one per line")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	layout := pixarray.Layout{Shape: *shape, Width: *width, Serpentine: *serp}
+	switch {
+	case *duration <= 0:
+		return fmt.Errorf("duration must be positive")
+	case *numPixels <= 0:
+		return fmt.Errorf("pixels must be positive")
+	case *fps <= 0 || *fps > 100:
+		return fmt.Errorf("fps must be >0 and <=100")
+	case *scale <= 0:
+		return fmt.Errorf("scale must be positive")
+	}
+	if err := layout.Validate(); err != nil {
+		return fmt.Errorf("layout: %v", err)
+	}
+	ps, err := readPaletteFile(*palettes)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		effects.DefinePalette(p)
+	}
+
+	sim := pixarray.NewSim(*numPixels, 3)
+	pa := pixarray.NewPixArray(*numPixels, 3, sim)
+	e, err := renderEffect(pa, *effect, *duration)
+	if err != nil {
+		return err
+	}
+	frames := renderFrames(e, pa, *duration, *fps)
+	if *pngFile != "" {
+		err = writeImage(*pngFile, func(f *os.File) error {
+			return png.Encode(f, stripChart(frames, pa.MaxPerChannel(), *scale))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if *gifFile != "" {
+		err = writeImage(*gifFile, func(f *os.File) error {
+			return gif.EncodeAll(f, animation(frames, pa.MaxPerChannel(), layout, *scale, *fps))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderEffect creates the effect for the command l, which must be one that starts an effect
+// straight away. If l has no parameters, d is given as the effect's duration.
+func renderEffect(pa *pixarray.PixArray, l string, d time.Duration) (effects.Effect, error) {
+	t := strings.SplitN(strings.TrimSpace(l), " ", 2)
+	cmd := strings.ToUpper(t[0])
+	parms := strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+	if len(t) > 1 {
+		parms = t[1]
+	}
+	ok := cmd == "PLAYBACK"
+	for _, ve := range viewerEffects {
+		ok = ok || ve.Name == cmd
+	}
+	if !ok {
+		return nil, fmt.Errorf("'%s' isn't an effect that can be rendered", cmd)
+	}
+	s := &Server{pa: pa, clock: clock.NewFake(renderStart), off: true}
+	e, err := s.createEffect(cmd, parms, bufio.NewWriter(ioutil.Discard))
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, fmt.Errorf("'%s' doesn't start an effect straight away", l)
+	}
+	return e, nil
+}
+
+// renderFrames runs e on pa for d, on a virtual clock, returning the pixels at each of fps frames
+// per second, starting at the start. If the effect finishes early, the frames after show how it
+// left the pixels.
+func renderFrames(e effects.Effect, pa *pixarray.PixArray, d time.Duration, fps float64) [][]pixarray.Pixel {
+	n := int(d.Seconds()*fps) + 1
+	frames := make([][]pixarray.Pixel, n)
+	e.Start(pa, renderStart)
+	next := renderStart
+	done := false
+	for i := range frames {
+		at := renderStart.Add(time.Duration(float64(i) * float64(time.Second) / fps))
+		// Every step that's due by this frame, at the time it was asked for
+		for !done && !next.After(at) {
+			step := e.NextStep(pa, next)
+			if step == 0 {
+				done = true
+			}
+			next = next.Add(step)
+		}
+		frames[i] = pa.GetPixels()
+	}
+	return frames
+}
+
+func toColor(p pixarray.Pixel, max int) color.RGBA {
+	r, g, b := p.To8Bit(max)
+	return color.RGBA{R: r, G: g, B: b, A: 0xff}
+}
+
+// stripChart draws frames as a strip-chart: each frame is a row, each pixel a column, and each
+// scaled up to scale×scale.
+func stripChart(frames [][]pixarray.Pixel, max, scale int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, len(frames[0])*scale, len(frames)*scale))
+	for y, f := range frames {
+		for x, p := range f {
+			draw.Draw(img, image.Rect(x*scale, y*scale, (x+1)*scale, (y+1)*scale), image.NewUniform(toColor(p, max)), image.Point{}, draw.Src)
+		}
+	}
+	return img
+}
+
+// animation draws frames as an animated GIF, with the pixels laid out as given, each a
+// scale×scale square.
+func animation(frames [][]pixarray.Pixel, max int, layout pixarray.Layout, scale int, fps float64) *gif.GIF {
+	n := len(frames[0])
+	w, h := layout.Size(n)
+	bounds := image.Rect(0, 0, int(math.Ceil(w*float64(scale))), int(math.Ceil(h*float64(scale))))
+	delay := int(math.Round(100 / fps))
+	g := &gif.GIF{}
+	rgba := image.NewRGBA(bounds)
+	for _, f := range frames {
+		draw.Draw(rgba, bounds, image.Black, image.Point{}, draw.Src)
+		pal := color.Palette{color.RGBA{A: 0xff}}
+		seen := map[color.RGBA]bool{pal[0].(color.RGBA): true}
+		for i, p := range f {
+			c := toColor(p, max)
+			if !seen[c] {
+				seen[c] = true
+				pal = append(pal, c)
+			}
+			x, y := layout.Point(i, n)
+			x0 := int(math.Round(x*float64(scale) - float64(scale)/2))
+			y0 := int(math.Round(y*float64(scale) - float64(scale)/2))
+			draw.Draw(rgba, image.Rect(x0, y0, x0+scale, y0+scale), image.NewUniform(c), image.Point{}, draw.Src)
+		}
+		if len(pal) > 256 {
+			// Too many colours for one GIF frame, approximate them
+			pal = palette.Plan9
+		}
+		pi := image.NewPaletted(bounds, pal)
+		draw.Draw(pi, bounds, rgba, image.Point{}, draw.Src)
+		g.Image = append(g.Image, pi)
+		g.Delay = append(g.Delay, delay)
+	}
+	return g
+}
+
+// writeImage creates the file path and writes an image to it with enc.
+func writeImage(path string, enc func(f *os.File) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = enc(f)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't write %s: %v", path, err)
+	}
+	return nil
+}
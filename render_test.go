@@ -0,0 +1,94 @@
+package main
+
+import (
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenderFrames(t *testing.T) {
+	pa := pixarray.NewPixArray(4, 3, pixarray.NewSim(4, 3))
+	e, err := renderEffect(pa, "FADE_ALL ff0000 1", 0)
+	if err != nil {
+		t.Fatalf("Couldn't create effect: %v", err)
+	}
+	frames := renderFrames(e, pa, 2*time.Second, 10)
+	if len(frames) != 21 {
+		t.Fatalf("Wrong number of frames, got: %d, want: 21", len(frames))
+	}
+	if frames[0][0].R != 0 || frames[5][0].R == 0 || frames[5][0].R == 255 {
+		t.Errorf("Fade not under way: %v, %v", frames[0][0], frames[5][0])
+	}
+	for _, i := range []int{10, 20} {
+		if want := (pixarray.Pixel{R: 255, G: 0, B: 0, W: -1}); frames[i][3] != want {
+			t.Errorf("Wrong pixel in frame %d, got: %v, want: %v", i, frames[i][3], want)
+		}
+	}
+
+	for _, l := range []string{"OFF", "SCHEDULE LIST", "FADE_ALL", "NOPE"} {
+		if _, err := renderEffect(pa, l, time.Second); err == nil {
+			t.Errorf("'%s' rendered, wanted an error", l)
+		}
+	}
+	if _, err := renderEffect(pa, "rainbow", time.Second); err != nil {
+		t.Errorf("Couldn't create effect with the default duration: %v", err)
+	}
+}
+
+func TestRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledctl")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	pngFile := filepath.Join(dir, "out.png")
+	gifFile := filepath.Join(dir, "out.gif")
+	err = render([]string{"--effect", "RAINBOW", "--duration", "1s", "--pixels", "16", "--fps", "10", "--scale", "2",
+		"--layout", "matrix", "--layoutwidth", "4", "--png", pngFile, "--gif", gifFile})
+	if err != nil {
+		t.Fatalf("Couldn't render: %v", err)
+	}
+	f, err := os.Open(pngFile)
+	if err != nil {
+		t.Fatalf("Couldn't open PNG: %v", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Couldn't decode PNG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 22 {
+		t.Errorf("Wrong PNG size, got: %v, want: 32x22", b)
+	}
+	g, err := os.Open(gifFile)
+	if err != nil {
+		t.Fatalf("Couldn't open GIF: %v", err)
+	}
+	defer g.Close()
+	anim, err := gif.DecodeAll(g)
+	if err != nil {
+		t.Fatalf("Couldn't decode GIF: %v", err)
+	}
+	if len(anim.Image) != 11 || anim.Delay[0] != 10 {
+		t.Errorf("Wrong animation, got: %d frames, delay %d, want: 11 frames, delay 10", len(anim.Image), anim.Delay[0])
+	}
+	if b := anim.Image[0].Bounds(); b.Dx() != 8 || b.Dy() != 8 {
+		t.Errorf("Wrong GIF size, got: %v, want: 8x8", b)
+	}
+
+	for _, args := range [][]string{
+		{"--duration", "0s"},
+		{"--pixels", "0"},
+		{"--layout", "spiral"},
+		{"--effect", "OFF"},
+	} {
+		if err := render(append(args, "--png", "", "--gif", "")); err == nil {
+			t.Errorf("Rendered with %v, wanted an error", args)
+		}
+	}
+}
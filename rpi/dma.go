@@ -117,7 +117,7 @@ func (rp *RPi) InitDMA(dma int) error {
 		bufOffs uintptr
 		err     error
 	)
-	rp.dmaBuf, bufOffs, err = rp.mapMem(offset, int(unsafe.Sizeof(dmaT{})))
+	rp.dmaBuf, bufOffs, err = rp.mem.mapMem(offset, int(unsafe.Sizeof(dmaT{})))
 	if err != nil {
 		return fmt.Errorf("couldn't map dmaT at %08X: %v", offset, err)
 	}
@@ -136,10 +136,10 @@ func rpiDmaCsPriority(val uint32) uint32 {
 
 func (rp *RPi) StartDMA(d *DMABuf) {
 	rp.dma.cs = RPI_DMA_CS_RESET
-	time.Sleep(10 * time.Microsecond)
+	rp.sleep(10 * time.Microsecond)
 
 	rp.dma.cs = RPI_DMA_CS_INT | RPI_DMA_CS_END
-	time.Sleep(10 * time.Microsecond)
+	rp.sleep(10 * time.Microsecond)
 
 	rp.dma.conblkAd = uint32(d.pb.busAddr)
 	rp.dma.debug = 7 // clear debug error flags
@@ -164,7 +164,7 @@ func (rp *RPi) WaitForDMAEnd() error {
 		if i == 100000 {
 			return fmt.Errorf("wait failed, cs %08X", cs)
 		}
-		time.Sleep(10 * time.Microsecond)
+		rp.sleep(10 * time.Microsecond)
 	}
 	if (cs & RPI_DMA_CS_ERROR) != 0 {
 		return fmt.Errorf("DMA error, cs %08X, debug %08X", cs, rp.dma.debug)
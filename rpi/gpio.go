@@ -49,7 +49,7 @@ const (
 
 func (rp *RPi) gpioSetPinFunction(pin int, fnc uint32) error {
 	if pin > pinMax {
-		return fmt.Errorf("pin %d not supported")
+		return fmt.Errorf("pin %d not supported", pin)
 	}
 	reg := pin / 10
 	offset := uint((pin % 10) * 3)
@@ -73,11 +73,11 @@ func (rp *RPi) GPIOSetOutput(pin int, pm PullMode) error {
 
 	// See p101 for the description of this procedure.
 	rp.gpio.pud = uint32(pm)
-	time.Sleep(10 * time.Microsecond) // Datasheet says to sleep for 150 cycles after setting pud
+	rp.sleep(10 * time.Microsecond) // Datasheet says to sleep for 150 cycles after setting pud
 	reg := pin / 32
 	offset := uint(pin % 32)
 	rp.gpio.pudclk[reg] = 1 << offset
-	time.Sleep(10 * time.Microsecond) // Datasheet says to sleep for 150 cycles after setting pudclk
+	rp.sleep(10 * time.Microsecond) // Datasheet says to sleep for 150 cycles after setting pudclk
 	rp.gpio.pud = 0
 	rp.gpio.pudclk[reg] = 0
 	return nil
@@ -93,7 +93,7 @@ func (rp *RPi) gpioSetAltFunction(pin int, alt int) error {
 
 func (rp *RPi) GPIOSetPin(pin int, val bool) error {
 	if pin > pinMax {
-		return fmt.Errorf("pin %d not supported")
+		return fmt.Errorf("pin %d not supported", pin)
 	}
 	reg := pin / 32
 	offset := uint(pin % 32)
@@ -107,7 +107,7 @@ func (rp *RPi) GPIOSetPin(pin int, val bool) error {
 
 func (rp *RPi) GPIOGetPin(pin int) (bool, error) {
 	if pin > pinMax {
-		return false, fmt.Errorf("pin %d not supported")
+		return false, fmt.Errorf("pin %d not supported", pin)
 	}
 	reg := pin / 32
 	offset := uint(pin % 32)
@@ -119,7 +119,7 @@ func (rp *RPi) InitGPIO() error {
 		bufOffs uintptr
 		err     error
 	)
-	rp.gpioBuf, bufOffs, err = rp.mapMem(GPIO_OFFSET+rp.hw.periphBase, int(unsafe.Sizeof(gpioT{})))
+	rp.gpioBuf, bufOffs, err = rp.mem.mapMem(GPIO_OFFSET+rp.hw.periphBase, int(unsafe.Sizeof(gpioT{})))
 	if err != nil {
 		return fmt.Errorf("couldn't map gpioT at %08X: %v", GPIO_OFFSET+rp.hw.periphBase, err)
 	}
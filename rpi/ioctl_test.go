@@ -86,7 +86,9 @@ func TestIowr(t *testing.T) {
 		size interface{}
 		want uint32
 	}{
-		{"IOCTL_MBOX_PROPERTY", MAJOR_NUM, 0, uintptr(0), 0xC0046400},
+		// The want value came from a 32-bit Pi, where char * is 4 bytes. uint32 keeps that size
+		// regardless of which architecture the test runs on.
+		{"IOCTL_MBOX_PROPERTY", MAJOR_NUM, 0, uint32(0), 0xC0046400},
 	}
 
 	for _, test := range tests {
@@ -7,7 +7,6 @@ import (
 	"log"
 	"os"
 	"path"
-	"reflect"
 	"syscall"
 	"unsafe"
 )
@@ -39,19 +38,13 @@ type PhysBuf struct {
 // desired mapped area and also adds any bytes specified by offs.
 func (pb *PhysBuf) uint32Slice(offs uintptr) []uint32 {
 	offs += pb.offs
-	header := *(*reflect.SliceHeader)(unsafe.Pointer(&pb.buf))
-	header.Len -= int(offs)
-	header.Len /= 4
-	header.Cap -= int(offs)
-	header.Cap /= 4
-	header.Data += offs
-	return *(*[]uint32)(unsafe.Pointer(&header))
+	return unsafe.Slice((*uint32)(unsafe.Pointer(&pb.buf[offs])), (len(pb.buf)-int(offs))/4)
 }
 
 func (rp *RPi) FreePhysBuf(pb *PhysBuf) error {
 	var err, te error
 	if pb.buf != nil {
-		err = pb.buf.Unmap()
+		err = rp.mem.unmap(pb.buf)
 		pb.buf = nil
 		// Ignore error, return it later
 	}
@@ -85,7 +78,7 @@ func (rp *RPi) getPhysBuf(size uint32) (*PhysBuf, error) {
 		rp.freeVCMem(pb.handle) // Ignore error
 		return nil, fmt.Errorf("couldn't lockMem(%X) of size %v: %v", pb.handle, size, err)
 	}
-	pb.buf, pb.offs, err = rp.mapMem(busToPhys(pb.busAddr), int(size))
+	pb.buf, pb.offs, err = rp.mem.mapMem(busToPhys(pb.busAddr), int(size))
 	if err != nil {
 		rp.unlockVCMem(pb.handle) // Ignore error
 		rp.freeVCMem(pb.handle)   // Ignore error
@@ -100,11 +93,28 @@ func busToPhys(busAddr uintptr) uintptr {
 	return busAddr &^ 0xC0000000 // p7
 }
 
+// A memory maps physical memory, the peripheral registers and DMA buffers, into our address space.
+// On a Pi, it's devMem; tests use plain memory instead.
+type memory interface {
+	mapMem(physAddr uintptr, size int) (mmap.MMap, uintptr, error)
+	unmap(m mmap.MMap) error
+}
+
+// A mailbox sends property messages to the VideoCore. On a Pi, it's vcioMailbox; tests use a fake
+// that answers the messages itself.
+type mailbox interface {
+	property(buf []uint32) error
+	close() error
+}
+
+// devMem maps physical memory through /dev/mem.
+type devMem struct{}
+
 // mapMem opens /dev/mem and uses mmap to map a given physical address into our address space.
 // Since the mapping has to start at a page boundary, the physical address is rounded down to the
 // nearest page boundary. mapMem returns the mapped memory and the offset that should be used to
 // access it (=physAddr%PAGE_SIZE).
-func (rp *RPi) mapMem(physAddr uintptr, size int) (mmap.MMap, uintptr, error) {
+func (devMem) mapMem(physAddr uintptr, size int) (mmap.MMap, uintptr, error) {
 	f, err := os.OpenFile(MEM_FILE, os.O_RDWR|os.O_SYNC, os.ModePerm)
 	if err != nil {
 		return nil, 0, fmt.Errorf("couldn't open %s: %v", MEM_FILE, err)
@@ -123,6 +133,24 @@ func (rp *RPi) mapMem(physAddr uintptr, size int) (mmap.MMap, uintptr, error) {
 	return mm, physAddr & (PAGE_SIZE - 1), nil
 }
 
+func (devMem) unmap(m mmap.MMap) error {
+	return m.Unmap()
+}
+
+// vcioMailbox sends property messages by ioctl-ing a mailbox device node.
+type vcioMailbox struct {
+	f *os.File
+}
+
+func (m *vcioMailbox) property(buf []uint32) error {
+	mboxProperty := iowr(VIDEOCORE_MAJOR_NUM, 0, uintptr(0))
+	return ioctlArrUint32(m.f.Fd(), mboxProperty, buf)
+}
+
+func (m *vcioMailbox) close() error {
+	return m.f.Close()
+}
+
 // mboxOpenTemp creates a temporary device node for ioctl-ing with the mailbox, opens it and
 // immediately removes the node once it's open. It returns the opened node.
 func (rp *RPi) mboxOpenTemp() error {
@@ -144,16 +172,17 @@ func (rp *RPi) mboxOpenTemp() error {
 		f.Close() // Ignore error
 		return fmt.Errorf("couldn't remove temp mbox: %v", err)
 	}
-	rp.mbox = f
+	rp.mbox = &vcioMailbox{f}
 	return nil
 }
 
 // mboxOpen opens /dev/vcio for ioctl-ing with the mailbox. If that doesn't exist, it passes instead
 // to mboxOpenTemp to get a temporary node. It returns the opened mailbox.
 func (rp *RPi) mboxOpen() error {
-	var err error
-	rp.mbox, err = os.OpenFile(VCIO_FILE, os.O_RDONLY, os.ModePerm)
-	if err == os.ErrNotExist {
+	f, err := os.OpenFile(VCIO_FILE, os.O_RDONLY, os.ModePerm)
+	if err == nil {
+		rp.mbox = &vcioMailbox{f}
+	} else if err == os.ErrNotExist {
 		err = rp.mboxOpenTemp()
 	}
 	if err != nil {
@@ -163,7 +192,7 @@ func (rp *RPi) mboxOpen() error {
 }
 
 func (rp *RPi) mboxClose() error {
-	return rp.mbox.Close()
+	return rp.mbox.close()
 }
 
 // mboxProperty uses ioctl to send messages via the mailbox
@@ -171,8 +200,7 @@ func (rp *RPi) mboxProperty(buf []uint32) error {
 	if rp.mbox == nil {
 		return errors.New("mailbox not open")
 	}
-	mboxProperty := iowr(VIDEOCORE_MAJOR_NUM, 0, uintptr(0))
-	err := ioctlArrUint32(rp.mbox.Fd(), mboxProperty, buf)
+	err := rp.mbox.property(buf)
 	if err != nil {
 		return fmt.Errorf("failed ioctl mbox property: %v", err)
 	}
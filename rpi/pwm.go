@@ -82,7 +82,7 @@ func (rp *RPi) InitPWM(freq uint, buf *DMABuf, bytes uint, pins []int) error {
 			bufOffs uintptr
 			err     error
 		)
-		rp.pwmBuf, bufOffs, err = rp.mapMem(PWM_OFFSET+rp.hw.periphBase, int(unsafe.Sizeof(pwmT{})))
+		rp.pwmBuf, bufOffs, err = rp.mem.mapMem(PWM_OFFSET+rp.hw.periphBase, int(unsafe.Sizeof(pwmT{})))
 		if err != nil {
 			return fmt.Errorf("couldn't map pwmT at %08X: %v", PWM_OFFSET+rp.hw.periphBase, err)
 		}
@@ -90,7 +90,7 @@ func (rp *RPi) InitPWM(freq uint, buf *DMABuf, bytes uint, pins []int) error {
 		rp.pwm = (*pwmT)(unsafe.Pointer(&rp.pwmBuf[bufOffs]))
 
 		// This could potentially be in a clk.go. Seems not worth it yet, though.
-		rp.cmClkBuf, bufOffs, err = rp.mapMem(CM_PWM_OFFSET+rp.hw.periphBase, int(unsafe.Sizeof(cmClkT{})))
+		rp.cmClkBuf, bufOffs, err = rp.mem.mapMem(CM_PWM_OFFSET+rp.hw.periphBase, int(unsafe.Sizeof(cmClkT{})))
 		if err != nil {
 			return fmt.Errorf("couldn't map cmClkT at %08X: %v", CM_PWM_OFFSET+rp.hw.periphBase, err)
 		}
@@ -104,7 +104,7 @@ func (rp *RPi) InitPWM(freq uint, buf *DMABuf, bytes uint, pins []int) error {
 	rp.cmClk.div = CM_CLK_DIV_PASSWD | cmClkDivI(oscFreq/(3*uint32(freq)))
 	rp.cmClk.ctl = CM_CLK_CTL_PASSWD | CM_CLK_CTL_SRC_OSC
 	rp.cmClk.ctl = CM_CLK_CTL_PASSWD | CM_CLK_CTL_SRC_OSC | CM_CLK_CTL_ENAB
-	time.Sleep(10 * time.Microsecond)
+	rp.sleep(10 * time.Microsecond)
 	log.Printf("Waiting for cmClk busy\n")
 	i := 0
 	for (rp.cmClk.ctl & CM_CLK_CTL_BUSY) == 0 {
@@ -119,13 +119,13 @@ func (rp *RPi) InitPWM(freq uint, buf *DMABuf, bytes uint, pins []int) error {
 	// the odds of a DMA priority boost are extremely low.
 
 	rp.pwm.rng1 = 32 // 32-bits per word to serialize
-	time.Sleep(10 * time.Microsecond)
+	rp.sleep(10 * time.Microsecond)
 	rp.pwm.ctl = RPI_PWM_CTL_CLRF1
-	time.Sleep(10 * time.Microsecond)
+	rp.sleep(10 * time.Microsecond)
 	rp.pwm.dmac = RPI_PWM_DMAC_ENAB | rpiPwmDmacPanic(7) | rpiPwmDmacDreq(3)
-	time.Sleep(10 * time.Microsecond)
+	rp.sleep(10 * time.Microsecond)
 	rp.pwm.ctl = RPI_PWM_CTL_USEF1 | RPI_PWM_CTL_MODE1 | RPI_PWM_CTL_USEF2 | RPI_PWM_CTL_MODE2
-	time.Sleep(10 * time.Microsecond)
+	rp.sleep(10 * time.Microsecond)
 	rp.pwm.ctl |= RPI_PWM_CTL_PWEN1 | RPI_PWM_CTL_PWEN2
 
 	// Initialize the DMA control block
@@ -152,11 +152,11 @@ func (rp *RPi) InitPWM(freq uint, buf *DMABuf, bytes uint, pins []int) error {
 func (rp *RPi) StopPWM() {
 	// Turn off the PWM in case already running
 	rp.pwm.ctl = 0
-	time.Sleep(10 * time.Microsecond)
+	rp.sleep(10 * time.Microsecond)
 
 	// Kill the clock if it was already running
 	rp.cmClk.ctl = CM_CLK_CTL_PASSWD | CM_CLK_CTL_KILL
-	time.Sleep(10 * time.Microsecond)
+	rp.sleep(10 * time.Microsecond)
 	log.Printf("Waiting for cmClk not-busy\n")
 	i := 0
 	for (rp.cmClk.ctl & CM_CLK_CTL_BUSY) != 0 {
@@ -6,12 +6,16 @@ import (
 	"fmt"
 	mmap "github.com/edsrzf/mmap-go"
 	"os"
+	"time"
 )
 
 type RPi struct {
-	mbox     *os.File
+	mbox     mailbox
 	mboxSize uint32
 	hw       *hw
+	mem      memory
+	// sleep waits between register writes that the hardware needs time to act on
+	sleep    func(time.Duration)
 	dmaBuf   mmap.MMap
 	dma      *dmaT
 	pwmBuf   mmap.MMap
@@ -28,7 +32,9 @@ func NewRPi() (*RPi, error) {
 		return nil, fmt.Errorf("couldn't detect RPi hardware: %v", err)
 	}
 	rp := RPi{
-		hw: hw,
+		hw:    hw,
+		mem:   devMem{},
+		sleep: time.Sleep,
 	}
 	err = rp.mboxOpen()
 	if err != nil {
@@ -37,6 +43,34 @@ func NewRPi() (*RPi, error) {
 	return &rp, nil
 }
 
+// Close unmaps all peripheral registers and closes the mailbox. The RPi can't be used afterwards.
+// Any DMA buffers must already have been freed.
+func (rp *RPi) Close() error {
+	var err error
+	for _, b := range []*mmap.MMap{&rp.dmaBuf, &rp.pwmBuf, &rp.gpioBuf, &rp.cmClkBuf} {
+		if *b == nil {
+			continue
+		}
+		te := rp.mem.unmap(*b)
+		*b = nil
+		if err == nil {
+			err = te
+		}
+	}
+	rp.dma = nil
+	rp.pwm = nil
+	rp.gpio = nil
+	rp.cmClk = nil
+	if rp.mbox != nil {
+		te := rp.mboxClose()
+		rp.mbox = nil
+		if err == nil {
+			err = te
+		}
+	}
+	return err
+}
+
 type hw struct {
 	hwType     int
 	periphBase uintptr
@@ -0,0 +1,281 @@
+package rpi
+
+import (
+	"fmt"
+	mmap "github.com/edsrzf/mmap-go"
+	"reflect"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// fakePi stands in for a Pi's peripherals with plain memory and a mailbox that answers messages
+// itself. Each time the code under test sleeps, fakePi snapshots the registers, then acts on them
+// like the hardware would: the clock goes busy once it's enabled, and DMA finishes.
+type fakePi struct {
+	rp     *RPi
+	pages  map[uintptr]mmap.MMap
+	maps   []uintptr  // The physical addresses mapped, in order
+	msgs   [][]uint32 // The mailbox messages received, in order
+	handle uint32
+	closed bool
+	snaps  []snapshot
+}
+
+type snapshot struct {
+	pwm   pwmT
+	cmClk cmClkT
+	dma   dmaT
+	gpio  gpioT
+}
+
+// newFakePi returns an RPi for the hardware revision rev, with fakePi's peripherals.
+func newFakePi(t *testing.T, rev uint32) *fakePi {
+	hw, ok := rasPiVariants[rev]
+	if !ok {
+		t.Fatalf("Unknown revision %X", rev)
+	}
+	f := &fakePi{pages: map[uintptr]mmap.MMap{}}
+	f.rp = &RPi{hw: &hw, mem: f, mbox: f, sleep: f.sleep}
+	return f
+}
+
+func (f *fakePi) mapMem(physAddr uintptr, size int) (mmap.MMap, uintptr, error) {
+	f.maps = append(f.maps, physAddr)
+	page := physAddr &^ (PAGE_SIZE - 1)
+	offs := physAddr - page
+	// Mapping the same page again gets the same memory, as it would from /dev/mem
+	m, ok := f.pages[page]
+	if !ok {
+		m = make(mmap.MMap, (int(offs)+size+PAGE_SIZE-1)&^(PAGE_SIZE-1))
+		f.pages[page] = m
+	}
+	if len(m) < int(offs)+size {
+		return nil, 0, fmt.Errorf("mapping at %08X grew to %d bytes", physAddr, size)
+	}
+	return m, offs, nil
+}
+
+func (f *fakePi) unmap(m mmap.MMap) error {
+	return nil
+}
+
+func (f *fakePi) property(buf []uint32) error {
+	f.msgs = append(f.msgs, append([]uint32(nil), buf[:buf[0]/4]...))
+	buf[4] |= 0x80000000
+	switch buf[2] {
+	case 0x3000c: // Allocate
+		f.handle++
+		buf[5] = f.handle
+	case 0x3000d: // Lock, giving each handle its own megabyte
+		buf[5] = uint32(f.rp.hw.vcBase) | (0x08000000 + f.handle<<20)
+	default:
+		buf[5] = 0
+	}
+	return nil
+}
+
+func (f *fakePi) close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *fakePi) sleep(d time.Duration) {
+	var s snapshot
+	if f.rp.pwm != nil {
+		s.pwm = *f.rp.pwm
+	}
+	if f.rp.cmClk != nil {
+		s.cmClk = *f.rp.cmClk
+		if f.rp.cmClk.ctl&CM_CLK_CTL_ENAB != 0 {
+			f.rp.cmClk.ctl |= CM_CLK_CTL_BUSY
+		}
+	}
+	if f.rp.dma != nil {
+		s.dma = *f.rp.dma
+		if f.rp.dma.cs&RPI_DMA_CS_ACTIVE != 0 {
+			f.rp.dma.cs = f.rp.dma.cs&^RPI_DMA_CS_ACTIVE | RPI_DMA_CS_END
+		}
+	}
+	if f.rp.gpio != nil {
+		s.gpio = *f.rp.gpio
+	}
+	f.snaps = append(f.snaps, s)
+}
+
+func TestInitPWM(t *testing.T) {
+	tests := []struct {
+		name  string
+		rev   uint32
+		base  uintptr
+		div   uint32
+		flags uint32
+	}{
+		// 19.2MHz or 54MHz clock divided down to three ticks per 800kHz bit
+		{"Pi 1", 0x0e, PERIPH_BASE_RPI, 8, 0xc},
+		{"Pi 2", 0xA01041, PERIPH_BASE_RPI2, 8, 0x4}, // BCM2836
+		{"Pi 3", 0xA02082, PERIPH_BASE_RPI2, 8, 0x4},
+		{"Pi 4", 0xC03111, PERIPH_BASE_RPI4, 22, 0x4},
+	}
+	for _, tc := range tests {
+		f := newFakePi(t, tc.rev)
+		rp := f.rp
+		if err := rp.InitGPIO(); err != nil {
+			t.Fatalf("%s: couldn't init GPIO: %v", tc.name, err)
+		}
+		if err := rp.InitDMA(10); err != nil {
+			t.Fatalf("%s: couldn't init DMA: %v", tc.name, err)
+		}
+		buf, err := rp.GetDMABuf(1024)
+		if err != nil {
+			t.Fatalf("%s: couldn't get DMA buffer: %v", tc.name, err)
+		}
+		busAddr := uint32(rp.hw.vcBase) | 0x08100000
+		if err := rp.InitPWM(800000, buf, 1024, []int{18, 13}); err != nil {
+			t.Fatalf("%s: couldn't init PWM: %v", tc.name, err)
+		}
+
+		wantMaps := []uintptr{tc.base + 0x200000, tc.base + 0x7a00, 0x08100000, tc.base + 0x20c000, tc.base + 0x1010a0}
+		if !reflect.DeepEqual(f.maps, wantMaps) {
+			t.Errorf("%s: wrong memory mapped, got: %X, want: %X", tc.name, f.maps, wantMaps)
+		}
+		wantMsgs := [][]uint32{
+			{36, 0, 0x3000c, 12, 0, 4096, PAGE_SIZE, tc.flags, 0},
+			{28, 0, 0x3000d, 4, 0, 1, 0},
+		}
+		if !reflect.DeepEqual(f.msgs, wantMsgs) {
+			t.Errorf("%s: wrong mailbox messages, got: %X, want: %X", tc.name, f.msgs, wantMsgs)
+		}
+
+		// Pin 18 is alt 5 (function 2) and pin 13 alt 0 (function 4), both in the second fsel
+		if got, want := rp.gpio.fsel[1], uint32(2<<24|4<<9); got != want {
+			t.Errorf("%s: wrong fsel, got: %08X, want: %08X", tc.name, got, want)
+		}
+
+		if got, want := rp.cmClk.div, CM_CLK_DIV_PASSWD|tc.div<<12; got != want {
+			t.Errorf("%s: wrong clock divisor, got: %08X, want: %08X", tc.name, got, want)
+		}
+		// The clock killed, then started, and each PWM control change given time to settle
+		wantClk := []uint32{0, CM_CLK_CTL_PASSWD | CM_CLK_CTL_KILL, CM_CLK_CTL_PASSWD | CM_CLK_CTL_SRC_OSC | CM_CLK_CTL_ENAB}
+		modes := uint32(RPI_PWM_CTL_USEF1 | RPI_PWM_CTL_MODE1 | RPI_PWM_CTL_USEF2 | RPI_PWM_CTL_MODE2)
+		wantCtl := []uint32{0, 0, 0, 0, RPI_PWM_CTL_CLRF1, RPI_PWM_CTL_CLRF1, modes}
+		if len(f.snaps) != len(wantCtl) {
+			t.Fatalf("%s: wrong number of sleeps, got: %d, want: %d", tc.name, len(f.snaps), len(wantCtl))
+		}
+		for i, s := range f.snaps {
+			if i < len(wantClk) && s.cmClk.ctl != wantClk[i] {
+				t.Errorf("%s: wrong clock control at sleep %d, got: %08X, want: %08X", tc.name, i, s.cmClk.ctl, wantClk[i])
+			}
+			if s.pwm.ctl != wantCtl[i] {
+				t.Errorf("%s: wrong PWM control at sleep %d, got: %08X, want: %08X", tc.name, i, s.pwm.ctl, wantCtl[i])
+			}
+		}
+		if got, want := rp.pwm.ctl, modes|RPI_PWM_CTL_PWEN1|RPI_PWM_CTL_PWEN2; got != want {
+			t.Errorf("%s: wrong final PWM control, got: %08X, want: %08X", tc.name, got, want)
+		}
+		if rp.pwm.rng1 != 32 {
+			t.Errorf("%s: wrong PWM range, got: %d, want: 32", tc.name, rp.pwm.rng1)
+		}
+		if got, want := rp.pwm.dmac, RPI_PWM_DMAC_ENAB|7<<8|3; got != want {
+			t.Errorf("%s: wrong PWM DMA config, got: %08X, want: %08X", tc.name, got, want)
+		}
+
+		wantC := dmaControl{
+			ti:       RPI_DMA_TI_NO_WIDE_BURSTS | RPI_DMA_TI_WAIT_RESP | RPI_DMA_TI_DEST_DREQ | 5<<16 | RPI_DMA_TI_SRC_INC,
+			sourceAd: busAddr + uint32(unsafe.Sizeof(dmaControl{})),
+			destAd:   0x7e20c018, // PWM FIFO
+			txLen:    1024,
+		}
+		if *buf.c != wantC {
+			t.Errorf("%s: wrong DMA control block, got: %+v, want: %+v", tc.name, *buf.c, wantC)
+		}
+	}
+}
+
+func TestDMA(t *testing.T) {
+	f := newFakePi(t, 0xA02082)
+	rp := f.rp
+	if err := rp.InitDMA(5); err != nil {
+		t.Fatalf("Couldn't init DMA: %v", err)
+	}
+	buf, err := rp.GetDMABuf(100)
+	if err != nil {
+		t.Fatalf("Couldn't get DMA buffer: %v", err)
+	}
+	rp.StartDMA(buf)
+	if len(f.snaps) != 2 || f.snaps[0].dma.cs != RPI_DMA_CS_RESET || f.snaps[1].dma.cs != RPI_DMA_CS_INT|RPI_DMA_CS_END {
+		t.Errorf("DMA not reset before starting, got: %+v", f.snaps)
+	}
+	want := uint32(RPI_DMA_CS_WAIT_OUTSTANDING_WRITES | 15<<20 | 15<<16 | RPI_DMA_CS_ACTIVE)
+	if rp.dma.cs != want || rp.dma.conblkAd != 0xc8100000 || rp.dma.debug != 7 {
+		t.Errorf("Wrong DMA registers after start, got: cs %08X, conblkAd %08X, debug %d", rp.dma.cs, rp.dma.conblkAd, rp.dma.debug)
+	}
+	if err := rp.WaitForDMAEnd(); err != nil {
+		t.Errorf("Error waiting for DMA: %v", err)
+	}
+	rp.dma.cs |= RPI_DMA_CS_ERROR
+	if err := rp.WaitForDMAEnd(); err == nil {
+		t.Errorf("No error waiting for failed DMA")
+	}
+
+	if err := rp.FreeDMABuf(buf); err != nil {
+		t.Errorf("Couldn't free DMA buffer: %v", err)
+	}
+	if err := rp.Close(); err != nil {
+		t.Errorf("Couldn't close: %v", err)
+	}
+	wantTags := []uint32{0x3000c, 0x3000d, 0x3000e, 0x3000f}
+	if len(f.msgs) != len(wantTags) {
+		t.Fatalf("Wrong number of mailbox messages, got: %d, want: %d", len(f.msgs), len(wantTags))
+	}
+	for i, m := range f.msgs {
+		if m[2] != wantTags[i] {
+			t.Errorf("Wrong mailbox message %d, got tag %X, want: %X", i, m[2], wantTags[i])
+		}
+	}
+	if !f.closed || rp.dma != nil {
+		t.Errorf("Not closed")
+	}
+}
+
+func TestGPIO(t *testing.T) {
+	f := newFakePi(t, 0x0e)
+	rp := f.rp
+	if err := rp.InitGPIO(); err != nil {
+		t.Fatalf("Couldn't init GPIO: %v", err)
+	}
+	rp.gpio.fsel[0] = 0x7 << 12
+	if err := rp.GPIOSetOutput(4, PullUp); err != nil {
+		t.Fatalf("Couldn't set output: %v", err)
+	}
+	if got, want := rp.gpio.fsel[0], uint32(1<<12); got != want {
+		t.Errorf("Wrong fsel for output, got: %08X, want: %08X", got, want)
+	}
+	// The pull mode, then the clock for the pin, each given time to settle, then both cleared
+	if len(f.snaps) != 2 || f.snaps[0].gpio.pud != PullUp || f.snaps[1].gpio.pudclk[0] != 1<<4 {
+		t.Errorf("Wrong pull-up sequence, got: %+v", f.snaps)
+	}
+	if rp.gpio.pud != 0 || rp.gpio.pudclk[0] != 0 {
+		t.Errorf("Pull-up registers not cleared, got: %d, %08X", rp.gpio.pud, rp.gpio.pudclk[0])
+	}
+	if err := rp.GPIOSetOutput(4, PullUp+1); err == nil {
+		t.Errorf("Bad pull mode accepted")
+	}
+
+	if err := rp.GPIOSetPin(35, true); err != nil || rp.gpio.set[1] != 1<<3 {
+		t.Errorf("Wrong set, got: %v, %08X", err, rp.gpio.set[1])
+	}
+	if err := rp.GPIOSetPin(35, false); err != nil || rp.gpio.clr[1] != 1<<3 {
+		t.Errorf("Wrong clear, got: %v, %08X", err, rp.gpio.clr[1])
+	}
+	rp.gpio.lev[0] = 1 << 4
+	if v, err := rp.GPIOGetPin(4); err != nil || !v {
+		t.Errorf("Wrong level, got: %v, %v", v, err)
+	}
+	if v, err := rp.GPIOGetPin(5); err != nil || v {
+		t.Errorf("Wrong level, got: %v, %v", v, err)
+	}
+	if err := rp.GPIOSetPin(pinMax+1, true); err == nil {
+		t.Errorf("Bad pin accepted")
+	}
+}
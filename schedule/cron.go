@@ -0,0 +1,140 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Cron is a parsed five-field cron expression: minute, hour, day of month, month and day of week.
+// Each field may be *, a number, a range (a-b), a list (a,b,c), or any of those with a step (*/5,
+// 0-30/10). A number with a step runs from that number to the end of the field's range, so 5/10
+// in the minute field is 5, 15, 25, 35, 45 and 55. Days of the week run from 0 (Sunday) to 7 (also Sunday). As with cron itself, if both
+// day of month and day of week are restricted, a day matching either is enough.
+type Cron struct {
+	minute  [60]bool
+	hour    [24]bool
+	dom     [32]bool
+	month   [13]bool
+	dow     [7]bool
+	domStar bool
+	dowStar bool
+	expr    string
+}
+
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCronField parses one field of a cron expression, calling set for each value it covers.
+func parseCronField(s string, f cronField, set func(int)) error {
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		i := strings.Index(part, "/")
+		if i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return fmt.Errorf("invalid step in %s field '%s'", f.name, s)
+			}
+			part = part[:i]
+		}
+		lo, hi := f.min, f.max
+		if part != "*" {
+			r := strings.SplitN(part, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(r[0])
+			if err != nil {
+				return fmt.Errorf("invalid %s field '%s'", f.name, s)
+			}
+			hi = lo
+			if i >= 0 {
+				// A step on a single number runs to the end of the range
+				hi = f.max
+			}
+			if len(r) == 2 {
+				hi, err = strconv.Atoi(r[1])
+				if err != nil {
+					return fmt.Errorf("invalid %s field '%s'", f.name, s)
+				}
+			}
+			if lo < f.min || hi > f.max || lo > hi {
+				return fmt.Errorf("%s field '%s' out of range %d-%d", f.name, s, f.min, f.max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set(v)
+		}
+	}
+	return nil
+}
+
+func ParseCron(expr string) (*Cron, error) {
+	t := strings.Fields(expr)
+	if len(t) != 5 {
+		return nil, fmt.Errorf("cron expression '%s' has %d fields, want 5", expr, len(t))
+	}
+	c := Cron{expr: strings.Join(t, " ")}
+	sets := []func(int){
+		func(v int) { c.minute[v] = true },
+		func(v int) { c.hour[v] = true },
+		func(v int) { c.dom[v] = true },
+		func(v int) { c.month[v] = true },
+		func(v int) { c.dow[v%7] = true },
+	}
+	for i, f := range cronFields {
+		err := parseCronField(t[i], f, sets[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.domStar = t[2] == "*"
+	c.dowStar = t[4] == "*"
+	return &c, nil
+}
+
+func (c *Cron) String() string {
+	return c.expr
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time strictly after after that matches c, or the zero time if there's
+// none in the next five years (e.g. for 31st February).
+func (c *Cron) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !c.month[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,363 @@
+// Package schedule runs commands at times given by cron expressions or relative to sunrise and
+// sunset.
+package schedule
+
+import (
+	"bufio"
+	"fmt"
+	clock "github.com/Jon-Bright/ledctl/clock"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sunNone = iota
+	sunRise
+	sunSet
+)
+
+// A Rule runs Command whenever When comes round. When is either a five-field cron expression or
+// @sunrise or @sunset, optionally followed by an offset such as +30m or -1h15m.
+type Rule struct {
+	ID      int
+	When    string
+	Command string
+	cron    *Cron
+	sun     int
+	offset  time.Duration
+}
+
+// parseWhen parses a rule's When, filling in how the rule should be evaluated.
+func (r *Rule) parseWhen() error {
+	if !strings.HasPrefix(r.When, "@") {
+		c, err := ParseCron(r.When)
+		if err != nil {
+			return err
+		}
+		r.cron = c
+		r.When = c.String()
+		return nil
+	}
+	w := strings.ToLower(r.When)
+	i := strings.IndexAny(w, "+-")
+	ev := w
+	if i >= 0 {
+		ev = w[:i]
+		var err error
+		r.offset, err = time.ParseDuration(w[i:])
+		if err != nil {
+			return fmt.Errorf("invalid offset in '%s': %v", r.When, err)
+		}
+	}
+	switch ev {
+	case "@sunrise":
+		r.sun = sunRise
+	case "@sunset":
+		r.sun = sunSet
+	default:
+		return fmt.Errorf("unknown event '%s', want @sunrise or @sunset", ev)
+	}
+	r.When = w
+	return nil
+}
+
+// A Scheduler holds a set of Rules, runs their commands at the right times, and saves them to a
+// file whenever they change.
+type Scheduler struct {
+	mu     sync.Mutex
+	rules  []*Rule
+	nextID int
+	lat    float64
+	long   float64
+	path   string
+	run    func(cmd string)
+	clock  clock.Clock
+	wake   chan bool
+	quit   chan chan bool
+}
+
+// NewScheduler creates a Scheduler that calls run for each command that comes due. lat and long
+// give the location for sunrise and sunset rules, and may be NaN if those aren't wanted. If path
+// isn't empty, rules are loaded from it (if it exists) and saved to it on every change. Rules come
+// due by clk.
+func NewScheduler(path string, lat, long float64, run func(cmd string), clk clock.Clock) (*Scheduler, error) {
+	s := Scheduler{
+		nextID: 1,
+		lat:    lat,
+		long:   long,
+		path:   path,
+		run:    run,
+		clock:  clk,
+		wake:   make(chan bool, 1),
+		quit:   make(chan chan bool),
+	}
+	if path == "" {
+		return &s, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open schedule: %v", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	n := 0
+	for sc.Scan() {
+		n++
+		l := sc.Text()
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		t := strings.SplitN(l, "\t", 3)
+		if len(t) != 3 {
+			return nil, fmt.Errorf("%s line %d: want <id>\\t<when>\\t<command>", path, n)
+		}
+		id, err := strconv.Atoi(t[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid ID: %v", path, n, err)
+		}
+		r := Rule{ID: id, When: t[1], Command: t[2]}
+		err = s.check(&r)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, n, err)
+		}
+		s.rules = append(s.rules, &r)
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read schedule: %v", err)
+	}
+	return &s, nil
+}
+
+// check parses a Rule's When and checks that the Scheduler can evaluate it.
+func (s *Scheduler) check(r *Rule) error {
+	err := r.parseWhen()
+	if err != nil {
+		return err
+	}
+	if r.sun != sunNone && (math.IsNaN(s.lat) || math.IsNaN(s.long)) {
+		return fmt.Errorf("'%s' needs a latitude and longitude to be configured", r.When)
+	}
+	if strings.TrimSpace(r.Command) == "" {
+		return fmt.Errorf("rule has no command")
+	}
+	return nil
+}
+
+// save writes the rules to the Scheduler's file, if it has one. s.mu must be held.
+func (s *Scheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("couldn't create %s: %v", tmp, err)
+	}
+	w := bufio.NewWriter(f)
+	for _, r := range s.rules {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", r.ID, r.When, r.Command)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close() // Ignore error, we already have one
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't write %s: %v", tmp, err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// poke wakes Run up so that it notices changed rules.
+func (s *Scheduler) poke() {
+	select {
+	case s.wake <- true:
+	default:
+		// Already poked
+	}
+}
+
+// Add adds a rule running command at when, returning the new rule.
+func (s *Scheduler) Add(when, command string) (Rule, error) {
+	r := Rule{When: strings.TrimSpace(when), Command: strings.TrimSpace(command)}
+	err := s.check(&r)
+	if err != nil {
+		return Rule{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.ID = s.nextID
+	s.nextID++
+	s.rules = append(s.rules, &r)
+	err = s.save()
+	if err != nil {
+		return Rule{}, fmt.Errorf("couldn't save schedule: %v", err)
+	}
+	s.poke()
+	return r, nil
+}
+
+// Delete removes the rule with the given ID.
+func (s *Scheduler) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.rules {
+		if r.ID == id {
+			s.rules = append(s.rules[:i], s.rules[i+1:]...)
+			err := s.save()
+			if err != nil {
+				return fmt.Errorf("couldn't save schedule: %v", err)
+			}
+			s.poke()
+			return nil
+		}
+	}
+	return fmt.Errorf("no rule with ID %d", id)
+}
+
+// Reconfigure changes the Scheduler's file and location. If path names an existing file, rules
+// are loaded from it, replacing the current ones. Otherwise, the current rules are kept, and
+// saved to path if it isn't empty. Nothing changes if any rule can't be evaluated with the new
+// location.
+func (s *Scheduler) Reconfigure(path string, lat, long float64) error {
+	_, err := os.Stat(path)
+	keep := path == "" || os.IsNotExist(err)
+	n, err := NewScheduler(path, lat, long, s.run, s.clock)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if keep {
+		for _, r := range s.rules {
+			rc := *r
+			err = n.check(&rc)
+			if err != nil {
+				return fmt.Errorf("rule %d: %v", r.ID, err)
+			}
+			n.rules = append(n.rules, &rc)
+		}
+		n.nextID = s.nextID
+		// Save before changing anything, so that a failure leaves the scheduler as it was
+		err = n.save()
+		if err != nil {
+			return fmt.Errorf("couldn't save schedule: %v", err)
+		}
+	}
+	s.rules = n.rules
+	s.nextID = n.nextID
+	s.lat = lat
+	s.long = long
+	s.path = path
+	s.poke()
+	return nil
+}
+
+// Rules returns a copy of all rules, sorted by ID.
+func (s *Scheduler) Rules() []Rule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs := make([]Rule, len(s.rules))
+	for i, r := range s.rules {
+		rs[i] = *r
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].ID < rs[j].ID })
+	return rs
+}
+
+// Next returns the first time strictly after after at which r should run, or the zero time if
+// there's no such time.
+func (s *Scheduler) Next(r *Rule, after time.Time) time.Time {
+	if r.cron != nil {
+		return r.cron.Next(after)
+	}
+	// Look at the days around after until we find an event that's after it. A few days covers
+	// large offsets and places where the sun doesn't rise or set on some days; anything more
+	// (polar winter) we'll find when we look again tomorrow.
+	for d := -1; d < 3; d++ {
+		rise, set, ok := SunTimes(after.AddDate(0, 0, d), s.lat, s.long)
+		if !ok {
+			continue
+		}
+		t := rise
+		if r.sun == sunSet {
+			t = set
+		}
+		t = t.Add(r.offset).In(after.Location())
+		if t.After(after) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Run runs due commands until Stop is called.
+func (s *Scheduler) Run() {
+	last := s.clock.Now()
+	for {
+		// Find the next rule(s) to run
+		s.mu.Lock()
+		var next time.Time
+		var due []string
+		for _, r := range s.rules {
+			t := s.Next(r, last)
+			if t.IsZero() {
+				continue
+			}
+			if next.IsZero() || t.Before(next) {
+				next = t
+				due = []string{r.Command}
+			} else if t.Equal(next) {
+				due = append(due, r.Command)
+			}
+		}
+		s.mu.Unlock()
+
+		wait := 24 * time.Hour // Nothing to do, but check again later, e.g. for polar sunrises
+		if !next.IsZero() {
+			wait = next.Sub(s.clock.Now())
+		}
+		wc, wt := s.clock.NewTimer(wait)
+		select {
+		case <-s.wake:
+			// Rules changed, start again from now
+			wt.Stop()
+			last = s.clock.Now()
+			continue
+		case done := <-s.quit:
+			wt.Stop()
+			close(done)
+			return
+		case <-wc:
+		}
+		if next.IsZero() {
+			last = s.clock.Now()
+			continue
+		}
+		for _, cmd := range due {
+			log.Printf("Scheduled at %v: %s", next, cmd)
+			s.run(cmd)
+		}
+		last = next
+	}
+}
+
+// Stop stops Run, returning once no more commands will be run. Run must be running.
+func (s *Scheduler) Stop() {
+	done := make(chan bool)
+	s.quit <- done
+	<-done
+}
@@ -0,0 +1,244 @@
+package schedule
+
+import (
+	clock "github.com/Jon-Bright/ledctl/clock"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tm(s string, tb testing.TB) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+	if err != nil {
+		tb.Fatalf("Couldn't parse time %s: %v", s, err)
+	}
+	return t
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr  string
+		after string
+		want  string
+	}{
+		{"30 23 * * *", "2024-03-01 12:00", "2024-03-01 23:30"},
+		{"30 23 * * *", "2024-03-01 23:30", "2024-03-02 23:30"},
+		{"*/15 * * * *", "2024-03-01 12:07", "2024-03-01 12:15"},
+		{"0 9-17/4 * * *", "2024-03-01 13:01", "2024-03-01 17:00"},
+		{"5/10 * * * *", "2024-03-01 12:07", "2024-03-01 12:15"},
+		{"5/10 * * * *", "2024-03-01 12:56", "2024-03-01 13:05"},
+		{"0 7 * * 1-5", "2024-03-01 08:00", "2024-03-04 07:00"}, // Friday -> Monday
+		{"0 7 * * 0", "2024-03-01 08:00", "2024-03-03 07:00"},
+		{"0 7 * * 7", "2024-03-01 08:00", "2024-03-03 07:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 1,15 * *", "2024-03-02 00:00", "2024-03-15 00:00"},
+		// Both day fields restricted: either matches
+		{"0 0 13 * 5", "2024-03-02 00:00", "2024-03-08 00:00"},
+		{"0 0 31 12 *", "2024-03-02 00:00", "2024-12-31 00:00"},
+	}
+
+	for _, test := range tests {
+		c, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("Couldn't parse %s: %v", test.expr, err)
+			continue
+		}
+		if got := c.Next(tm(test.after, t)); !got.Equal(tm(test.want, t)) {
+			t.Errorf("%s after %s, got: %v, want: %s", test.expr, test.after, got, test.want)
+		}
+	}
+
+	c, err := ParseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatalf("Couldn't parse 31st February: %v", err)
+	}
+	if got := c.Next(tm("2024-03-01 00:00", t)); !got.IsZero() {
+		t.Errorf("31st February came round at %v", got)
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("Parsed invalid cron expression '%s' without error", expr)
+		}
+	}
+}
+
+func TestSunTimes(t *testing.T) {
+	tests := []struct {
+		date string
+		lat  float64
+		long float64
+		rise string
+		set  string
+	}{
+		// London, midsummer
+		{"2021-06-21 00:00", 51.5074, -0.1278, "2021-06-21 03:43", "2021-06-21 20:21"},
+		// Sydney, midwinter
+		{"2021-06-21 00:00", -33.8688, 151.2093, "2021-06-20 20:59", "2021-06-21 06:54"},
+	}
+
+	for _, test := range tests {
+		rise, set, ok := SunTimes(tm(test.date, t), test.lat, test.long)
+		if !ok {
+			t.Errorf("No sunrise/sunset for %f,%f on %s", test.lat, test.long, test.date)
+			continue
+		}
+		if d := rise.Sub(tm(test.rise, t)); d < -2*time.Minute || d > 2*time.Minute {
+			t.Errorf("Sunrise at %f,%f on %s, got: %v, want: %s", test.lat, test.long, test.date, rise, test.rise)
+		}
+		if d := set.Sub(tm(test.set, t)); d < -2*time.Minute || d > 2*time.Minute {
+			t.Errorf("Sunset at %f,%f on %s, got: %v, want: %s", test.lat, test.long, test.date, set, test.set)
+		}
+	}
+
+	// Tromsø at midsummer: midnight sun
+	if _, _, ok := SunTimes(tm("2021-06-21 00:00", t), 69.6492, 18.9553); ok {
+		t.Errorf("Got a sunrise in Tromsø at midsummer")
+	}
+}
+
+func TestSchedulerPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schedule")
+
+	s, err := NewScheduler(path, 51.5074, -0.1278, nil, clock.Real)
+	if err != nil {
+		t.Fatalf("Couldn't create scheduler: %v", err)
+	}
+	if _, err := s.Add("@SUNSET-30m", "RAINBOW 60"); err != nil {
+		t.Errorf("Couldn't add sunset rule: %v", err)
+	}
+	r, err := s.Add("30 23 * * *", "OFF")
+	if err != nil {
+		t.Errorf("Couldn't add cron rule: %v", err)
+	}
+	if _, err := s.Add("@sunset", "RAINBOW 60"); err != nil {
+		t.Errorf("Couldn't add sunset rule: %v", err)
+	}
+	if err := s.Delete(3); err != nil {
+		t.Errorf("Couldn't delete rule: %v", err)
+	}
+	if err := s.Delete(3); err == nil {
+		t.Errorf("Deleted rule twice without error")
+	}
+	for _, w := range []string{"@noon", "@sunrise+tea", "* * *"} {
+		if _, err := s.Add(w, "OFF"); err == nil {
+			t.Errorf("Added invalid rule '%s' without error", w)
+		}
+	}
+
+	s, err = NewScheduler(path, 51.5074, -0.1278, nil, clock.Real)
+	if err != nil {
+		t.Fatalf("Couldn't reload scheduler: %v", err)
+	}
+	rs := s.Rules()
+	if len(rs) != 2 {
+		t.Fatalf("Wrong number of rules after reload, got: %d, want: 2", len(rs))
+	}
+	if rs[0].When != "@sunset-30m" || rs[0].Command != "RAINBOW 60" || rs[1].ID != r.ID || rs[1].When != "30 23 * * *" {
+		t.Errorf("Wrong rules after reload: %+v", rs)
+	}
+	if got := s.Next(&rs[1], tm("2024-03-01 12:00", t)); !got.Equal(tm("2024-03-01 23:30", t)) {
+		t.Errorf("Wrong next time for reloaded rule: %v", got)
+	}
+	// IDs carry on from the highest one saved
+	if r, err := s.Add("0 0 * * *", "OFF"); err != nil || r.ID != 3 {
+		t.Errorf("Wrong ID for new rule after reload, got: %d (%v), want: 3", r.ID, err)
+	}
+
+	// Without a location, sun rules aren't allowed
+	if _, err := NewScheduler(path, math.NaN(), math.NaN(), nil, clock.Real); err == nil {
+		t.Errorf("Loaded sunset rule without a location")
+	}
+	if err := s.Reconfigure("", math.NaN(), math.NaN()); err == nil {
+		t.Errorf("Reconfigured sunset rule without a location")
+	}
+
+	// Moving to a new file keeps the rules and saves them there
+	path2 := filepath.Join(dir, "schedule2")
+	if err := s.Reconfigure(path2, 40.7128, -74.0060); err != nil {
+		t.Fatalf("Couldn't reconfigure scheduler: %v", err)
+	}
+	if len(s.Rules()) != 3 {
+		t.Errorf("Wrong number of rules after reconfigure, got: %d, want: 3", len(s.Rules()))
+	}
+	s, err = NewScheduler(path2, 40.7128, -74.0060, nil, clock.Real)
+	if err != nil {
+		t.Fatalf("Couldn't load reconfigured scheduler: %v", err)
+	}
+	if len(s.Rules()) != 3 {
+		t.Errorf("Wrong number of rules saved by reconfigure, got: %d, want: 3", len(s.Rules()))
+	}
+
+	// Moving back to an existing file loads its rules
+	if _, err := s.Add("0 1 * * *", "OFF"); err != nil {
+		t.Errorf("Couldn't add cron rule: %v", err)
+	}
+	if err := s.Reconfigure(path, 40.7128, -74.0060); err != nil {
+		t.Fatalf("Couldn't reconfigure scheduler: %v", err)
+	}
+	if len(s.Rules()) != 3 {
+		t.Errorf("Wrong number of rules after reconfigure to existing file, got: %d, want: 3", len(s.Rules()))
+	}
+}
+
+func TestStop(t *testing.T) {
+	s, err := NewScheduler("", math.NaN(), math.NaN(), func(string) {}, clock.Real)
+	if err != nil {
+		t.Fatalf("Couldn't create scheduler: %v", err)
+	}
+	stopped := make(chan bool)
+	go func() {
+		s.Run()
+		close(stopped)
+	}()
+	s.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("Run didn't return after Stop")
+	}
+}
+
+func TestRunFakeClock(t *testing.T) {
+	fc := clock.NewFake(tm("2024-03-01 12:10", t))
+	var ran []string
+	s, err := NewScheduler("", math.NaN(), math.NaN(), func(cmd string) {
+		ran = append(ran, fc.Now().Format("15:04")+" "+cmd)
+	}, fc)
+	if err != nil {
+		t.Fatalf("Couldn't create scheduler: %v", err)
+	}
+	if _, err := s.Add("0 * * * *", "RAINBOW 60"); err != nil {
+		t.Fatalf("Couldn't add rule: %v", err)
+	}
+	if _, err := s.Add("30 12 * * *", "OFF"); err != nil {
+		t.Fatalf("Couldn't add rule: %v", err)
+	}
+	go s.Run()
+	// A whole day, one rule at a time
+	for fc.Now().Before(tm("2024-03-02 12:00", t)) {
+		fc.BlockUntil(1)
+		fc.Next()
+	}
+	fc.BlockUntil(1) // The last rule has run
+	s.Stop()
+	if len(ran) != 25 {
+		t.Fatalf("Wrong number of rules run, got: %d, want: 25: %v", len(ran), ran)
+	}
+	for i, want := range []string{"12:30 OFF", "13:00 RAINBOW 60", "14:00 RAINBOW 60"} {
+		if ran[i] != want {
+			t.Errorf("Wrong rule run at %d, got: '%s', want: '%s'", i, ran[i], want)
+		}
+	}
+	if got := ran[len(ran)-1]; got != "12:00 RAINBOW 60" {
+		t.Errorf("Wrong last rule run, got: '%s'", got)
+	}
+}
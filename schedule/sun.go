@@ -0,0 +1,51 @@
+package schedule
+
+import (
+	"math"
+	"time"
+)
+
+// Sunrise and sunset times, from the sunrise equation as given at
+// https://en.wikipedia.org/wiki/Sunrise_equation - accurate to within a minute or two, which is
+// plenty for turning lights on and off.
+
+const (
+	julianUnixEpoch = 2440587.5 // Julian date of 1970-01-01 00:00 UTC
+	julian2000      = 2451545.0 // Julian date of 2000-01-01 12:00 UTC
+)
+
+func sinDeg(d float64) float64 {
+	return math.Sin(d * math.Pi / 180.0)
+}
+
+func cosDeg(d float64) float64 {
+	return math.Cos(d * math.Pi / 180.0)
+}
+
+func julianToTime(j float64) time.Time {
+	secs := (j - julianUnixEpoch) * 86400.0
+	return time.Unix(0, int64(secs*1e9)).UTC()
+}
+
+// SunTimes returns the times of sunrise and sunset at the given latitude and longitude (in degrees,
+// north and east positive) on the day whose solar noon is nearest to noon UTC on the given date.
+// ok is false if the sun doesn't rise or set on that day (polar day or night).
+func SunTimes(date time.Time, lat, long float64) (rise, set time.Time, ok bool) {
+	y, m, d := date.Date()
+	noon := time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	n := math.Floor(float64(noon.Unix())/86400.0 + julianUnixEpoch - julian2000 + 0.5)
+
+	jStar := n - long/360.0
+	ma := math.Mod(357.5291+0.98560028*jStar, 360.0)
+	c := 1.9148*sinDeg(ma) + 0.0200*sinDeg(2*ma) + 0.0003*sinDeg(3*ma)
+	lambda := math.Mod(ma+c+180.0+102.9372, 360.0)
+	transit := julian2000 + jStar + 0.0053*sinDeg(ma) - 0.0069*sinDeg(2*lambda)
+	sinDecl := sinDeg(lambda) * sinDeg(23.4397)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+	cosHour := (sinDeg(-0.833) - sinDeg(lat)*sinDecl) / (cosDeg(lat) * cosDecl)
+	if cosHour < -1.0 || cosHour > 1.0 {
+		return time.Time{}, time.Time{}, false
+	}
+	hour := math.Acos(cosHour) * 180.0 / math.Pi
+	return julianToTime(transit - hour/360.0), julianToTime(transit + hour/360.0), true
+}
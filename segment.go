@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	effects "github.com/Jon-Bright/ledctl/effects"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	rpi "github.com/Jon-Bright/ledctl/rpi"
+	"time"
+)
+
+// segmentLeds is an LEDStrip showing just one segment of a PixArray, so that an effect can run on
+// a segment as though it were the whole strip.
+type segmentLeds struct {
+	pa    *pixarray.PixArray
+	start int
+}
+
+func (sl *segmentLeds) RPi() *rpi.RPi {
+	return sl.pa.RPi()
+}
+
+func (sl *segmentLeds) MaxPerChannel() int {
+	return sl.pa.MaxPerChannel()
+}
+
+func (sl *segmentLeds) GetPixel(i int) pixarray.Pixel {
+	return sl.pa.GetPixel(sl.start + i)
+}
+
+func (sl *segmentLeds) SetPixel(i int, p pixarray.Pixel) {
+	sl.pa.SetOne(sl.start+i, p)
+}
+
+func (sl *segmentLeds) Write() error {
+	return sl.pa.Write()
+}
+
+func (sl *segmentLeds) Close() error {
+	// The segment doesn't own the hardware, the PixArray it's part of does
+	return nil
+}
+
+// segmentEffect runs an effect on one segment, leaving the rest of the strip as it is.
+type segmentEffect struct {
+	e  effects.Effect
+	pa *pixarray.PixArray
+}
+
+func (se *segmentEffect) Start(pa *pixarray.PixArray, now time.Time) {
+	se.e.Start(se.pa, now)
+}
+
+func (se *segmentEffect) NextStep(pa *pixarray.PixArray, now time.Time) time.Duration {
+	return se.e.NextStep(se.pa, now)
+}
+
+func (se *segmentEffect) Name() string {
+	return se.e.Name()
+}
+
+// lookupSegment returns the segment with the given name.
+func lookupSegment(name string) (SegmentConfig, error) {
+	for _, sg := range getSegments() {
+		if sg.Name == name {
+			return sg, nil
+		}
+	}
+	return SegmentConfig{}, fmt.Errorf("no segment named '%s'", name)
+}
+
+// onSegment returns e restricted to the segment named by a segment= option, or e unchanged if
+// there's no such option.
+func (s *Server) onSegment(e effects.Effect, o map[string]string) (effects.Effect, error) {
+	name, ok := o["segment"]
+	if !ok {
+		return e, nil
+	}
+	sg, err := lookupSegment(name)
+	if err != nil {
+		return nil, err
+	}
+	if sg.Start+sg.Length > s.pa.NumPixels() {
+		return nil, fmt.Errorf("segment '%s' doesn't fit in %d pixels", name, s.pa.NumPixels())
+	}
+	sl := &segmentLeds{pa: s.pa, start: sg.Start}
+	return &segmentEffect{e: e, pa: pixarray.NewPixArray(sg.Length, s.pa.NumColors(), sl)}, nil
+}
@@ -4,45 +4,114 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	clock "github.com/Jon-Bright/ledctl/clock"
 	effects "github.com/Jon-Bright/ledctl/effects"
 	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	schedule "github.com/Jon-Bright/ledctl/schedule"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-var lpd8806Dev = flag.String("dev", "/dev/spidev0.0", "The SPI device on which LPD8806 LEDs are connected")
+var lpd8806Dev = flag.String("dev", "/dev/spidev0.0", "The SPI device on which LPD8806 LEDs, or WS281x LEDs driven over SPI, are connected")
 var lpd8806SpiSpeed = flag.Uint("spispeed", 1000000, "The speed to send data via SPI to LPD8806s, in Hz")
 var ws281xFreq = flag.Uint("ws281xfreq", 800000, "The frequency to send data to WS2801x devices, in Hz")
 var ws281xDma = flag.Int("ws281xdma", 10, "The DMA channel to use for sending data to WS281x devices")
 var ws281xPin0 = flag.Int("ws281xpin0", 18, "The pin on which channel 0 should be output for WS281x devices")
 var ws281xPin1 = flag.Int("ws281xpin1", 13, "The pin on which channel 1 should be output for WS281x devices")
-var ledChip = flag.String("ledchip", "ws281x", "The type of LED strip to drive: one of ws281x, lpd8806")
+var ws281xSpiBits = flag.Int("ws281xspibits", 3, "The number of SPI bits (3 or 4) sent for each bit to WS281x devices driven over SPI")
+var brightness = flag.Float64("brightness", 1, "The most any channel is driven, as a fraction of its maximum, e.g. 0.5 to limit power draw")
+var gamma = flag.Float64("gamma", 1, "The gamma correction applied to colours sent to the LEDs. 1 sends them as given, around 2.2 makes fades look even")
+var ledChip = flag.String("ledchip", "ws281x", "The type of LED strip to drive: one of ws281x, ws281xspi (WS281x driven over SPI), lpd8806, or sim for simulated LEDs without a Raspberry Pi")
 var port = flag.Int("port", 24601, "The port that the server should listen to")
 var pixels = flag.Int("pixels", 5*32, "The number of pixels to be controlled")
 var pixelOrder = flag.String("order", "GRB", "The color ordering of the pixels")
+var scheduleFile = flag.String("schedule", "", "A file in which to save scheduled rules, so they survive restarts. Empty means rules aren't saved")
+var latitude = flag.Float64("latitude", math.NaN(), "The latitude, in degrees north, used to work out sunrise and sunset times for scheduled rules")
+var longitude = flag.Float64("longitude", math.NaN(), "The longitude, in degrees east, used to work out sunrise and sunset times for scheduled rules")
+var shutdownFade = flag.Duration("shutdownfade", 0, "How long to fade the LEDs to black for when shutting down. 0 leaves them as they are")
+var paletteFile = flag.String("palettes", "", "A file of palette definitions to load at startup, one per line")
+var layoutShape = flag.String("layout", "linear", "How the pixels are arranged, for previews: linear, matrix or ring")
+var layoutWidth = flag.Int("layoutwidth", 40, "The number of pixels per row in previews: the matrix width, or where a linear strip wraps")
+var serpentine = flag.Bool("serpentine", false, "Whether every other row of a matrix runs right to left")
+var preview = flag.Bool("preview", false, "Whether to show the LEDs in the terminal (on stdout), using 24-bit colour")
+var previewFPS = flag.Float64("previewfps", 25, "The maximum frame rate for --preview. 0 means no maximum")
 
 type Server struct {
-	pa      *pixarray.PixArray
-	l       net.Listener
-	c       chan effects.Effect
+	pa *pixarray.PixArray
+	// clock is what effects, alarms and the scheduler are timed by
+	clock clock.Clock
+	lMu   sync.Mutex
+	// l holds the listeners by kind: "tcp", "unix" or, for sockets from systemd, "fd<n>"
+	l         map[string]net.Listener
+	activated bool
+	c         chan effects.Effect
+	quit      chan chan bool
+	ping      chan chan bool
+	// stateMu protects laste, lastCmd, off and running, which runEffects and connections both use,
+	// and keeps writes to the state file in order
+	stateMu sync.Mutex
 	laste   effects.Effect
+	lastCmd string
 	off     bool
 	running bool
+	powered bool
+	events  eventHub
+	authMu  sync.Mutex
+	auth    *authConfig
+	// reloadMu stops a SIGHUP and a RELOAD command reloading at the same time
+	reloadMu sync.Mutex
+	alarmMu  sync.Mutex
+	alarm    clock.Timer
+	alarmAt  time.Time
+	sched    *schedule.Scheduler
+	web      *http.Server
+	recMu    sync.Mutex
+	rec      *pixarray.Recorder
+	recFile  *os.File
+	recName  string
 }
 
-func NewServer(port int, pa *pixarray.PixArray) (*Server, error) {
+func NewServer(lc ListenConfig, pa *pixarray.PixArray, clk clock.Clock) (*Server, error) {
 
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	a, err := loadAuth(lc.TokenFile, lc.Users)
 	if err != nil {
 		return nil, err
 	}
+	ls, err := activatedListeners(lc)
+	if err != nil {
+		return nil, err
+	}
+	activated := len(ls) > 0
+	if !activated {
+		ls = map[string]net.Listener{}
+		ls["tcp"], err = newListener(lc)
+		if err != nil {
+			return nil, err
+		}
+		if lc.Unix != "" {
+			ls["unix"], err = unixListener(lc)
+			if err != nil {
+				ls["tcp"].Close() // Ignore error
+				return nil, err
+			}
+		}
+	}
+	for _, l := range ls {
+		log.Printf("Listening on %s", l.Addr())
+	}
 	c := make(chan effects.Effect)
-	log.Printf("Listening on port %d", port)
-	return &Server{pa, l, c, nil, true, false}, nil
+	return &Server{pa: pa, clock: clk, l: ls, activated: activated, c: c, quit: make(chan chan bool), ping: make(chan chan bool), off: true, auth: a}, nil
 }
 
 func parseDuration(parms string) (string, time.Duration, error) {
@@ -57,17 +126,212 @@ func parseDuration(parms string) (string, time.Duration, error) {
 	return t[1], d, nil
 }
 
+// parsePositiveDuration is parseDuration for durations that effects divide by, e.g. a period,
+// where zero or negative durations make no sense.
+func parsePositiveDuration(parms string) (string, time.Duration, error) {
+	parms, d, err := parseDuration(parms)
+	if err != nil {
+		return "", 0, err
+	}
+	if d <= 0 {
+		return "", 0, fmt.Errorf("duration %v must be positive", d)
+	}
+	return parms, d, nil
+}
+
+// parseOptions parses any remaining parameters as space-separated key=value options. Only keys
+// listed in allowed are accepted. Keys are case-insensitive and returned in lower case.
+func parseOptions(parms string, allowed ...string) (map[string]string, error) {
+	o := map[string]string{}
+	for _, t := range strings.Fields(parms) {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("option '%s' isn't key=value", t)
+		}
+		k := strings.ToLower(kv[0])
+		ok := false
+		for _, a := range allowed {
+			if k == a {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown option '%s'", kv[0])
+		}
+		o[k] = kv[1]
+	}
+	return o, nil
+}
+
+// parseEase returns the Easing requested by an ease= option, or nil for the default (linear)
+// easing.
+func parseEase(o map[string]string) (effects.Easing, error) {
+	e, ok := o["ease"]
+	if !ok {
+		return nil, nil
+	}
+	return effects.ParseEasing(e)
+}
+
+// parseSpace returns the colour space requested by a space= option, defaulting to RGB.
+func parseSpace(o map[string]string) (int, error) {
+	sp, ok := o["space"]
+	if !ok {
+		return effects.SpaceRGB, nil
+	}
+	space, ok := effects.StringColorSpaces[strings.ToUpper(sp)]
+	if !ok {
+		return 0, fmt.Errorf("unknown colour space '%s'", sp)
+	}
+	return space, nil
+}
+
+// parsePalette returns the palette named by a palette= option, or nil if none was given.
+func parsePalette(o map[string]string) (*effects.Palette, error) {
+	n, ok := o["palette"]
+	if !ok {
+		return nil, nil
+	}
+	p, ok := effects.LookupPalette(n)
+	if !ok {
+		return nil, fmt.Errorf("unknown palette '%s'", n)
+	}
+	return p, nil
+}
+
+// parseWheel parses the options for effects that move round a colour wheel: either a space= or a
+// palette= option, but not both.
+func parseWheel(parms string) (int, *effects.Palette, error) {
+	o, err := parseOptions(parms, "space", "palette")
+	if err != nil {
+		return 0, nil, fmt.Errorf("error parsing options: %v", err)
+	}
+	space, err := parseSpace(o)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error parsing space: %v", err)
+	}
+	p, err := parsePalette(o)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error parsing palette: %v", err)
+	}
+	if p != nil && space != effects.SpaceRGB {
+		return 0, nil, fmt.Errorf("only one of space and palette may be given")
+	}
+	return space, p, nil
+}
+
+// nextWallClock returns the next time after now that a clock will show hhmm (e.g. "06:30").
+func nextWallClock(now time.Time, hhmm string) (time.Time, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next, nil
+}
+
+// setAlarm arranges for e, created by the command line l, to start at the given time, replacing
+// any alarm already set.
+func (s *Server) setAlarm(at time.Time, e effects.Effect, l string) {
+	s.alarmMu.Lock()
+	defer s.alarmMu.Unlock()
+	if s.alarm != nil {
+		s.alarm.Stop()
+	}
+	log.Printf("Setting alarm for %s at %v", e.Name(), at)
+	s.alarmAt = at
+	var tm clock.Timer
+	tm = s.clock.AfterFunc(at.Sub(s.clock.Now()), func() {
+		s.alarmMu.Lock()
+		if s.alarm != tm {
+			// Cancelled or replaced after firing, but before we got the lock
+			s.alarmMu.Unlock()
+			return
+		}
+		s.alarm = nil
+		s.alarmMu.Unlock()
+		log.Printf("Alarm for %s", e.Name())
+		s.startEffect(e, l)
+	})
+	s.alarm = tm
+}
+
+// createSun creates a SUNRISE or SUNSET. If an at= option is given, it's set as an alarm instead
+// of being returned.
+func (s *Server) createSun(cmd, parms string) (effects.Effect, error) {
+	e, d, t, err := s.parseSun(cmd, parms)
+	if err != nil || t.IsZero() {
+		return e, err
+	}
+	s.setAlarm(t, e, fmt.Sprintf("%s %s", cmd, strconv.FormatFloat(d.Seconds(), 'f', -1, 64)))
+	return nil, nil
+}
+
+// parseSun parses the parameters of SUNRISE or SUNSET, returning the effect, its duration and, if
+// at= was given, when it should start.
+func (s *Server) parseSun(cmd, parms string) (effects.Effect, time.Duration, time.Time, error) {
+	parms, d, err := parsePositiveDuration(parms)
+	if err != nil {
+		return nil, 0, time.Time{}, fmt.Errorf("error parsing duration: %v", err)
+	}
+	o, err := parseOptions(parms, "at")
+	if err != nil {
+		return nil, 0, time.Time{}, fmt.Errorf("error parsing options: %v", err)
+	}
+	var e effects.Effect
+	if cmd == "SUNRISE" {
+		e = effects.NewSunrise(d)
+	} else {
+		e = effects.NewSunset(d)
+	}
+	at, ok := o["at"]
+	if !ok {
+		return e, d, time.Time{}, nil
+	}
+	t, err := nextWallClock(s.clock.Now(), at)
+	if err != nil {
+		return nil, 0, time.Time{}, fmt.Errorf("error parsing time: %v", err)
+	}
+	return e, d, t, nil
+}
+
+// isRawHex returns whether c is a colour given as hex in the LEDs' own channel depth.
+func isRawHex(c string) bool {
+	if len(c) != 6 && len(c) != 8 {
+		return false
+	}
+	_, err := strconv.ParseUint(c, 16, 32)
+	return err == nil
+}
+
+// parseColor parses the colour at the start of parms, returning the rest of parms. The colour is
+// either hex in the LEDs' own channel depth, or anything pixarray.ParseColor accepts.
 func (s *Server) parseColor(parms string) (string, *pixarray.Pixel, error) {
 	t := strings.SplitN(parms, " ", 2)
 	var p pixarray.Pixel
-	n, err := fmt.Sscanf(t[0], "%02X%02X%02X%02X", &p.R, &p.G, &p.B, &p.W)
-	if err != nil && err != io.EOF {
-		return "", nil, err
-	}
-	if n != s.pa.NumColors() {
-		return "", nil, fmt.Errorf("only %d tokens parsed from '%s', wanted %d", n, t[0], s.pa.NumColors())
-	}
 	max := s.pa.MaxPerChannel()
+	if isRawHex(t[0]) {
+		n, err := fmt.Sscanf(t[0], "%02X%02X%02X%02X", &p.R, &p.G, &p.B, &p.W)
+		if err != nil && err != io.EOF {
+			return "", nil, err
+		}
+		if n != s.pa.NumColors() {
+			return "", nil, fmt.Errorf("only %d tokens parsed from '%s', wanted %d", n, t[0], s.pa.NumColors())
+		}
+	} else {
+		var err error
+		p, err = pixarray.ParseColor(t[0], max)
+		if err != nil {
+			return "", nil, err
+		}
+		if p.W > 0 && s.pa.NumColors() < 4 {
+			return "", nil, fmt.Errorf("'%s' has white, but the LEDs don't", t[0])
+		}
+	}
 	if p.R > max || p.G > max || p.B > max || p.W > max {
 		return "", nil, fmt.Errorf("invalid color: one or more of %d, %d, %d, %d is >%d, parsed from %s", p.R, p.G, p.B, p.W, max, t[0])
 	}
@@ -84,33 +348,230 @@ func (s *Server) createEffect(cmd, parms string, w *bufio.Writer) (effects.Effec
 		if err != nil {
 			return nil, fmt.Errorf("error parsing color: %v", err)
 		}
-		_, d, err := parseDuration(parms)
+		parms, d, err := parseDuration(parms)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing duration: %v", err)
 		}
-		return effects.NewFade(d, *p), nil
+		o, err := parseOptions(parms, "ease", "space", "segment")
+		if err != nil {
+			return nil, fmt.Errorf("error parsing options: %v", err)
+		}
+		e, err := parseEase(o)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ease: %v", err)
+		}
+		space, err := parseSpace(o)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing space: %v", err)
+		}
+		return s.onSegment(effects.NewColorFade(d, *p, e, space), o)
 	case cmd == "ZIP_SET_ALL":
 		parms, p, err := s.parseColor(parms)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing color: %v", err)
 		}
-		_, d, err := parseDuration(parms)
+		parms, d, err := parseDuration(parms)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing duration: %v", err)
 		}
-		return effects.NewZip(d, *p), nil
+		o, err := parseOptions(parms, "ease", "segment")
+		if err != nil {
+			return nil, fmt.Errorf("error parsing options: %v", err)
+		}
+		e, err := parseEase(o)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ease: %v", err)
+		}
+		return s.onSegment(effects.NewEasedZip(d, *p, e), o)
 	case cmd == "CYCLE":
-		_, d, err := parseDuration(parms)
+		parms, d, err := parseDuration(parms)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing duration: %v", err)
 		}
-		return effects.NewCycle(d), nil
+		space, p, err := parseWheel(parms)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			return effects.NewPaletteCycle(d, p), nil
+		}
+		return effects.NewColorCycle(d, space), nil
 	case cmd == "RAINBOW":
-		_, d, err := parseDuration(parms)
+		parms, d, err := parseDuration(parms)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing duration: %v", err)
 		}
-		return effects.NewRainbow(d), nil
+		space, p, err := parseWheel(parms)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			return effects.NewPaletteRainbow(d, p), nil
+		}
+		return effects.NewColorRainbow(d, space), nil
+	case cmd == "TWINKLE":
+		parms, d, err := parsePositiveDuration(parms)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing duration: %v", err)
+		}
+		o, err := parseOptions(parms, "palette", "density")
+		if err != nil {
+			return nil, fmt.Errorf("error parsing options: %v", err)
+		}
+		p, err := parsePalette(o)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing palette: %v", err)
+		}
+		if p == nil {
+			p, _ = effects.LookupPalette("party")
+		}
+		density := 0.1
+		if ds, ok := o["density"]; ok {
+			density, err = strconv.ParseFloat(ds, 64)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing density: %v", err)
+			}
+			if density <= 0.0 || density > 1.0 {
+				return nil, fmt.Errorf("density %f must be >0.0 and <=1.0", density)
+			}
+		}
+		return effects.NewTwinkle(d, p, density), nil
+	case cmd == "PALETTE":
+		t := strings.SplitN(parms, " ", 2)
+		switch strings.ToUpper(t[0]) {
+		case "LIST":
+			for _, p := range effects.Palettes() {
+				w.WriteString(p.String() + "\n")
+			}
+		case "DEFINE":
+			if len(t) < 2 {
+				return nil, fmt.Errorf("PALETTE DEFINE needs a palette definition")
+			}
+			p, err := effects.ParsePalette(t[1])
+			if err != nil {
+				return nil, fmt.Errorf("error parsing palette: %v", err)
+			}
+			effects.DefinePalette(p)
+			log.Printf("Defined palette %s", p)
+		default:
+			return nil, fmt.Errorf("unknown PALETTE subcommand '%s'", t[0])
+		}
+		w.WriteString("OK\n")
+		err := w.Flush()
+		return nil, err
+	case cmd == "BREATHE":
+		parms, low, err := s.parseColor(parms)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing low color: %v", err)
+		}
+		parms, high, err := s.parseColor(parms)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing high color: %v", err)
+		}
+		parms, d, err := parsePositiveDuration(parms)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing duration: %v", err)
+		}
+		wave := effects.WaveSine
+		duty := 1.0
+		if parms != "" {
+			t := strings.SplitN(parms, " ", 2)
+			var ok bool
+			wave, ok = effects.StringWaveforms[strings.ToUpper(t[0])]
+			if !ok {
+				return nil, fmt.Errorf("unknown waveform '%s'", t[0])
+			}
+			if len(t) > 1 {
+				duty, err = strconv.ParseFloat(t[1], 64)
+				if err != nil {
+					return nil, fmt.Errorf("error parsing duty cycle: %v", err)
+				}
+				if duty <= 0.0 || duty > 1.0 {
+					return nil, fmt.Errorf("duty cycle %f must be >0.0 and <=1.0", duty)
+				}
+			}
+		}
+		return effects.NewBreathe(d, *low, *high, wave, duty), nil
+	case cmd == "SUNRISE" || cmd == "SUNSET":
+		e, err := s.createSun(cmd, parms)
+		if err != nil || e != nil {
+			return e, err
+		}
+		// Scheduled for later
+		w.WriteString("OK\n")
+		err = w.Flush()
+		return nil, err
+	case cmd == "ALARM":
+		s.alarmMu.Lock()
+		defer s.alarmMu.Unlock()
+		switch {
+		case parms == "":
+			r := "NONE\n"
+			if s.alarm != nil {
+				r = s.alarmAt.Format("2006-01-02 15:04") + "\n"
+			}
+			w.WriteString(r)
+		case strings.ToUpper(parms) == "CANCEL":
+			if s.alarm != nil {
+				s.alarm.Stop()
+				s.alarm = nil
+				log.Printf("Alarm cancelled")
+			}
+			w.WriteString("OK\n")
+		default:
+			return nil, fmt.Errorf("unknown ALARM subcommand '%s'", parms)
+		}
+		err := w.Flush()
+		return nil, err
+	case cmd == "SCHEDULE":
+		t := strings.SplitN(parms, " ", 2)
+		switch strings.ToUpper(t[0]) {
+		case "ADD":
+			if len(t) < 2 {
+				return nil, fmt.Errorf("SCHEDULE ADD needs a time and a command")
+			}
+			// The time is either @sunrise/@sunset with an optional offset, or five cron fields
+			n := 5
+			if strings.HasPrefix(t[1], "@") {
+				n = 1
+			}
+			f := strings.Fields(t[1])
+			if len(f) <= n {
+				return nil, fmt.Errorf("SCHEDULE ADD needs a time and a command")
+			}
+			err := s.checkScheduled(strings.Join(f[n:], " "))
+			if err != nil {
+				return nil, fmt.Errorf("error adding rule: %v", err)
+			}
+			r, err := s.sched.Add(strings.Join(f[:n], " "), strings.Join(f[n:], " "))
+			if err != nil {
+				return nil, fmt.Errorf("error adding rule: %v", err)
+			}
+			log.Printf("Added rule %d: %s %s", r.ID, r.When, r.Command)
+			w.WriteString(fmt.Sprintf("%d\n", r.ID))
+		case "LIST":
+			for _, r := range s.sched.Rules() {
+				w.WriteString(fmt.Sprintf("%d %s %s\n", r.ID, r.When, r.Command))
+			}
+			w.WriteString("OK\n")
+		case "DEL":
+			if len(t) < 2 {
+				return nil, fmt.Errorf("SCHEDULE DEL needs a rule ID")
+			}
+			id, err := strconv.Atoi(strings.TrimSpace(t[1]))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing rule ID: %v", err)
+			}
+			err = s.sched.Delete(id)
+			if err != nil {
+				return nil, fmt.Errorf("error deleting rule: %v", err)
+			}
+			w.WriteString("OK\n")
+		default:
+			return nil, fmt.Errorf("unknown SCHEDULE subcommand '%s'", t[0])
+		}
+		err := w.Flush()
+		return nil, err
 	case cmd == "GET":
 		for _, p := range s.pa.GetPixels() {
 			if p.R != 0 || p.G != 0 || p.B != 0 {
@@ -122,6 +583,27 @@ func (s *Server) createEffect(cmd, parms string, w *bufio.Writer) (effects.Effec
 		w.WriteString("0\n")
 		err := w.Flush()
 		return nil, err
+	case cmd == "RELOAD":
+		applied, restart, err := s.reload()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range applied {
+			w.WriteString("APPLIED " + a + "\n")
+		}
+		for _, r := range restart {
+			w.WriteString("RESTART " + r + "\n")
+		}
+		w.WriteString("OK\n")
+		err = w.Flush()
+		return nil, err
+	case cmd == "SEGMENTS":
+		for _, sg := range getSegments() {
+			w.WriteString(fmt.Sprintf("%s %d %d\n", sg.Name, sg.Start, sg.Length))
+		}
+		w.WriteString("OK\n")
+		err := w.Flush()
+		return nil, err
 	case cmd == "COLOUR" || cmd == "COLOR":
 		p := s.pa.GetPixels()[0]
 		c := p.String() + "\n"
@@ -130,14 +612,9 @@ func (s *Server) createEffect(cmd, parms string, w *bufio.Writer) (effects.Effec
 		err := w.Flush()
 		return nil, err
 	case cmd == "MODE":
-		n := "CONST"
-		if s.off {
-			n = "OFF"
-		} else if s.running {
-			if s.laste == nil {
-				return nil, fmt.Errorf("s running, but laste nil!")
-			}
-			n = s.laste.Name()
+		n, err := s.mode()
+		if err != nil {
+			return nil, err
 		}
 		log.Printf("Mode '%s'", n)
 		if parms == "" {
@@ -152,16 +629,32 @@ func (s *Server) createEffect(cmd, parms string, w *bufio.Writer) (effects.Effec
 		}
 		log.Printf("Returning %s", r)
 		w.WriteString(r)
-		err := w.Flush()
+		err = w.Flush()
 		return nil, err
 	case cmd == "ON":
+		s.stateMu.Lock()
+		defer s.stateMu.Unlock()
 		return s.laste, nil
 	case cmd == "OFF":
+		fb, err := parseOff(parms)
+		if err != nil {
+			return nil, err
+		}
 		// Hack: we insert this directly into the channel because we don't want to overwrite whatever the last effect was
-		fb := effects.NewFade(20*time.Second, pixarray.Pixel{R: 0, G: 0, B: 0, W: 0})
+		s.stateMu.Lock()
+		if !s.off {
+			s.events.publish("OFF")
+		}
 		s.off = true
+		s.checkMode()
+		s.stateMu.Unlock()
 		s.c <- fb
+		s.saveState(false)
 		return nil, nil
+	case cmd == "RECORD":
+		return nil, s.record(parms, w)
+	case cmd == "PLAYBACK":
+		return createPlayback(parms)
 	case cmd == "KNIGHTRIDER":
 		_, d, err := parseDuration(parms)
 		if err != nil {
@@ -169,7 +662,45 @@ func (s *Server) createEffect(cmd, parms string, w *bufio.Writer) (effects.Effec
 		}
 		return effects.NewKnightRider(d, s.pa.NumPixels()/4), nil
 	}
-	return nil, fmt.Errorf("unknown command: %s", cmd)
+	return nil, unknownCommandError{cmd}
+}
+
+// parseOff parses OFF's parameters, returning the fade to black it starts.
+func parseOff(parms string) (effects.Effect, error) {
+	o, err := parseOptions(parms, "ease")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing options: %v", err)
+	}
+	e, err := parseEase(o)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ease: %v", err)
+	}
+	return effects.NewEasedFade(20*time.Second, pixarray.Pixel{R: 0, G: 0, B: 0, W: 0}, e), nil
+}
+
+// checkScheduled checks that the command line l can be scheduled, and parses, without running it.
+// Only commands that change the LEDs can be scheduled: anything else would have its reply thrown
+// away.
+func (s *Server) checkScheduled(l string) error {
+	t := strings.SplitN(strings.TrimSpace(l), " ", 2)
+	cmd := strings.ToUpper(t[0])
+	parms := ""
+	if len(t) > 1 {
+		parms = t[1]
+	}
+	var err error
+	switch cmd {
+	case "FADE_ALL", "ZIP_SET_ALL", "CYCLE", "RAINBOW", "TWINKLE", "BREATHE", "KNIGHTRIDER", "PLAYBACK", "ON":
+		// These only create an effect, which isn't started here
+		_, err = s.createEffect(cmd, parms, bufio.NewWriter(ioutil.Discard))
+	case "SUNRISE", "SUNSET":
+		_, _, _, err = s.parseSun(cmd, parms)
+	case "OFF":
+		_, err = parseOff(parms)
+	default:
+		err = fmt.Errorf("%s can't be scheduled", cmd)
+	}
+	return err
 }
 
 func (s *Server) runEffects() {
@@ -177,16 +708,29 @@ func (s *Server) runEffects() {
 	var d time.Duration
 	var steps int
 	var start time.Time
+	var writeErr string
+	var wait <-chan time.Time
+	var waitTimer clock.Timer
 	for {
-		if d == 0 {
-			e = <-s.c
-		} else {
-			select {
-			case e = <-s.c:
-				break
-			case <-time.After(d):
-				break
+		select {
+		case e = <-s.c:
+			break
+		case <-wait:
+			break
+		case p := <-s.ping:
+			// The watchdog checking that we're still running, the current step is still due as before
+			close(p)
+			continue
+		case done := <-s.quit:
+			log.Printf("Stopping effects")
+			s.stateMu.Lock()
+			s.running = false
+			s.stateMu.Unlock()
+			if waitTimer != nil {
+				waitTimer.Stop()
 			}
+			close(done)
+			return
 		}
 		if e == nil {
 			log.Fatalf("Ready to process effect, but no effect!")
@@ -196,21 +740,41 @@ func (s *Server) runEffects() {
 			if err != nil {
 				log.Fatalf("Failed power-on: %v", err)
 			}
-			start = time.Now()
+			if !s.powered && *powerCtrlPin >= 0 {
+				s.events.publish("POWER ON")
+			}
+			s.powered = true
+			start = s.clock.Now()
 			e.Start(s.pa, start)
-			s.running = true
 			steps = 0
+			s.events.publish("EFFECT_STARTED %s", e.Name())
+			s.stateMu.Lock()
+			s.running = true
+			s.checkMode()
+			s.stateMu.Unlock()
 		}
-		d = e.NextStep(s.pa, time.Now())
+		d = e.NextStep(s.pa, s.clock.Now())
 		steps++
-		s.pa.Write()
+		err := s.pa.Write()
+		if err != nil && err.Error() != writeErr {
+			// Only once per error, rather than once per step
+			s.events.publish("ERROR writing to LEDs: %v", err)
+		}
+		writeErr = ""
+		if err != nil {
+			writeErr = err.Error()
+		}
 		if d == 0 {
-			d := time.Since(start)
+			d := s.clock.Now().Sub(start)
 			ps := time.Duration(d.Nanoseconds() / int64(steps))
 			log.Printf("Finished effect, %d steps, %s total, %s/step", steps, d, ps)
+			s.events.publish("EFFECT_FINISHED %s", e.Name())
 			laste = nil
 			e = nil
+			s.stateMu.Lock()
 			s.running = false
+			s.stateMu.Unlock()
+			s.saveState(false)
 			p := s.pa.GetPixels()[0]
 			log.Printf("Seeing post-effect pix %v", p)
 			if p.R <= 0 && p.G <= 0 && p.B <= 0 && p.W <= 0 {
@@ -218,10 +782,64 @@ func (s *Server) runEffects() {
 				if err != nil {
 					log.Fatalf("Failed power-off: %v", err)
 				}
+				if s.powered && *powerCtrlPin >= 0 {
+					s.events.publish("POWER OFF")
+				}
+				s.powered = false
 			}
+			s.stateMu.Lock()
+			s.checkMode()
+			s.stateMu.Unlock()
 		} else {
 			laste = e
 		}
+		if waitTimer != nil {
+			// A new effect may have come before the last step was due
+			waitTimer.Stop()
+		}
+		wait, waitTimer = nil, nil
+		if d != 0 {
+			wait, waitTimer = s.clock.NewTimer(d)
+		}
+	}
+}
+
+// startEffect hands e, created by the command line l, to runEffects and makes it the effect that
+// ON resumes.
+func (s *Server) startEffect(e effects.Effect, l string) {
+	s.stateMu.Lock()
+	if e != s.laste {
+		// Not just ON resuming the last effect
+		s.laste = e
+		s.lastCmd = l
+	}
+	if s.off {
+		s.events.publish("ON")
+	}
+	s.off = false
+	s.stateMu.Unlock()
+	// runEffects publishes the new mode once it's started e. Publishing it here could announce
+	// CONST for the moment before it does.
+	s.c <- e
+	s.saveState(true)
+}
+
+// runScheduled runs a command from the scheduler, as though it had come from a connection. Any
+// reply it writes is discarded.
+func (s *Server) runScheduled(l string) {
+	t := strings.SplitN(strings.TrimSpace(l), " ", 2)
+	cmd := strings.ToUpper(t[0])
+	parms := ""
+	if len(t) > 1 {
+		parms = t[1]
+	}
+	e, err := s.createEffect(cmd, parms, bufio.NewWriter(ioutil.Discard))
+	if err != nil {
+		log.Printf("Error creating scheduled effect '%s': %v", l, err)
+		return
+	}
+	if e != nil {
+		s.startEffect(e, l)
 	}
 }
 
@@ -230,6 +848,9 @@ func (s *Server) handleConnection(c net.Conn) {
 	defer c.Close()
 	r := bufio.NewReader(c)
 	w := bufio.NewWriter(c)
+	version := 1
+	role := s.getAuth().initialRole()
+	authFailures := 0
 	for {
 		l, err := r.ReadString('\n')
 		if err == io.EOF {
@@ -241,20 +862,68 @@ func (s *Server) handleConnection(c net.Conn) {
 			return
 		}
 		l = strings.TrimSpace(l)
-		log.Printf("Got line '%s'", l)
+		id := ""
+		if version >= 2 {
+			id, l = splitRequestID(l)
+		}
 		t := strings.SplitN(l, " ", 2)
 		cmd := strings.ToUpper(t[0])
 		parms := ""
 		if len(t) > 1 {
 			parms = t[1]
 		}
+		if cmd == "AUTH" {
+			log.Printf("Got line 'AUTH ...'") // Without the password
+		} else {
+			log.Printf("Got line '%s'", l)
+		}
 		if cmd == "QUIT" {
 			return
 		}
-		e, err := s.createEffect(cmd, parms, w)
+		if cmd == "SUBSCRIBE" && allowed(role, cmd, parms) {
+			s.subscribe(r, w, version, id)
+			return
+		}
+		var e effects.Effect
+		switch {
+		case cmd == "PROTOCOL":
+			version, err = parseProtocol(parms, version, id, w)
+		case cmd == "AUTH":
+			role, err = s.authenticate(parms, role, version, id, w)
+			if err != nil {
+				authFailures++
+			}
+		case !allowed(role, cmd, parms):
+			err = checkAllowed(role, cmd, parms)
+		case version >= 2:
+			err = s.runV2(cmd, parms, l, id, w)
+			if err != nil {
+				log.Printf("error writing reply: %v", err)
+			}
+			continue
+		default:
+			e, err = s.createEffect(cmd, parms, w)
+		}
+		if err != nil && version >= 2 {
+			// Only a failed PROTOCOL or AUTH or a forbidden command gets here, runV2 replies to its
+			// own errors
+			log.Printf("Error running '%s': %v", l, err)
+			s.events.publish("ERROR %v", err)
+			writeV2(w, id, nil, statusFor(err), err.Error())
+			err = w.Flush()
+			if err != nil {
+				log.Printf("error writing error reply: %v", err)
+			}
+			if authFailures >= maxAuthFailures {
+				log.Printf("Closing connection %v after %d failed AUTHs", c.RemoteAddr(), authFailures)
+				return
+			}
+			continue
+		}
 		if err != nil {
 			es := fmt.Sprintf("Error creating effect: %v", err)
 			log.Print(es)
+			s.events.publish("ERROR %v", err)
 			w.WriteString("ERR: " + es + "\n")
 			err = w.Flush()
 			if err != nil {
@@ -270,17 +939,52 @@ func (s *Server) handleConnection(c net.Conn) {
 			if err != nil {
 				log.Printf("error writing reply: %v", err)
 			}
-			s.c <- e
-			s.laste = e
-			s.off = false
+			s.startEffect(e, l)
 		}
 	}
 }
 
-func (s *Server) handleConnections() {
+// serve accepts connections on all of the server's listeners.
+func (s *Server) serve() {
+	s.lMu.Lock()
+	defer s.lMu.Unlock()
+	for k, l := range s.l {
+		go s.handleConnections(k, l)
+	}
+}
+
+// listen replaces the server's listener of the given kind with l, which may be nil to just close
+// the old one. Connections already accepted carry on.
+func (s *Server) listen(kind string, l net.Listener) error {
+	s.lMu.Lock()
+	old := s.l[kind]
+	if l != nil {
+		log.Printf("Listening on %s", l.Addr())
+		if s.l == nil {
+			s.l = map[string]net.Listener{}
+		}
+		s.l[kind] = l
+		go s.handleConnections(kind, l)
+	} else {
+		delete(s.l, kind)
+	}
+	s.lMu.Unlock()
+	if old == nil {
+		return nil
+	}
+	return old.Close()
+}
+
+func (s *Server) handleConnections(kind string, l net.Listener) {
 	for {
-		conn, err := s.l.Accept()
+		conn, err := l.Accept()
 		if err != nil {
+			s.lMu.Lock()
+			replaced := s.l[kind] != l
+			s.lMu.Unlock()
+			if replaced {
+				return
+			}
 			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
@@ -288,11 +992,162 @@ func (s *Server) handleConnections() {
 	}
 }
 
+// closeListeners stops accepting new connections.
+func (s *Server) closeListeners() {
+	s.lMu.Lock()
+	ls := s.l
+	s.l = nil
+	s.lMu.Unlock()
+	for _, l := range ls {
+		err := l.Close()
+		if err != nil {
+			log.Printf("Error closing listener: %v", err)
+		}
+	}
+}
+
+// shutdown stops the server in an orderly way: it stops accepting connections, stops the scheduler
+// and the current effect, optionally fades to black over fade, switches power off and frees the
+// hardware. The state file isn't touched, so a restart restores the state from before the
+// shutdown.
+func (s *Server) shutdown(fade time.Duration) {
+	log.Printf("Shutting down")
+	sdNotify("STOPPING=1")
+	s.closeListeners()
+	if s.web != nil {
+		err := s.web.Close()
+		if err != nil {
+			log.Printf("Error closing viewer: %v", err)
+		}
+	}
+	s.alarmMu.Lock()
+	if s.alarm != nil {
+		s.alarm.Stop()
+		s.alarm = nil
+	}
+	s.alarmMu.Unlock()
+	if s.sched != nil {
+		// Before the effect loop, which a due rule would otherwise wait for forever
+		s.sched.Stop()
+	}
+	done := make(chan bool)
+	s.quit <- done
+	<-done
+	s.recMu.Lock()
+	err := s.stopRecording()
+	s.recMu.Unlock()
+	if err != nil {
+		log.Printf("Failed stopping recording: %v", err)
+	}
+
+	if fade > 0 && !isDark(s.pa) {
+		log.Printf("Fading to black over %v", fade)
+		e := effects.NewFade(fade, pixarray.Pixel{R: 0, G: 0, B: 0, W: 0})
+		e.Start(s.pa, s.clock.Now())
+		for {
+			d := e.NextStep(s.pa, s.clock.Now())
+			s.pa.Write()
+			if d == 0 {
+				break
+			}
+			<-s.clock.After(d)
+		}
+	}
+	err = powerOff(s.pa.RPi())
+	if err != nil {
+		log.Printf("Failed power-off: %v", err)
+	}
+	err = s.pa.Close()
+	if err != nil {
+		log.Printf("Failed freeing hardware: %v", err)
+	}
+	log.Printf("Shut down")
+}
+
+// isDark returns whether every pixel in pa is off.
+func isDark(pa *pixarray.PixArray) bool {
+	for _, p := range pa.GetPixels() {
+		if p.R > 0 || p.G > 0 || p.B > 0 || p.W > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readPaletteFile reads palettes from the given file, if any, without defining them.
+func readPaletteFile(path string) ([]*effects.Palette, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ps, err := effects.ReadPalettes(f)
+	f.Close() // Ignore error
+	if err != nil {
+		return nil, fmt.Errorf("failed loading palettes from %s: %v", path, err)
+	}
+	return ps, nil
+}
+
+// loadPaletteFile loads palettes from the file given by --palettes, if any.
+func loadPaletteFile() error {
+	ps, err := readPaletteFile(*paletteFile)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		effects.DefinePalette(p)
+	}
+	return nil
+}
+
+// handleSignals reloads the config file on SIGHUP, and shuts down on SIGINT or SIGTERM, returning
+// once that's done.
+func (s *Server) handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			log.Printf("Got %v", sig)
+			signal.Stop(c)
+			s.shutdown(*shutdownFade)
+			return
+		}
+		_, _, err := s.reload()
+		if err != nil {
+			log.Printf("Failed reloading config: %v", err)
+		}
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		err := render(os.Args[2:])
+		if err == flag.ErrHelp {
+			return
+		}
+		if err != nil {
+			log.Fatalf("Failed rendering: %v", err)
+		}
+		return
+	}
 	flag.Parse()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Failed loading config: %v", err)
+	}
+	if *printConfig {
+		fmt.Print(cfg)
+		return
+	}
+	err = loadPaletteFile()
+	if err != nil {
+		log.Fatalf("Failed loading palettes: %v", err)
+	}
 	order := pixarray.StringOrders[*pixelOrder]
 	var leds pixarray.LEDStrip
-	var err error
 	switch *ledChip {
 	case "lpd8806":
 		dev, err := os.OpenFile(*lpd8806Dev, os.O_RDWR, os.ModePerm)
@@ -308,16 +1163,59 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed creating WS281x: %v", err)
 		}
+	case "ws281xspi":
+		dev, err := os.OpenFile(*lpd8806Dev, os.O_RDWR, os.ModePerm)
+		if err != nil {
+			log.Fatalf("Failed opening SPI: %v", err)
+		}
+		leds, err = pixarray.NewWS281xSPI(dev, *pixels, 3, order, *ws281xFreq, *ws281xSpiBits)
+		if err != nil {
+			log.Fatalf("Failed creating WS281x over SPI: %v", err)
+		}
+	case "sim":
+		leds = pixarray.NewSim(*pixels, 3)
 	default:
 		log.Fatalf("Unrecognized LED type: %v", *ledChip)
 	}
+	if *preview {
+		leds = pixarray.NewTerminal(leds, *pixels, os.Stdout, cfg.Layout.pixLayout(), *previewFPS)
+	}
+	var feed *pixarray.Feed
+	if cfg.Listen.HTTP != "" {
+		feed = pixarray.NewFeed(leds, *pixels)
+		leds = feed
+	}
 	pa := pixarray.NewPixArray(*pixels, 3, leds) // TODO: White
+	pa.SetCorrection(*brightness, *gamma)
 
-	s, err := NewServer(*port, pa)
+	s, err := NewServer(cfg.Listen, pa, clock.Real)
 	if err != nil {
 		log.Fatalf("Failed creating server: %v", err)
 	}
 
+	s.sched, err = schedule.NewScheduler(*scheduleFile, *latitude, *longitude, s.runScheduled, s.clock)
+	if err != nil {
+		log.Fatalf("Failed creating scheduler: %v", err)
+	}
+
 	go s.runEffects()
-	s.handleConnections()
+	err = s.restore()
+	if err != nil {
+		log.Printf("Failed restoring state: %v", err)
+	}
+	go s.sched.Run()
+	s.serve()
+	if feed != nil {
+		err = s.serveViewer(cfg.Listen, feed, cfg.Layout.pixLayout())
+		if err != nil {
+			log.Fatalf("Failed serving viewer: %v", err)
+		}
+	}
+	err = sdNotify("READY=1")
+	if err != nil {
+		log.Printf("Failed notifying systemd: %v", err)
+	}
+	go s.watchdog()
+	s.handleSignals()
+
 }
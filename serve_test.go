@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	clock "github.com/Jon-Bright/ledctl/clock"
+	effects "github.com/Jon-Bright/ledctl/effects"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	schedule "github.com/Jon-Bright/ledctl/schedule"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRejectNonPositiveDurations(t *testing.T) {
+	s := newTestServer(4)
+	w := bufio.NewWriter(ioutil.Discard)
+	for _, l := range []string{
+		"BREATHE 000000 7f7f7f 0",
+		"BREATHE 000000 7f7f7f -1",
+		"TWINKLE 0",
+		"SUNRISE 0",
+		"SUNSET 0 at=07:00",
+	} {
+		tk := strings.SplitN(l, " ", 2)
+		if _, err := s.createEffect(tk[0], tk[1], w); err == nil {
+			t.Errorf("'%s' accepted, wanted an error", l)
+		}
+	}
+}
+
+func TestNextWallClock(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 30, 0, 0, time.Local)
+	tests := []struct {
+		hhmm    string
+		want    time.Time
+		wantErr bool
+	}{
+		{"13:00", time.Date(2024, 3, 1, 13, 0, 0, 0, time.Local), false},
+		{"07:15", time.Date(2024, 3, 2, 7, 15, 0, 0, time.Local), false},
+		{"12:30", time.Date(2024, 3, 2, 12, 30, 0, 0, time.Local), false},
+		{"23:59", time.Date(2024, 3, 1, 23, 59, 0, 0, time.Local), false},
+		{"25:00", time.Time{}, true},
+		{"7am", time.Time{}, true},
+	}
+	for _, tc := range tests {
+		got, err := nextWallClock(now, tc.hhmm)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("'%s' accepted, wanted an error", tc.hhmm)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s' failed: %v", tc.hhmm, err)
+		} else if !got.Equal(tc.want) {
+			t.Errorf("Wrong time for '%s', got: %v, want: %v", tc.hhmm, got, tc.want)
+		}
+	}
+}
+
+func TestAlarm(t *testing.T) {
+	s := newTestServer(4)
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+
+	// An alarm that fires starts its effect
+	s.setAlarm(time.Now().Add(10*time.Millisecond), effects.NewSunrise(time.Second), "SUNRISE 1")
+	select {
+	case e := <-s.c:
+		if e.Name() != "SUNRISE" {
+			t.Errorf("Wrong effect from alarm: %s", e.Name())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Alarm didn't fire")
+	}
+
+	// A cancelled alarm doesn't
+	s.setAlarm(time.Now().Add(50*time.Millisecond), effects.NewSunset(time.Second), "SUNSET 1")
+	if _, err := s.createEffect("ALARM", "", w); err != nil || strings.HasPrefix(b.String(), "NONE") {
+		t.Errorf("Alarm not reported: '%s' (%v)", b.String(), err)
+	}
+	if _, err := s.createEffect("ALARM", "CANCEL", w); err != nil {
+		t.Errorf("Couldn't cancel alarm: %v", err)
+	}
+	select {
+	case e := <-s.c:
+		t.Errorf("Cancelled alarm started %s", e.Name())
+	case <-time.After(100 * time.Millisecond):
+	}
+	b.Reset()
+	if _, err := s.createEffect("ALARM", "", w); err != nil || b.String() != "NONE\n" {
+		t.Errorf("Wrong reply after cancelling: '%s' (%v)", b.String(), err)
+	}
+}
+
+func TestSegmentFade(t *testing.T) {
+	s := newTestServer(6)
+	setSegments([]SegmentConfig{{Name: "middle", Start: 2, Length: 2}})
+	defer setSegments(nil)
+	w := bufio.NewWriter(ioutil.Discard)
+	if _, err := s.createEffect("FADE_ALL", "ff0000 1 segment=nowhere", w); err == nil {
+		t.Errorf("Fade on unknown segment accepted")
+	}
+	e, err := s.createEffect("FADE_ALL", "ff0000 1 segment=middle", w)
+	if err != nil {
+		t.Fatalf("Couldn't create segment fade: %v", err)
+	}
+	tm := time.Now()
+	e.Start(s.pa, tm)
+	for d := time.Duration(1); d != 0; {
+		tm = tm.Add(d)
+		d = e.NextStep(s.pa, tm)
+	}
+	for i, p := range s.pa.GetPixels() {
+		want := pixarray.Pixel{R: 1, G: 2, B: 3, W: -1}
+		if i >= 2 && i < 4 {
+			want = pixarray.Pixel{R: 0xff, G: 0, B: 0, W: 0}
+		}
+		if p != want {
+			t.Errorf("Wrong pixel %d after segment fade, got: %v, want: %v", i, p, want)
+		}
+	}
+}
+
+func TestScheduleAddChecksCommand(t *testing.T) {
+	s := newTestServer(4)
+	var err error
+	s.sched, err = schedule.NewScheduler("", math.NaN(), math.NaN(), s.runScheduled, s.clock)
+	if err != nil {
+		t.Fatalf("Couldn't create scheduler: %v", err)
+	}
+	w := bufio.NewWriter(ioutil.Discard)
+	tests := []struct {
+		parms string
+		ok    bool
+	}{
+		{"ADD 0 7 * * * FADE_ALL ff0000 60", true},
+		{"ADD 0 23 * * * OFF ease=in_quad", true},
+		{"ADD 30 6 * * 1-5 SUNRISE 1800", true},
+		{"ADD 0 7 * * * FADE_ALL ff0000", false},
+		{"ADD 0 7 * * * RAINBOW x", false},
+		{"ADD 0 7 * * * OFF ease=wobbly", false},
+		{"ADD 0 7 * * * SUNRISE 0", false},
+		{"ADD 0 7 * * * NOPE", false},
+		{"ADD 0 7 * * * COLOUR", false},
+	}
+	for _, tc := range tests {
+		if _, err := s.createEffect("SCHEDULE", tc.parms, w); (err == nil) != tc.ok {
+			t.Errorf("Wrong result for SCHEDULE %s, got: %v, want ok: %v", tc.parms, err, tc.ok)
+		}
+	}
+	if n := len(s.sched.Rules()); n != 3 {
+		t.Errorf("Wrong number of rules added, got: %d, want: 3", n)
+	}
+	if len(s.c) != 0 || s.alarm != nil {
+		t.Errorf("Checking a scheduled command ran it")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		start pixarray.Pixel
+		fade  time.Duration
+	}{
+		{"fade", pixarray.Pixel{R: 1, G: 2, B: 3, W: 0}, 50 * time.Millisecond},
+		{"no fade", pixarray.Pixel{R: 1, G: 2, B: 3, W: 0}, 0},
+		// Already dark, so the (long) fade is skipped
+		{"dark", pixarray.Pixel{R: 0, G: 0, B: 0, W: 0}, time.Hour},
+	}
+	for _, tc := range tests {
+		s := newTestServer(4)
+		leds := &testLeds{pixels: make([]pixarray.Pixel, 4)}
+		s.pa = pixarray.NewPixArray(4, 3, leds)
+		s.pa.SetAll(tc.start)
+		var err error
+		s.sched, err = schedule.NewScheduler("", math.NaN(), math.NaN(), s.runScheduled, s.clock)
+		if err != nil {
+			t.Fatalf("Couldn't create scheduler: %v", err)
+		}
+		go s.sched.Run()
+		go s.runEffects()
+		done := make(chan bool)
+		go func() {
+			s.shutdown(tc.fade)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: shutdown didn't finish", tc.name)
+		}
+		if !leds.closed {
+			t.Errorf("%s: LEDs not closed", tc.name)
+		}
+		want := pixarray.Pixel{R: 0, G: 0, B: 0, W: 0}
+		if tc.fade == 0 {
+			want = tc.start
+		}
+		for i, p := range s.pa.GetPixels() {
+			if p != want {
+				t.Errorf("%s: wrong pixel %d after shutdown, got: %v, want: %v", tc.name, i, p, want)
+			}
+		}
+	}
+}
+
+// TestCycleFakeClock runs a half-hour CYCLE against a fake clock, which should take well under a
+// second of real time.
+func TestCycleFakeClock(t *testing.T) {
+	s := newTestServer(4)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fc := clock.NewFake(start)
+	s.clock = fc
+	go s.runEffects()
+	e, err := s.createEffect("CYCLE", "1800", bufio.NewWriter(ioutil.Discard))
+	if err != nil {
+		t.Fatalf("Couldn't create cycle: %v", err)
+	}
+	s.startEffect(e, "CYCLE 1800")
+	end := start.Add(30 * time.Minute)
+	steps := 0
+	var sawR, sawG, sawB bool
+	for fc.Now().Before(end) {
+		// Once runEffects is waiting for its next step, it's done this one
+		fc.BlockUntil(1)
+		p := s.pa.GetPixel(0)
+		sawR = sawR || p.R == 127
+		sawG = sawG || p.G == 127
+		sawB = sawB || p.B == 127
+		fc.Next()
+		steps++
+	}
+	if steps < 768 {
+		t.Errorf("Too few steps in a full cycle, got: %d, want: >=768", steps)
+	}
+	if !sawR || !sawG || !sawB {
+		t.Errorf("Cycle didn't go all the way round, saw red: %v, green: %v, blue: %v", sawR, sawG, sawB)
+	}
+	done := make(chan bool)
+	s.quit <- done
+	<-done
+}
+
+func TestParseColorSyntax(t *testing.T) {
+	s := newTestServer(4)
+	tests := []struct {
+		in   string
+		want pixarray.Pixel
+		ok   bool
+	}{
+		{"7f0000 1", pixarray.Pixel{R: 0x7f, G: 0, B: 0, W: 0}, true},
+		{"red 1", pixarray.Pixel{R: 0xff, G: 0, B: 0, W: 0}, true},
+		{"#00ff00 1", pixarray.Pixel{R: 0, G: 0xff, B: 0, W: 0}, true},
+		{"hsv(240,1,0.5) 1", pixarray.Pixel{R: 0, G: 0, B: 0x80, W: 0}, true},
+		{"6600K 1", pixarray.Pixel{R: 0xff, G: 0xff, B: 0xff, W: 0}, true},
+		{"7f00007f 1", pixarray.Pixel{}, false},      // The test LEDs are RGB
+		{"rgbw(0,0,0,1) 1", pixarray.Pixel{}, false}, // Likewise
+		{"notacolour 1", pixarray.Pixel{}, false},
+	}
+	for _, tc := range tests {
+		rest, p, err := s.parseColor(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("Wrong error for '%s', got: %v, want ok: %v", tc.in, err, tc.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if *p != tc.want || rest != "1" {
+			t.Errorf("Wrong result for '%s', got: %v, '%s', want: %v, '1'", tc.in, *p, rest, tc.want)
+		}
+	}
+}
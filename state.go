@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	effects "github.com/Jon-Bright/ledctl/effects"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var stateFile = flag.String("state", "", "A file in which to save the current state (last effect, on/off and colour) whenever it changes. Empty means state isn't saved")
+var restoreState = flag.Bool("restore", false, "Whether to restore the state saved in the -state file at startup")
+
+// savedState is what's written to the state file. Command is the command line that started the
+// last effect, i.e. what ON would resume, and Running is whether it was still running. Colour is
+// the colour of the first pixel: if the last effect finished, this is the constant colour (and
+// brightness) the LEDs were left showing.
+type savedState struct {
+	Command string `json:"command"`
+	Running bool   `json:"running"`
+	Off     bool   `json:"off"`
+	Colour  string `json:"colour"`
+}
+
+// How long restoring takes to fade to the colour a finished effect left the LEDs at.
+const restoreFade = time.Second
+
+// saveState writes the server's current state to the state file, if there is one. running says
+// whether the last effect is still running. Errors are logged, but otherwise ignored: failing to
+// save state shouldn't stop the lights working. s.stateMu mustn't be held.
+func (s *Server) saveState(running bool) {
+	if *stateFile == "" {
+		return
+	}
+	// Hold the lock while writing too, so that an older snapshot can't be written over a newer one
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	p := s.pa.GetPixel(0)
+	st := savedState{
+		Command: s.lastCmd,
+		Running: running,
+		Off:     s.off,
+		Colour:  p.String(),
+	}
+	b, err := json.Marshal(&st)
+	if err != nil {
+		log.Printf("Couldn't marshal state: %v", err)
+		return
+	}
+	tmp := *stateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, append(b, '\n'), 0644)
+	if err == nil {
+		err = os.Rename(tmp, *stateFile)
+	}
+	if err != nil {
+		log.Printf("Couldn't save state to %s: %v", *stateFile, err)
+	}
+}
+
+// loadState reads the state file.
+func loadState() (*savedState, error) {
+	b, err := ioutil.ReadFile(*stateFile)
+	if err != nil {
+		return nil, err
+	}
+	var st savedState
+	err = json.Unmarshal(b, &st)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %v", *stateFile, err)
+	}
+	return &st, nil
+}
+
+// restore puts the server back into the state saved in the state file, if restoring is turned on
+// and there's anything to restore. runEffects must already be running.
+func (s *Server) restore() error {
+	if *stateFile == "" || !*restoreState {
+		return nil
+	}
+	st, err := loadState()
+	if os.IsNotExist(err) {
+		log.Printf("No saved state in %s", *stateFile)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Restoring state %+v", *st)
+	if st.Command == "" {
+		return nil
+	}
+	t := strings.SplitN(st.Command, " ", 2)
+	parms := ""
+	if len(t) > 1 {
+		parms = t[1]
+	}
+	e, err := s.createEffect(strings.ToUpper(t[0]), parms, bufio.NewWriter(ioutil.Discard))
+	if err != nil {
+		return fmt.Errorf("couldn't recreate '%s': %v", st.Command, err)
+	}
+	if e == nil {
+		return fmt.Errorf("'%s' isn't an effect", st.Command)
+	}
+	if st.Off {
+		// Nothing to show, but ON should still resume the last effect
+		s.stateMu.Lock()
+		s.laste = e
+		s.lastCmd = st.Command
+		s.stateMu.Unlock()
+		return nil
+	}
+	var p *pixarray.Pixel
+	if st.Colour != "" {
+		_, p, err = s.parseColor(st.Colour)
+		if err != nil {
+			log.Printf("Couldn't restore colour '%s': %v", st.Colour, err)
+			p = nil
+		}
+	}
+	if !st.Running {
+		// The effect had finished, so just go back to where it left the LEDs. Replaying it would
+		// e.g. start a finished SUNSET from full brightness again. ON still resumes it.
+		s.stateMu.Lock()
+		s.laste = e
+		s.lastCmd = st.Command
+		s.off = false
+		s.stateMu.Unlock()
+		if p != nil {
+			s.c <- effects.NewFade(restoreFade, *p)
+		}
+		s.saveState(false)
+		return nil
+	}
+	if p != nil {
+		// Start from the colour we left off at, so e.g. a cycle carries on from where it was.
+		s.pa.SetAll(*p)
+	}
+	s.startEffect(e, st.Command)
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	*stateFile = filepath.Join(dir, "state")
+	*restoreState = true
+	defer func() {
+		*stateFile = ""
+		*restoreState = false
+	}()
+
+	tests := []struct {
+		name      string
+		cmd       string
+		colour    pixarray.Pixel
+		running   bool
+		off       bool
+		wantStart string // Name of the effect restoring starts, if any
+		wantPix   pixarray.Pixel
+	}{
+		// A finished effect isn't replayed, just faded back to
+		{"finished", "SUNSET 1800", pixarray.Pixel{R: 0x20, G: 0x10, B: 0, W: -1}, false, false, "FADE", pixarray.Pixel{R: 1, G: 2, B: 3, W: -1}},
+		// A running effect carries on from its colour
+		{"running", "CYCLE 60", pixarray.Pixel{R: 0x40, G: 0, B: 0, W: -1}, true, false, "CYCLE", pixarray.Pixel{R: 0x40, G: 0, B: 0, W: 0}},
+		// Off stays off
+		{"off", "RAINBOW 60", pixarray.Pixel{R: 0, G: 0, B: 0, W: -1}, true, true, "", pixarray.Pixel{R: 1, G: 2, B: 3, W: -1}},
+	}
+	for _, tc := range tests {
+		s := newTestServer(4)
+		s.pa.SetAll(tc.colour)
+		s.lastCmd = tc.cmd
+		s.off = tc.off
+		s.saveState(tc.running)
+
+		s = newTestServer(4)
+		err := s.restore()
+		if err != nil {
+			t.Errorf("%s: couldn't restore: %v", tc.name, err)
+			continue
+		}
+		if s.lastCmd != tc.cmd || s.laste == nil || s.off != tc.off {
+			t.Errorf("%s: wrong restored state, command '%s', laste %v, off %v", tc.name, s.lastCmd, s.laste, s.off)
+		}
+		started := ""
+		if len(s.c) > 0 {
+			started = (<-s.c).Name()
+		}
+		if started != tc.wantStart {
+			t.Errorf("%s: restoring started '%s', want '%s'", tc.name, started, tc.wantStart)
+		}
+		if p := s.pa.GetPixel(0); p != tc.wantPix {
+			t.Errorf("%s: wrong restored pixel, got: %v, want: %v", tc.name, p, tc.wantPix)
+		}
+	}
+
+	// A query in the state file is an error, not a crash
+	err = ioutil.WriteFile(*stateFile, []byte(`{"command":"PALETTE LIST","running":true,"off":false,"colour":"000000"}`), 0644)
+	if err != nil {
+		t.Fatalf("Couldn't write state: %v", err)
+	}
+	if err := newTestServer(4).restore(); err == nil {
+		t.Errorf("Restored a query without error")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The first file descriptor systemd passes for socket activation.
+const listenFDsStart = 3
+
+// activatedListeners returns the listeners passed by systemd socket activation, if any, by kind
+// ("fd<n>"). TCP listeners use TLS if lc says so.
+func activatedListeners(lc ListenConfig) (map[string]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	// Child processes shouldn't think the sockets are theirs
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	ls := map[string]net.Listener{}
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		name := fmt.Sprintf("fd%d", fd)
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close() // Ignore error, FileListener has its own copy
+		if err == nil && l.Addr().Network() == "tcp" {
+			l, err = withTLS(lc, l)
+		}
+		if err != nil {
+			for _, l := range ls {
+				l.Close() // Ignore error, we already have one
+			}
+			return nil, fmt.Errorf("couldn't use socket %s from systemd: %v", name, err)
+		}
+		ls[name] = l
+	}
+	return ls, nil
+}
+
+// sdNotify tells systemd about the server's state, if systemd is waiting to hear about it (with
+// Type=notify).
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// An abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often systemd wants to hear that the server is still alive, or 0
+// if it doesn't.
+func watchdogInterval() time.Duration {
+	us, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || us <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(us) * time.Microsecond
+}
+
+// watchdog tells systemd the server is still alive, twice per watchdog interval, for as long as
+// the effect loop keeps responding. If the effect loop gets stuck (e.g. writing to the LEDs),
+// systemd notices and can restart the server.
+func (s *Server) watchdog() {
+	d := watchdogInterval()
+	if d == 0 {
+		return
+	}
+	log.Printf("Notifying systemd watchdog every %v", d/2)
+	t := time.NewTicker(d / 2)
+	defer t.Stop()
+	for range t.C {
+		p := make(chan bool)
+		select {
+		case s.ping <- p:
+			<-p
+		case <-time.After(d / 2):
+			log.Printf("Effect loop not responding, not notifying watchdog")
+			continue
+		}
+		err := sdNotify("WATCHDOG=1")
+		if err != nil {
+			log.Printf("Failed notifying watchdog: %v", err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledctl")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Couldn't listen for notifications: %v", err)
+	}
+	defer c.Close()
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	err = sdNotify("READY=1")
+	if err != nil {
+		t.Fatalf("Couldn't notify: %v", err)
+	}
+	c.SetDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 64)
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatalf("Couldn't read notification: %v", err)
+	}
+	if got := string(b[:n]); got != "READY=1" {
+		t.Errorf("Wrong notification, got: '%s', want: 'READY=1'", got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	tests := []struct {
+		usec string
+		pid  string
+		want time.Duration
+	}{
+		{"", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", strconv.Itoa(os.Getpid()), 30 * time.Second},
+		{"30000000", strconv.Itoa(os.Getpid() + 1), 0}, // Meant for someone else
+		{"bogus", "", 0},
+	}
+	for _, tc := range tests {
+		os.Setenv("WATCHDOG_USEC", tc.usec)
+		os.Setenv("WATCHDOG_PID", tc.pid)
+		if got := watchdogInterval(); got != tc.want {
+			t.Errorf("Wrong interval for WATCHDOG_USEC '%s', WATCHDOG_PID '%s', got: %v, want: %v", tc.usec, tc.pid, got, tc.want)
+		}
+	}
+}
+
+func TestNotActivated(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	ls, err := activatedListeners(ListenConfig{})
+	if err != nil || ls != nil {
+		t.Errorf("Used sockets meant for another process, got: %v, %v", ls, err)
+	}
+}
+
+func TestEffectLoopAnswersPing(t *testing.T) {
+	s := newTestServer(4)
+	s.ping = make(chan chan bool)
+	go s.runEffects()
+	p := make(chan bool)
+	select {
+	case s.ping <- p:
+		<-p
+	case <-time.After(time.Second):
+		t.Errorf("Effect loop didn't answer ping")
+	}
+	done := make(chan bool)
+	s.quit <- done
+	<-done
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The most frames per second the viewer is sent. The feed always catches up with the latest frame.
+const viewerFPS = 30
+
+//go:embed web/viewer.html
+var viewerPage []byte
+
+// A viewerEffect is an effect the viewer offers, with the parameters it asks for, in order:
+// "low" (a second colour, for BREATHE), "colour" and "duration". Anything else (e.g. options) can
+// be added in the viewer.
+type viewerEffect struct {
+	Name   string   `json:"name"`
+	Params []string `json:"params"`
+}
+
+var viewerEffects = []viewerEffect{
+	{"FADE_ALL", []string{"colour", "duration"}},
+	{"ZIP_SET_ALL", []string{"colour", "duration"}},
+	{"BREATHE", []string{"low", "colour", "duration"}},
+	{"CYCLE", []string{"duration"}},
+	{"RAINBOW", []string{"duration"}},
+	{"TWINKLE", []string{"duration"}},
+	{"KNIGHTRIDER", []string{"duration"}},
+	{"SUNRISE", []string{"duration"}},
+	{"SUNSET", []string{"duration"}},
+}
+
+// viewerInfo tells the viewer how to draw the LEDs and what it can do with them.
+type viewerInfo struct {
+	Pixels  int            `json:"pixels"`
+	Shape   string         `json:"shape"`
+	Width   float64        `json:"width"`
+	Height  float64        `json:"height"`
+	Points  [][2]float64   `json:"points"`
+	Effects []viewerEffect `json:"effects"`
+}
+
+// viewerReply is the reply to a command sent from the viewer, like a protocol 2 reply.
+type viewerReply struct {
+	Status  int      `json:"status"`
+	Message string   `json:"message"`
+	Data    []string `json:"data,omitempty"`
+}
+
+// serveViewer serves the browser viewer on the address in lc, showing the frames from feed with
+// the given layout. It uses TLS if lc has a certificate and key.
+func (s *Server) serveViewer(lc ListenConfig, feed *pixarray.Feed, layout pixarray.Layout) error {
+	l, err := net.Listen("tcp", lc.HTTP)
+	if err != nil {
+		return err
+	}
+	l, err = withTLS(lc, l)
+	if err != nil {
+		l.Close() // Ignore error, we already have one
+		return err
+	}
+	log.Printf("Serving viewer on %s", l.Addr())
+	s.web = &http.Server{Handler: s.viewerHandler(feed, layout)}
+	go func() {
+		err := s.web.Serve(l)
+		if err != http.ErrServerClosed {
+			log.Printf("Viewer stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// viewerHandler returns the handler for the viewer's page and API.
+func (s *Server) viewerHandler(feed *pixarray.Feed, layout pixarray.Layout) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		if !s.authorize(w, r, "COLOUR", "") {
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(viewerPage) // Ignore error, the viewer's gone
+	})
+	mux.HandleFunc("/api/info", func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorize(w, r, "COLOUR", "") {
+			return
+		}
+		n := s.pa.NumPixels()
+		vi := viewerInfo{Pixels: n, Shape: layout.Shape, Points: make([][2]float64, n), Effects: viewerEffects}
+		vi.Width, vi.Height = layout.Size(n)
+		for i := range vi.Points {
+			vi.Points[i][0], vi.Points[i][1] = layout.Point(i, n)
+		}
+		writeJSON(w, http.StatusOK, vi)
+	})
+	mux.HandleFunc("/api/frames", func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorize(w, r, "COLOUR", "") {
+			return
+		}
+		s.sendFrames(w, r, feed)
+	})
+	mux.HandleFunc("/api/command", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "commands must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !sameSite(r) {
+			http.Error(w, "commands must come from the viewer", http.StatusForbidden)
+			return
+		}
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		l := strings.TrimSpace(string(b))
+		t := strings.SplitN(l, " ", 2)
+		cmd := strings.ToUpper(t[0])
+		parms := ""
+		if len(t) > 1 {
+			parms = t[1]
+		}
+		if !s.authorize(w, r, cmd, parms) {
+			return
+		}
+		log.Printf("Got viewer command '%s'", l)
+		switch cmd {
+		case "AUTH", "PROTOCOL", "QUIT", "SUBSCRIBE":
+			// Only make sense on a connection
+			writeJSON(w, http.StatusBadRequest, viewerReply{Status: statusError, Message: cmd + " isn't available from the viewer"})
+			return
+		}
+		e, data, err := s.collect(cmd, parms, l)
+		if err != nil {
+			writeJSON(w, statusFor(err), viewerReply{Status: statusFor(err), Message: err.Error()})
+			return
+		}
+		if e != nil {
+			s.startEffect(e, l)
+		}
+		writeJSON(w, http.StatusOK, viewerReply{Status: statusOK, Message: "OK", Data: data})
+	})
+	return mux
+}
+
+// viewerHeader is set by the viewer page on every command. A cross-site form can't set headers,
+// and a cross-site script can't without a CORS preflight, which the viewer never allows.
+const viewerHeader = "X-Ledctl-Viewer"
+
+// sameSite reports whether r could have come from the viewer's own page: it must carry
+// viewerHeader and, if the browser sent an Origin, that must be the viewer's own host.
+func sameSite(r *http.Request) bool {
+	if r.Header.Get(viewerHeader) == "" {
+		return false
+	}
+	o := r.Header.Get("Origin")
+	if o == "" {
+		return true
+	}
+	u, err := url.Parse(o)
+	return err == nil && u.Host == r.Host
+}
+
+// authorize checks that the request's HTTP basic authentication allows it to run cmd, replying
+// with an error if not. With a token, the user name is left empty and the token is the password.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, cmd, parms string) bool {
+	a := s.getAuth()
+	rl := a.initialRole()
+	var err error
+	if u, p, ok := r.BasicAuth(); ok && a.required() {
+		if u != "" {
+			p = u + " " + p
+		}
+		rl, err = a.login(p)
+	}
+	if err == nil {
+		err = checkAllowed(rl, cmd, parms)
+	}
+	if err == nil {
+		return true
+	}
+	code := statusFor(err) // The protocol's statuses are HTTP's
+	if code == statusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ledctl"`)
+	}
+	http.Error(w, err.Error(), code)
+	return false
+}
+
+// sendFrames sends the frames from feed as server-sent events, until the viewer goes away. Each
+// frame is the pixels' colours as 8-bit RGB hex, six digits per pixel, with no separators.
+func (s *Server) sendFrames(w http.ResponseWriter, r *http.Request, feed *pixarray.Feed) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	c := feed.Watch()
+	defer feed.Unwatch(c)
+	max := s.pa.MaxPerChannel()
+	var b strings.Builder
+	for {
+		select {
+		case f := <-c:
+			b.Reset()
+			for i := range f {
+				r, g, bl := f[i].To8Bit(max)
+				fmt.Fprintf(&b, "%02x%02x%02x", r, g, bl)
+			}
+			_, err := fmt.Fprintf(w, "data: %s\n\n", b.String())
+			if err != nil {
+				return
+			}
+			fl.Flush()
+		case <-r.Context().Done():
+			return
+		}
+		select {
+		case <-time.After(time.Second / viewerFPS):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v) // Ignore error, the viewer's gone
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	pixarray "github.com/Jon-Bright/ledctl/pixarray"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestViewer serves the viewer for s, on simulated LEDs laid out in a ring.
+func newTestViewer(s *Server) *httptest.Server {
+	feed := pixarray.NewFeed(pixarray.NewSim(s.pa.NumPixels(), 3), s.pa.NumPixels())
+	s.pa = pixarray.NewPixArray(s.pa.NumPixels(), 3, feed)
+	return httptest.NewServer(s.viewerHandler(feed, pixarray.Layout{Shape: "ring", Width: 1}))
+}
+
+func viewerRequest(t *testing.T, method, url, user, password, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Couldn't make request: %v", err)
+	}
+	if user != "" || password != "" {
+		req.SetBasicAuth(user, password)
+	}
+	req.Header.Set(viewerHeader, "1")
+	return doViewerRequest(t, req)
+}
+
+// doViewerRequest sends req and returns the reply's status and body.
+func doViewerRequest(t *testing.T, req *http.Request) (int, string) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Couldn't %s %s: %v", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Couldn't read reply to %s %s: %v", req.Method, req.URL, err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestViewerAPI(t *testing.T) {
+	s := newTestServer(8)
+	hs := newTestViewer(s)
+	defer hs.Close()
+
+	code, body := viewerRequest(t, "GET", hs.URL+"/api/info", "", "", "")
+	if code != http.StatusOK {
+		t.Fatalf("Couldn't get info: %d %s", code, body)
+	}
+	var vi viewerInfo
+	err := json.Unmarshal([]byte(body), &vi)
+	if err != nil {
+		t.Fatalf("Couldn't parse info: %v", err)
+	}
+	if vi.Pixels != 8 || len(vi.Points) != 8 || vi.Shape != "ring" || len(vi.Effects) == 0 {
+		t.Errorf("Wrong info: %+v", vi)
+	}
+
+	tests := []struct {
+		method string
+		send   string
+		code   int
+		want   string
+	}{
+		{"POST", "FADE_ALL #ff0000 1", http.StatusOK, `"message":"OK"`},
+		{"POST", "SEGMENTS", http.StatusOK, `"message":"OK"`},
+		{"POST", "NOPE", http.StatusNotFound, "unknown command: NOPE"},
+		{"POST", "FADE_ALL red", http.StatusBadRequest, "error parsing duration"},
+		{"POST", "SUBSCRIBE", http.StatusBadRequest, "isn't available from the viewer"},
+		{"GET", "MODE", http.StatusMethodNotAllowed, "POSTed"},
+	}
+	for _, tc := range tests {
+		code, body := viewerRequest(t, tc.method, hs.URL+"/api/command", "", "", tc.send)
+		if code != tc.code || !strings.Contains(body, tc.want) {
+			t.Errorf("Wrong reply to %s '%s', got: %d %s, want: %d containing '%s'", tc.method, tc.send, code, body, tc.code, tc.want)
+		}
+	}
+	if len(s.c) != 1 {
+		t.Errorf("Wrong number of effects started, got: %d, want: 1", len(s.c))
+	}
+}
+
+func TestViewerCrossSite(t *testing.T) {
+	s := newTestServer(4)
+	hs := newTestViewer(s)
+	defer hs.Close()
+
+	tests := []struct {
+		name   string
+		header string
+		origin string
+		code   int
+	}{
+		{"no header", "", "", http.StatusForbidden},
+		{"foreign origin", "1", "http://evil.example", http.StatusForbidden},
+		{"same origin", "1", hs.URL, http.StatusOK},
+		{"no origin", "1", "", http.StatusOK},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest("POST", hs.URL+"/api/command", strings.NewReader("FADE_ALL ff0000 1"))
+		if err != nil {
+			t.Fatalf("Couldn't make request: %v", err)
+		}
+		if tc.header != "" {
+			req.Header.Set(viewerHeader, tc.header)
+		}
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		code, body := doViewerRequest(t, req)
+		if code != tc.code {
+			t.Errorf("%s: wrong status, got: %d %s, want: %d", tc.name, code, body, tc.code)
+		}
+	}
+	if len(s.c) != 2 {
+		t.Errorf("Wrong number of effects started, got: %d, want: 2", len(s.c))
+	}
+}
+
+func TestViewerAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledctl")
+	if err != nil {
+		t.Fatalf("Couldn't make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s := newTestServer(4)
+	s.auth, err = loadAuth(writeAuthFiles(t, dir))
+	if err != nil {
+		t.Fatalf("Couldn't load auth: %v", err)
+	}
+	hs := newTestViewer(s)
+	defer hs.Close()
+
+	tests := []struct {
+		method, path, user, password, send string
+		code                               int
+	}{
+		{"GET", "/", "", "", "", http.StatusUnauthorized},
+		{"GET", "/", "visitor", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/", "visitor", "guest", "", http.StatusOK},
+		{"GET", "/api/info", "visitor", "guest", "", http.StatusOK},
+		{"POST", "/api/command", "visitor", "guest", "MODE", http.StatusOK},
+		{"POST", "/api/command", "visitor", "guest", "FADE_ALL ff0000 1", http.StatusForbidden},
+		{"POST", "/api/command", "", "s3cret", "FADE_ALL ff0000 1", http.StatusOK},
+		{"GET", "/nope", "", "s3cret", "", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		code, body := viewerRequest(t, tc.method, hs.URL+tc.path, tc.user, tc.password, tc.send)
+		if code != tc.code {
+			t.Errorf("Wrong status for %s %s '%s' as '%s', got: %d %s, want: %d", tc.method, tc.path, tc.send, tc.user, code, body, tc.code)
+		}
+	}
+}
+
+func TestViewerFrames(t *testing.T) {
+	s := newTestServer(2)
+	hs := newTestViewer(s)
+	defer hs.Close()
+
+	resp, err := http.Get(hs.URL + "/api/frames")
+	if err != nil {
+		t.Fatalf("Couldn't get frames: %v", err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	next := func() string {
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Couldn't read frame: %v", err)
+			}
+			if strings.HasPrefix(l, "data: ") {
+				return strings.TrimSpace(strings.TrimPrefix(l, "data: "))
+			}
+		}
+	}
+	if got, want := next(), "000000000000"; got != want {
+		t.Errorf("Wrong first frame, got: %s, want: %s", got, want)
+	}
+	// Only the last of several frames written quickly is sure to be sent
+	s.pa.SetAll(pixarray.Pixel{R: 1, G: 2, B: 3, W: -1})
+	s.pa.Write()
+	s.pa.SetOne(1, pixarray.Pixel{R: 255, G: 128, B: 0, W: -1})
+	s.pa.Write()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := next()
+		if got == "010203ff8000" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Latest frame not sent, last got: %s", got)
+		}
+	}
+}